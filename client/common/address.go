@@ -0,0 +1,36 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Prefix of the server addresses of unix domain sockets
+const UNIX_ADDRESS_SCHEME = "unix:"
+
+// ParseServerAddress Returns the network and the address to dial for a server
+// address, which is either host:port, unix:///path/to.sock for a socket in
+// the filesystem or unix:@name for a socket in the abstract namespace
+func ParseServerAddress(address string) (string, string, error) {
+	if !strings.HasPrefix(address, UNIX_ADDRESS_SCHEME) {
+		return "tcp", address, nil
+	}
+
+	path := strings.TrimPrefix(address, UNIX_ADDRESS_SCHEME)
+	switch {
+	case strings.HasPrefix(path, "//"):
+		// The path of a unix:// URL must be absolute
+		path = strings.TrimPrefix(path, "//")
+		if !strings.HasPrefix(path, "/") {
+			return "", "", fmt.Errorf("invalid server address %v: socket path must be absolute", address)
+		}
+	case strings.HasPrefix(path, "@"):
+		// A leading @ stands for the abstract namespace when dialing
+		if len(path) == 1 {
+			return "", "", fmt.Errorf("invalid server address %v: empty abstract socket name", address)
+		}
+	default:
+		return "", "", fmt.Errorf("invalid server address %v: expected unix:///path or unix:@name", address)
+	}
+	return "unix", path, nil
+}
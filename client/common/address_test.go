@@ -0,0 +1,41 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestParseServerAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		path    string
+		valid   bool
+	}{
+		{address: "server:12345", network: "tcp", path: "server:12345", valid: true},
+		{address: "127.0.0.1:12345", network: "tcp", path: "127.0.0.1:12345", valid: true},
+		{address: "unix:///tmp/server.sock", network: "unix", path: "/tmp/server.sock", valid: true},
+		{address: "unix:@server", network: "unix", path: "@server", valid: true},
+		{address: "unix://server.sock", valid: false},
+		{address: "unix:@", valid: false},
+		{address: "unix:/tmp/server.sock", valid: false},
+		{address: "unix:", valid: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			network, path, err := ParseServerAddress(test.address)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("expected an error, got %v %v", network, path)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network != test.network || path != test.path {
+				t.Fatalf("expected %v %v, got %v %v", test.network, test.path, network, path)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ErrAuthenticationFailed Returned when the server rejects the agency because
+// it failed to authenticate. Connecting again would fail the same way
+var ErrAuthenticationFailed = errors.New("agency authentication failed")
+
+// AuthResponse Returns the answer to a challenge: the HMAC-SHA256 of the
+// nonce followed by the agency, keyed with the secret of the agency
+func AuthResponse(secret, nonce []byte, agency_id int) []byte {
+	agency := make([]byte, AUTH_AGENCY_LENGTH_IN_BYTES)
+	_PutField(agency, agency_id)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write(agency)
+	return mac.Sum(nil)
+}
+
+// Authenticate Answers the challenge the server sends after agreeing on
+// authentication, and waits for the server to accept the agency. Returns
+// ErrAuthenticationFailed if the server rejects it
+func Authenticate(conn *FramedConn, agency_id int, secret []byte) error {
+	message, err := ReceiveMessage(conn)
+	if err != nil {
+		return err
+	}
+	challenge, ok := message.(*ChallengeMessage)
+	if !ok {
+		return fmt.Errorf("unexpected message code: %v", message.Code())
+	}
+
+	err = SendMessage(conn, agency_id, &AuthMessage{Response: AuthResponse(secret, challenge.Nonce, agency_id)})
+	if err != nil {
+		return err
+	}
+
+	message, err = ReceiveMessage(conn)
+	if err != nil {
+		return err
+	}
+	if _, ok := message.(*AuthOkMessage); !ok {
+		return fmt.Errorf("unexpected message code: %v", message.Code())
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/conformance"
+)
+
+func TestAuthResponseMatchesVector(t *testing.T) {
+	var nonce []byte
+	for _, vector := range _LoadVectors(t, conformance.SENDER_SERVER) {
+		if vector.Name == "challenge_v2" {
+			_, _, message := _ParseVector(t, vector)
+			nonce = message.(*ChallengeMessage).Nonce
+		}
+	}
+	for _, vector := range _LoadVectors(t, conformance.SENDER_CLIENT) {
+		if vector.Name != "auth_v2" {
+			continue
+		}
+		_, _, message := _ParseVector(t, vector)
+		expected := message.(*AuthMessage).Response
+
+		if response := AuthResponse([]byte(vector.Secret), nonce, vector.Agency); !bytes.Equal(response, expected) {
+			t.Fatalf("expected response %x, got %x", expected, response)
+		}
+		if response := AuthResponse([]byte("another secret"), nonce, vector.Agency); bytes.Equal(response, expected) {
+			t.Fatal("expected the response to depend on the secret")
+		}
+		if response := AuthResponse([]byte(vector.Secret), nonce, vector.Agency+1); bytes.Equal(response, expected) {
+			t.Fatal("expected the response to depend on the agency")
+		}
+		return
+	}
+	t.Fatal("no auth vector")
+}
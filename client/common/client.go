@@ -1,6 +1,9 @@
 package common
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
@@ -10,6 +13,17 @@ import (
 )
 
 const DEFAULT_BETS_PER_BATCH = 250
+const DEFAULT_HANDSHAKE_TIMEOUT = time.Second
+const DEFAULT_MAX_RETRANSMISSIONS = 3
+const DEFAULT_WINDOW_SIZE = 1
+const DEFAULT_MAX_RECONNECTIONS = 3
+const DEFAULT_HEARTBEAT_INTERVAL = 5 * time.Second
+const DEFAULT_MAX_MISSED_PONGS = 3
+const DEFAULT_CONNECT_TIMEOUT = 5 * time.Second
+const DEFAULT_WRITE_TIMEOUT = 5 * time.Second
+const DEFAULT_READ_TIMEOUT = 10 * time.Second
+const DEFAULT_RESULTS_TIMEOUT = time.Minute
+const DEFAULT_POLL_INTERVAL = 2 * time.Second
 
 const SEND_BETS_PHASE = 0
 const CONSULT_WINNERS_PHASE = 1
@@ -19,18 +33,69 @@ const ANNOUNCE_WINNERS_PHASE = 2
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
-	LoopLapse     time.Duration
-	LoopPeriod    time.Duration
-	BetsPerBatch  int
+	// Time the client may run. Operations in progress are interrupted once
+	// it passes
+	LoopLapse    time.Duration
+	LoopPeriod   time.Duration
+	BetsPerBatch int
+	// Largest frame the client may send. Larger batches are split
+	MaxFrameSize int
+	// Times a bet batch rejected by the server is sent again before failing
+	MaxRetransmissions int
+	// Time to wait for the server to answer the connect message before
+	// falling back to the legacy protocol. Zero disables the negotiation
+	HandshakeTimeout time.Duration
+	// Bet batches that may be sent before the server confirms the first of them
+	WindowSize int
+	// Times the client connects again after losing the connection while
+	// sending bets before failing
+	MaxReconnections int
+	// Whether bet batches are compressed when the server supports it
+	Compression bool
+	// Transport security of the connection with the server
+	TLS TLSConfig
+	// Secret of the agency used to answer the authentication challenge.
+	// The client does not authenticate if empty
+	Secret []byte
+	// Time between the pings sent while waiting for the results. Zero
+	// disables the heartbeat
+	HeartbeatInterval time.Duration
+	// Pings in a row the server may leave unanswered before the connection
+	// is considered lost
+	MaxMissedPongs int
+	// Time each operation on the connection may take
+	Timeouts TimeoutsConfig
+	// Time between consults of the results while the server tells the
+	// client to wait. Servers that push the results are not polled. Must be
+	// shorter than the heartbeat interval times the max missed pongs
+	PollInterval time.Duration
+	// Encoding of the messages, either ENCODING_BINARY or ENCODING_JSONL
+	Encoding string
+	// File the winning bets are written to once the results arrive. No file
+	// is written if empty
+	WinnersFile string
+	// File with the corrections to the bets sent, applied before the agency
+	// finishes sending bets. No bet is corrected if empty
+	CorrectionsFile string
 }
 
 // Client Entity that encapsulates how
 type Client struct {
 	config     ClientConfig
-	conn       net.Conn
+	conn       *FramedConn
 	terminated bool
 	phase      int
 	winners    []int
+	features   Features
+	sequence   *BatchSequence
+	window     *BetWindow
+	// Time at which the loop lapse passes, or zero if the loop is not running
+	deadline time.Time
+	// Winning bets, only known if the server sent detailed results
+	winning_bets []*Bet
+	// Whether the server did not negotiate on a previous connection, so later
+	// connections skip the negotiation
+	legacy_server bool
 }
 
 // NewClient Initializes a new client receiving the configuration
@@ -40,10 +105,80 @@ func NewClient(config ClientConfig) *Client {
 		log.Warnf("Invalid bets per batch. Using default value: %v", DEFAULT_BETS_PER_BATCH)
 		config.BetsPerBatch = DEFAULT_BETS_PER_BATCH
 	}
+	if config.MaxFrameSize <= 0 || config.MaxFrameSize > MAX_FRAME_SIZE {
+		log.Warnf("Invalid max frame size. Using default value: %v", MAX_FRAME_SIZE)
+		config.MaxFrameSize = MAX_FRAME_SIZE
+	}
+	if config.MaxRetransmissions < 0 {
+		log.Warnf("Invalid max retransmissions. Using default value: %v", DEFAULT_MAX_RETRANSMISSIONS)
+		config.MaxRetransmissions = DEFAULT_MAX_RETRANSMISSIONS
+	}
+	if config.HandshakeTimeout < 0 {
+		log.Warnf("Invalid handshake timeout. Using default value: %v", DEFAULT_HANDSHAKE_TIMEOUT)
+		config.HandshakeTimeout = DEFAULT_HANDSHAKE_TIMEOUT
+	}
+	if config.WindowSize <= 0 {
+		log.Warnf("Invalid window size. Using default value: %v", DEFAULT_WINDOW_SIZE)
+		config.WindowSize = DEFAULT_WINDOW_SIZE
+	}
+	if config.MaxReconnections < 0 {
+		log.Warnf("Invalid max reconnections. Using default value: %v", DEFAULT_MAX_RECONNECTIONS)
+		config.MaxReconnections = DEFAULT_MAX_RECONNECTIONS
+	}
+	if config.HeartbeatInterval < 0 {
+		log.Warnf("Invalid heartbeat interval. Using default value: %v", DEFAULT_HEARTBEAT_INTERVAL)
+		config.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	if config.MaxMissedPongs <= 0 {
+		log.Warnf("Invalid max missed pongs. Using default value: %v", DEFAULT_MAX_MISSED_PONGS)
+		config.MaxMissedPongs = DEFAULT_MAX_MISSED_PONGS
+	}
+	if config.Timeouts.Connect < 0 {
+		log.Warnf("Invalid connect timeout. Using default value: %v", DEFAULT_CONNECT_TIMEOUT)
+		config.Timeouts.Connect = DEFAULT_CONNECT_TIMEOUT
+	}
+	if config.Timeouts.Write < 0 {
+		log.Warnf("Invalid write timeout. Using default value: %v", DEFAULT_WRITE_TIMEOUT)
+		config.Timeouts.Write = DEFAULT_WRITE_TIMEOUT
+	}
+	if config.Timeouts.Read < 0 {
+		log.Warnf("Invalid read timeout. Using default value: %v", DEFAULT_READ_TIMEOUT)
+		config.Timeouts.Read = DEFAULT_READ_TIMEOUT
+	}
+	if config.Timeouts.Results < 0 {
+		log.Warnf("Invalid results timeout. Using default value: %v", DEFAULT_RESULTS_TIMEOUT)
+		config.Timeouts.Results = DEFAULT_RESULTS_TIMEOUT
+	}
+	if config.PollInterval <= 0 {
+		log.Warnf("Invalid poll interval. Using default value: %v", DEFAULT_POLL_INTERVAL)
+		config.PollInterval = DEFAULT_POLL_INTERVAL
+	}
+	// Pongs are not read while waiting to poll again, so the heartbeat must not
+	// give up on the server in the meantime
+	heartbeat_timeout := config.HeartbeatInterval * time.Duration(config.MaxMissedPongs)
+	if config.HeartbeatInterval > 0 && config.PollInterval >= heartbeat_timeout {
+		log.Warnf("Poll interval not shorter than the heartbeat timeout of %v. Using value: %v", heartbeat_timeout, heartbeat_timeout/2)
+		config.PollInterval = heartbeat_timeout / 2
+	}
+	if config.Encoding != ENCODING_BINARY && config.Encoding != ENCODING_JSONL {
+		log.Warnf("Invalid encoding. Using default value: %v", ENCODING_BINARY)
+		config.Encoding = ENCODING_BINARY
+	}
+	agency_id_int, _ := strconv.Atoi(config.ID)
+	sequence := NewBatchSequence()
 	client := &Client{
-		config:  config,
-		phase:   SEND_BETS_PHASE,
-		winners: make([]int, 0),
+		config:   config,
+		phase:    SEND_BETS_PHASE,
+		winners:  make([]int, 0),
+		features: LegacyFeatures(),
+		sequence: sequence,
+		window: NewBetWindow(BetWindowConfig{
+			Size:               config.WindowSize,
+			AgencyID:           agency_id_int,
+			MaxRetransmissions: config.MaxRetransmissions,
+			Compression:        config.Compression,
+			RetryDelay:         config.LoopPeriod,
+		}, sequence),
 	}
 	client.terminated = false
 	return client
@@ -59,50 +194,94 @@ func (c *Client) _NextPhase() {
 	}
 }
 
+// LastConfirmedSequence Returns the sequence number of the last bet batch
+// confirmed by the server, or 0 if none was confirmed yet. Batches after it
+// can be safely sent again
+func (c *Client) LastConfirmedSequence() uint32 {
+	return c.sequence.LastConfirmed()
+}
+
 // SetWinners Sets the winners of the client
 func (c *Client) SetWinners(winners []int) {
 	c.winners = winners
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
+// SetWinningBets Sets the winning bets of the client, along with their
+// documents as its winners
+func (c *Client) SetWinningBets(bets []*Bet) {
+	c.winning_bets = bets
+	winners := make([]int, 0, len(bets))
+	for _, bet := range bets {
+		winners = append(winners, bet.bettor.dni)
+	}
+	c.SetWinners(winners)
+}
+
+// CreateClientSocket Initializes client socket, over TCP or a unix domain
+// socket depending on the scheme of the server address and over TLS if it is
+// enabled, within the connect timeout. In case of failure the error is
+// returned
 func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+	network, address, err := ParseServerAddress(c.config.ServerAddress)
 	if err != nil {
-		log.Fatalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
+		return err
+	}
+	dialer := &net.Dialer{Timeout: c.config.Timeouts.Connect, Deadline: c.deadline}
+	deadline := _Deadline(c.config.Timeouts.Connect, c.deadline)
+	var conn net.Conn
+	if c.config.TLS.Enabled {
+		tls_config, err := NewTLSClientConfig(c.config.TLS, c.config.ServerAddress)
+		if err != nil {
+			return err
+		}
+		conn, err = DialTLS(dialer, network, address, tls_config)
+		if err != nil {
+			return _TimeoutError("connect", c.config.Timeouts.Connect, deadline, c.deadline, err)
+		}
+	} else {
+		conn, err = dialer.Dial(network, address)
+		if err != nil {
+			return _TimeoutError("connect", c.config.Timeouts.Connect, deadline, c.deadline, err)
+		}
 	}
 	if c.terminated {
 		conn.Close()
 	} else {
-		c.conn = conn
+		c.conn = NewFramedConn(conn)
+		c.conn.SetMaxFrameSize(c.config.MaxFrameSize)
+		c.conn.SetTimeouts(c.config.Timeouts.Read, c.config.Timeouts.Write)
+		c.conn.SetDeadline(c.deadline)
+		c.conn.SetEncoding(c.config.Encoding)
 	}
 
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
+// StartClientLoop Send messages to the client until some time threshold is
+// met. The threshold is a hard deadline that also interrupts any operation
+// on the connection in progress
 func (c *Client) StartClientLoop() {
-	// Get the environment variables
+	if c.config.LoopLapse > 0 {
+		c.deadline = time.Now().Add(c.config.LoopLapse)
+	}
+
 	// Create the connection the server
 	err := c.createClientSocket()
 	if err != nil {
-		if !c.terminated {
-			log.Errorf("action: create_client_socket | result: fail | client_id: %v | error: %v",
-				c.config.ID, err)
-		}
-		return
+		log.Fatalf(
+			"action: connect | result: %v | client_id: %v | error: %v",
+			_Result(err),
+			c.config.ID,
+			err,
+		)
 	}
 	agency_id_int, _ := strconv.Atoi(c.config.ID)
-	err = SendConnectMessage(c.conn, agency_id_int)
+	err = c._Handshake()
 	if err != nil {
+		c._FailIfRejected(err)
 		if !c.terminated {
-			log.Errorf("action: send_connect | result: fail | client_id: %v | error: %v",
-				c.config.ID, err)
+			log.Errorf("action: send_connect | result: %v | client_id: %v | error: %v",
+				_Result(err), c.config.ID, err)
 		}
 		return
 	}
@@ -112,14 +291,12 @@ func (c *Client) StartClientLoop() {
 	defer csv_file.Close()
 
 loop:
-	for timeout := time.After(c.config.LoopLapse); !c.terminated; {
-		select {
-		case <-timeout:
+	for !c.terminated {
+		if c._Lapsed() {
 			log.Infof("action: timeout_detected | result: success | client_id: %v",
 				c.config.ID,
 			)
-			break loop
-		default:
+			return
 		}
 
 		switch c.phase {
@@ -133,7 +310,14 @@ loop:
 		case ANNOUNCE_WINNERS_PHASE:
 			break loop
 		}
+		if errors.Is(err, ErrLoopLapsed) {
+			log.Infof("action: timeout_detected | result: success | client_id: %v",
+				c.config.ID,
+			)
+			return
+		}
 		if err != nil {
+			c._FailIfRejected(err)
 			return
 		}
 	}
@@ -144,6 +328,33 @@ loop:
 	}
 	log.Infof("action: consulta_ganadores | result: success | client_id: %v | cant_ganadores: %v",
 		agency_id_int, len(c.winners))
+	for _, bet := range c.winning_bets {
+		log.Debugf("action: ganador | result: success | client_id: %v | dni: %v | numero: %v | nombre: %v | apellido: %v | nacimiento: %v",
+			agency_id_int, bet.bettor.dni, bet.number, bet.bettor.name, bet.bettor.lastname, bet.bettor.birthdate.Format("2006-01-02"))
+	}
+	c._WriteWinnersFile()
+}
+
+// _WriteWinnersFile Writes the winning bets to the winners file, if one is
+// configured. Servers that do not send detailed results only tell the
+// documents of the winners, so no file is written for them
+func (c *Client) _WriteWinnersFile() {
+	if c.config.WinnersFile == "" {
+		return
+	}
+	if !c.features.Has(CAP_DETAILED_RESULTS) {
+		log.Warnf("action: write_winners | result: skipped | client_id: %v | error: server does not send detailed results",
+			c.config.ID)
+		return
+	}
+	err := WriteBetsToCSVFile(c.config.WinnersFile, c.winning_bets)
+	if err != nil {
+		log.Errorf("action: write_winners | result: fail | client_id: %v | file: %v | error: %v",
+			c.config.ID, c.config.WinnersFile, err)
+		return
+	}
+	log.Infof("action: write_winners | result: success | client_id: %v | file: %v | cant_ganadores: %v",
+		c.config.ID, c.config.WinnersFile, len(c.winning_bets))
 }
 
 // Handles the sending of bets to the server and advances to the next phase
@@ -158,11 +369,21 @@ func (c *Client) SendBetsPhase(bets_file *CSVFile) error {
 	}
 
 	if len(bets_batch) == 0 {
-		// All bets have been read and sent
-		err := SendFinishedMessage(c.conn, agency_id_int)
+		// All bets have been read and sent, wait for the batches in flight
+		err := c.window.Drain()
+		if err != nil {
+			return c._HandleSendBetsError(err)
+		}
+		c.window.Detach()
+
+		err = c._ApplyCorrectionsFile()
+		if err != nil {
+			return err
+		}
+		err = SendFinishedMessage(c.conn, agency_id_int)
 		if err != nil && !c.terminated {
-			log.Errorf("action: send finished | result: fail | client_id: %v | error: %v",
-				agency_id_int, err)
+			log.Errorf("action: send finished | result: %v | client_id: %v | error: %v",
+				_Result(err), agency_id_int, err)
 			return err
 		}
 		c._NextPhase()
@@ -170,58 +391,433 @@ func (c *Client) SendBetsPhase(bets_file *CSVFile) error {
 	}
 
 	log.Debugf("action: read_bets | result: success | client_id: %v | bets read: %v", c.config.ID, len(bets_batch))
-	err = SendBets(bets_batch, c.conn, agency_id_int)
-	if err != nil && !c.terminated {
-		log.Errorf("action: send_bets | result: fail | client_id: %v | error: %v",
-			agency_id_int, err)
+	err = c.window.Enqueue(bets_batch)
+	if err == nil {
+		err = c.window.Flush()
+	}
+	if err != nil {
+		return c._HandleSendBetsError(err)
+	}
+	log.Infof("action: batch confirmation | result: success | client_id: %v | sequence: %v",
+		agency_id_int, c.LastConfirmedSequence())
+	return nil
+}
+
+// _ApplyCorrectionsFile Applies the corrections in the corrections file, if
+// one is configured. A correction the server does not apply is logged but
+// does not keep the agency from finishing, which would hold the lottery back
+func (c *Client) _ApplyCorrectionsFile() error {
+	if c.config.CorrectionsFile == "" {
+		return nil
+	}
+	agency_id_int, _ := strconv.Atoi(c.config.ID)
+	corrections, err := ReadCorrectionsFromCSVFile(c.config.CorrectionsFile, agency_id_int)
+	if err != nil {
+		log.Errorf("action: read_corrections | result: fail | client_id: %v | error: %v",
+			c.config.ID, err)
 		return err
 	}
+	c.ApplyCorrections(corrections)
+	return nil
+}
 
-	err = RecieveBatchConfirmation(c.conn)
-	if err != nil && !c.terminated {
-		log.Errorf("action: batch confirmation | result: fail | client_id: %v | error: %v",
-			agency_id_int, err)
+// _HandleSendBetsError Connects again to the server if the connection was lost
+// while sending bets, so the batches in flight are sent again. Batches the
+// server rate limits are sent again by the window after a loop period, any
+// other error reported by the server aborts. Returns the error if the client
+// cannot recover from it
+func (c *Client) _HandleSendBetsError(err error) error {
+	if c.terminated {
 		return err
 	}
-	log.Infof("action: batch confirmation | result: success | client_id: %v", agency_id_int)
+	if _IsConnectionError(err) {
+		err = c._Reconnect(err)
+		if err == nil {
+			return nil
+		}
+	}
+	log.Errorf("action: send_bets | result: %v | client_id: %v | error: %v",
+		_Result(err), c.config.ID, err)
+	return err
+}
+
+// _Reconnect Replaces a lost connection with a new one, waiting a loop period
+// between attempts. Batches can only be sent again if the server tells
+// retransmissions apart by their sequence number, otherwise the error that
+// closed the connection is returned
+func (c *Client) _Reconnect(cause error) error {
+	if c.window.Pending() > 0 && !c.features.Has(CAP_SEQUENCE_NUMBERS) {
+		return cause
+	}
+	c.window.Detach()
+	c.conn.Close()
+
+	for attempt := 1; attempt <= c.config.MaxReconnections && !c.terminated && !c._Lapsed(); attempt++ {
+		log.Warnf("action: reconnect | result: in_progress | client_id: %v | attempt: %v | error: %v",
+			c.config.ID, attempt, cause)
+		time.Sleep(c.config.LoopPeriod)
+
+		cause = c.createClientSocket()
+		if cause == nil {
+			cause = c._Handshake()
+			if cause != nil {
+				c.conn.Close()
+			}
+		}
+		if _IsFatalError(cause) {
+			// The server will not accept this client on a new connection either
+			return cause
+		}
+		if cause != nil {
+			continue
+		}
+		log.Infof("action: reconnect | result: success | client_id: %v | pending_batches: %v",
+			c.config.ID, c.window.Pending())
+		return nil
+	}
+	if c._Lapsed() {
+		return fmt.Errorf("reconnect interrupted: %w", ErrLoopLapsed)
+	}
+	return fmt.Errorf("could not reconnect after %v attempts: %w", c.config.MaxReconnections, cause)
+}
+
+// _Handshake Negotiates the features of the session on the current
+// connection and starts sending bet batches through it
+func (c *Client) _Handshake() error {
+	err := c._Negotiate()
+	if err != nil {
+		return err
+	}
+	if c.phase == SEND_BETS_PHASE {
+		return c.window.Attach(c.conn)
+	}
 	return nil
 }
 
-// Handles the receiving of winners from the server during the second phase and advances to the next phase
-// if the winners are received
-func (c *Client) ConsultWinnersPhase() error {
+// _Negotiate Negotiates the features of the session on the current
+// connection and authenticates the agency if it has a secret
+func (c *Client) _Negotiate() error {
 	agency_id_int, _ := strconv.Atoi(c.config.ID)
-
-	err := ConsultResults(c.conn, agency_id_int)
+	timeout := c.config.HandshakeTimeout
+	if c.legacy_server {
+		timeout = 0
+	}
+	features, err := Handshake(c.conn, agency_id_int, c._Capabilities(), c.sequence.Session(), timeout)
+	if errors.Is(err, ErrLegacyServer) {
+		if c.features.Version > LEGACY_PROTOCOL_VERSION {
+			// The server negotiated on a previous connection, so a missing answer
+			// means it is not responding rather than that it does not negotiate
+			return fmt.Errorf("server did not answer the handshake: %w", os.ErrDeadlineExceeded)
+		}
+		features, err = c._RedialLegacy(agency_id_int)
+		c.legacy_server = err == nil
+	}
 	if err != nil {
-		if !c.terminated {
-			log.Errorf("action: consult winners | result: fail | client_id: %v | error: %v",
-				c.config.ID, err)
+		if c.config.TLS.Enabled {
+			return ClassifyTLSError(err)
 		}
 		return err
 	}
+	c.features = features
+	log.Infof("action: handshake | result: success | client_id: %v | version: %v | capabilities: %v",
+		c.config.ID, c.features.Version, c.features)
+
+	if len(c.config.Secret) > 0 {
+		if !c.features.Has(CAP_AUTHENTICATION) {
+			log.Warnf("action: authenticate | result: skipped | client_id: %v | error: server does not authenticate agencies",
+				c.config.ID)
+		} else {
+			err = Authenticate(c.conn, agency_id_int, c.config.Secret)
+			if err != nil {
+				return err
+			}
+			log.Infof("action: authenticate | result: success | client_id: %v", c.config.ID)
+		}
+	}
+
+	// Pings of the server are answered from now on, but the client only
+	// pings the server while waiting for the results
+	if c.features.Has(CAP_HEARTBEAT) {
+		NewHeartbeat(c.conn, agency_id_int, c.config.HeartbeatInterval, c.config.MaxMissedPongs)
+	}
+	return nil
+}
+
+// _RedialLegacy Connects to the server again and sends the legacy connect
+// message. The connection the negotiation was proposed on is dropped, since
+// a new server slower than the handshake timeout may still answer it
+func (c *Client) _RedialLegacy(agency_id int) (Features, error) {
+	log.Infof("action: handshake | result: retry | client_id: %v | error: %v", c.config.ID, ErrLegacyServer)
+	c.conn.Close()
+	err := c.createClientSocket()
+	if err != nil {
+		return LegacyFeatures(), err
+	}
+	return Handshake(c.conn, agency_id, 0, 0, 0)
+}
 
-	winners, wait, err := ReceiveResults(c.conn)
+// QueryBettor Asks the server whether the bettor with the given document won
+// in the agency of the client. The query is sent on a connection of its own,
+// which is closed afterwards, so no bet has to be sent before and the client
+// loop must not be running. Returns the numbers of the winning bets of the
+// bettor, which are none if the bettor did not win, or ErrResultsNotReady if
+// the lottery was not drawn yet
+func (c *Client) QueryBettor(dni int) ([]int, error) {
+	err := c.createClientSocket()
 	if err != nil {
-		if !c.terminated {
-			log.Errorf("action: receive winners | result: fail | client_id: %v | error: %v",
-				c.config.ID, err)
+		return nil, err
+	}
+	// The connection is replaced if the server does not negotiate
+	defer func() { c.conn.Close() }()
+
+	err = c._Negotiate()
+	if err != nil {
+		return nil, err
+	}
+	if !c.features.Has(CAP_BETTOR_QUERY) {
+		return nil, fmt.Errorf("server does not answer bettor queries")
+	}
+
+	agency_id_int, _ := strconv.Atoi(c.config.ID)
+	numbers, err := QueryDNI(c.conn, agency_id_int, dni)
+	if errors.Is(err, ErrResultsNotReady) {
+		log.Infof("action: consulta_dni | result: wait | client_id: %v | dni: %v", c.config.ID, dni)
+		return nil, err
+	}
+	if err != nil {
+		log.Errorf("action: consulta_dni | result: %v | client_id: %v | dni: %v | error: %v",
+			_Result(err), c.config.ID, dni, err)
+		return nil, err
+	}
+	log.Infof("action: consulta_dni | result: success | client_id: %v | dni: %v | ganador: %v | numeros: %v",
+		c.config.ID, dni, len(numbers) > 0, numbers)
+	return numbers, nil
+}
+
+// CorrectBets Sends corrections to the bets of the agency on a connection of
+// its own, which is closed afterwards, like QueryBettor. The server only
+// applies them until the agency finishes sending bets. Returns the number of
+// corrections applied, see ApplyCorrections
+func (c *Client) CorrectBets(corrections []*Correction) (int, error) {
+	err := c.createClientSocket()
+	if err != nil {
+		return 0, err
+	}
+	// The connection is replaced if the server does not negotiate
+	defer func() { c.conn.Close() }()
+
+	err = c._Negotiate()
+	if err != nil {
+		return 0, err
+	}
+	return c.ApplyCorrections(corrections)
+}
+
+// ApplyCorrections Sends corrections to the bets of the agency on the
+// current connection, each one once the previous is confirmed, and stops at
+// the first one the server does not apply since the ones after it may
+// depend on it. No batch may be in flight. Returns the number of corrections
+// applied
+func (c *Client) ApplyCorrections(corrections []*Correction) (int, error) {
+	if !c.features.Has(CAP_CORRECTIONS) {
+		err := fmt.Errorf("server does not accept bet corrections")
+		log.Errorf("action: correct_bets | result: fail | client_id: %v | error: %v", c.config.ID, err)
+		return 0, err
+	}
+	for i, correction := range corrections {
+		action := "cancel_bet"
+		if correction.Bet != nil {
+			action = "amend_bet"
 		}
-		return err
+		err := c._ApplyCorrection(correction)
+		if err != nil {
+			log.Errorf("action: %v | result: %v | client_id: %v | dni: %v | numero: %v | error: %v",
+				action, _Result(err), c.config.ID, correction.DNI, correction.Number, err)
+			return i, err
+		}
+		log.Infof("action: %v | result: success | client_id: %v | dni: %v | numero: %v",
+			action, c.config.ID, correction.DNI, correction.Number)
+	}
+	return len(corrections), nil
+}
+
+// _ApplyCorrection Sends a correction and waits for the server to confirm it.
+// Corrections are numbered like the bet batches, and one rejected as
+// corrupted was not applied, so it is sent again up to the maximum
+// retransmissions. One rate limited by the server is sent again after a
+// loop period, like the bet batches
+func (c *Client) _ApplyCorrection(correction *Correction) error {
+	agency_id_int, _ := strconv.Atoi(c.config.ID)
+	sequence := c.sequence.Next()
+	for retransmissions := 0; ; {
+		var err error
+		if correction.Bet == nil {
+			err = CancelBet(c.conn, agency_id_int, sequence, correction.Number, correction.DNI)
+		} else {
+			err = AmendBet(c.conn, agency_id_int, sequence, correction.Number, correction.DNI, correction.Bet)
+		}
+		if err == nil {
+			c.sequence.Confirm(sequence)
+			return nil
+		}
+		if errors.Is(err, ErrRateLimited) && !c.terminated {
+			log.Warnf("action: correct_bets | result: retry | client_id: %v | sequence: %v | error: %v",
+				c.config.ID, sequence, err)
+			time.Sleep(c.config.LoopPeriod)
+			continue
+		}
+		if !errors.Is(err, ErrBatchRejected) || retransmissions >= c.config.MaxRetransmissions {
+			return err
+		}
+		retransmissions++
+		log.Warnf("action: correct_bets | result: retry | client_id: %v | retransmission: %v | sequence: %v | error: %v",
+			c.config.ID, retransmissions, sequence, err)
+	}
+}
+
+// _Capabilities Returns the capabilities the client proposes to the server
+// according to its configuration
+func (c *Client) _Capabilities() uint32 {
+	capabilities := uint32(SUPPORTED_CAPABILITIES)
+	if !c.config.Compression {
+		capabilities &^= CAP_COMPRESSION
+	}
+	if len(c.config.Secret) == 0 {
+		capabilities &^= CAP_AUTHENTICATION
+	}
+	if c.config.HeartbeatInterval == 0 {
+		capabilities &^= CAP_HEARTBEAT
+	}
+	if c.config.Encoding == ENCODING_JSONL {
+		capabilities &^= BINARY_CAPABILITIES
+	}
+	return capabilities
+}
+
+// _FailIfRejected Exits if the server rejected the agency, since retrying
+// cannot succeed
+func (c *Client) _FailIfRejected(err error) {
+	if errors.Is(err, ErrAuthenticationFailed) && !c.terminated {
+		log.Fatalf("action: authenticate | result: fail | client_id: %v | error: %v",
+			c.config.ID, err)
+	}
+}
+
+// _Lapsed Returns whether the loop lapse passed
+func (c *Client) _Lapsed() bool {
+	return !c.deadline.IsZero() && !time.Now().Before(c.deadline)
+}
+
+// _Result Returns the result logged for an operation that failed with err,
+// telling timeouts apart from other failures
+func _Result(err error) string {
+	if IsTimeout(err) {
+		return "timeout"
+	}
+	return "fail"
+}
+
+// _IsFatalError Returns whether err means the server will not accept the
+// client, so connecting again would fail the same way
+func _IsFatalError(err error) bool {
+	var tls_err *ErrTLSHandshake
+	return errors.As(err, &tls_err) ||
+		errors.Is(err, ErrAuthenticationFailed) ||
+		errors.Is(err, ErrUnknownAgency)
+}
+
+// _IsConnectionError Returns whether err means the connection with the
+// server was lost. Fatal errors are not, since connecting again would fail
+// the same way
+func _IsConnectionError(err error) bool {
+	var net_err net.Error
+	if _IsFatalError(err) {
+		return false
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, ErrPeerDead) ||
+		errors.As(err, &net_err)
+}
+
+// Handles the receiving of winners from the server during the second phase and advances to the next phase
+// if the winners are received. The client subscribes to the results if the server pushes them, and otherwise
+// consults them every poll interval until the server stops telling it to wait. The server is pinged while the
+// results are awaited, and a lost connection is replaced with a new one to consult again
+func (c *Client) ConsultWinnersPhase() error {
+	agency_id_int, _ := strconv.Atoi(c.config.ID)
+	if heartbeat := c.conn.Heartbeat(); heartbeat != nil {
+		heartbeat.Start()
+	}
+
+	if c.conn.Features().Has(CAP_PUSHED_RESULTS) {
+		err := SubscribeResults(c.conn, agency_id_int)
+		if err != nil {
+			return c._HandleConsultWinnersError("subscribe results", err)
+		}
+	} else {
+		err := ConsultResults(c.conn, agency_id_int)
+		if err != nil {
+			return c._HandleConsultWinnersError("consult winners", err)
+		}
+	}
+
+	detailed := c.conn.Features().Has(CAP_DETAILED_RESULTS)
+	var winners []int
+	var winning_bets []*Bet
+	var wait bool
+	var err error
+	if detailed {
+		winning_bets, wait, err = ReceiveDetailedResults(c.conn, c.config.Timeouts.Results)
+	} else {
+		winners, wait, err = ReceiveResults(c.conn, c.config.Timeouts.Results)
+	}
+	if errors.Is(err, ErrRateLimited) {
+		log.Warnf("action: receive winners | result: retry | client_id: %v | error: %v",
+			c.config.ID, err)
+		time.Sleep(c.config.LoopPeriod)
+		return nil
+	}
+	if err != nil {
+		return c._HandleConsultWinnersError("receive winners", err)
 	}
 
 	if wait {
-		time.Sleep(time.Second * 2)
+		time.Sleep(c.config.PollInterval)
 	} else {
-		c.SetWinners(winners)
+		if detailed {
+			c.SetWinningBets(winning_bets)
+		} else {
+			c.SetWinners(winners)
+		}
 		c._NextPhase()
 	}
 
 	return nil
 }
 
+// _HandleConsultWinnersError Connects again to the server if the connection
+// was lost while consulting the winners, so they are consulted again on the
+// next iteration. Returns the error if the client cannot recover from it
+func (c *Client) _HandleConsultWinnersError(action string, err error) error {
+	if c.terminated {
+		return err
+	}
+	if _IsConnectionError(err) {
+		err = c._Reconnect(err)
+		if err == nil {
+			return nil
+		}
+	}
+	log.Errorf("action: %v | result: %v | client_id: %v | error: %v",
+		action, _Result(err), c.config.ID, err)
+	return err
+}
+
 // Terminate Closes the connection and sets the client as terminated
 func (c *Client) Terminate() {
 	c.terminated = true
+	c.window.Detach()
 	c.conn.Close()
 }
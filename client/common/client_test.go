@@ -0,0 +1,310 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const TEST_HANDSHAKE_TIMEOUT = 50 * time.Millisecond
+
+// Starts a server on a local port that behaves like the baseline one: it
+// never answers the connect message and confirms every bet batch. If
+// ack_delay is positive it answers negotiating connect messages that late
+// instead, like a new server that is slower than the handshake timeout.
+// Returns its address and the connect frames it receives
+func _StartBaselineServer(t *testing.T, ack_delay time.Duration) (string, chan []byte) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	legacy := LegacyFeatures()
+	ack := _ServerFrames(t, legacy, &ConnectAckMessage{Version: PROTOCOL_VERSION, Capabilities: CAP_SEQUENCE_NUMBERS})
+	confirmation := _ServerFrames(t, legacy, &ConfirmationMessage{})
+	connects := make(chan []byte, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// Closed once the client closes its end
+				defer conn.Close()
+				framed_conn := NewFramedConn(conn)
+				for {
+					frame, err := framed_conn.ReadFrame(time.Time{})
+					if err != nil {
+						return
+					}
+					switch int(frame[SIZE_FIELD_LENGTH]) {
+					case CONNECT_CODE:
+						connects <- frame
+						if ack_delay > 0 && len(frame) > legacy.HeaderLength() {
+							time.AfterFunc(ack_delay, func() { framed_conn.WriteFrame(ack) })
+						}
+					case BET_MSG_CODE:
+						framed_conn.WriteFrame(confirmation)
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), connects
+}
+
+// Returns the next connect frame the server received
+func _NextConnect(t *testing.T, connects chan []byte) []byte {
+	t.Helper()
+	select {
+	case frame := <-connects:
+		return frame
+	case <-time.After(time.Second):
+		t.Fatal("expected the server to receive a connect message")
+		return nil
+	}
+}
+
+func TestHandshakeFallsBackToLegacyServers(t *testing.T) {
+	tests := []struct {
+		name      string
+		ack_delay time.Duration
+	}{
+		{name: "baseline server"},
+		{name: "slow server", ack_delay: 3 * TEST_HANDSHAKE_TIMEOUT},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, connects := _StartBaselineServer(t, test.ack_delay)
+			client := NewClient(ClientConfig{ID: "1", ServerAddress: address, HandshakeTimeout: TEST_HANDSHAKE_TIMEOUT})
+			if err := client.createClientSocket(); err != nil {
+				t.Fatal(err)
+			}
+			defer func() { client.conn.Close() }()
+			if err := client._Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if client.features != LegacyFeatures() {
+				t.Fatalf("expected the legacy features, got %v", client.features)
+			}
+
+			// The negotiation and the legacy connect are sent on different connections
+			if proposal := _NextConnect(t, connects); len(proposal) == LegacyFeatures().HeaderLength() {
+				t.Fatalf("expected the negotiation to be proposed first, got %x", proposal)
+			}
+			if legacy := _NextConnect(t, connects); len(legacy) != LegacyFeatures().HeaderLength() {
+				t.Fatalf("expected a legacy connect after the timeout, got %x", legacy)
+			}
+
+			// A late answer to the negotiation is not taken for a confirmation
+			time.Sleep(test.ack_delay)
+			bettor := NewBettorInfo("Santiago Lionel", "Lorca", 30904465, "1999-03-17")
+			if err := client.window.Enqueue([]*Bet{NewBet(7574, 1, *bettor)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.window.Drain(); err != nil {
+				t.Fatalf("expected the batch to be confirmed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestReconnectSkipsTheNegotiationWithLegacyServers(t *testing.T) {
+	address, connects := _StartBaselineServer(t, 0)
+	client := NewClient(ClientConfig{ID: "1", ServerAddress: address, HandshakeTimeout: TEST_HANDSHAKE_TIMEOUT})
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { client.conn.Close() }()
+	if err := client._Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	_NextConnect(t, connects)
+	_NextConnect(t, connects)
+
+	client.conn.Close()
+	if err := client.createClientSocket(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := client._Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= TEST_HANDSHAKE_TIMEOUT {
+		t.Fatalf("expected the legacy connect to be sent right away, took %v", elapsed)
+	}
+	if legacy := _NextConnect(t, connects); len(legacy) != LegacyFeatures().HeaderLength() {
+		t.Fatalf("expected only a legacy connect, got %x", legacy)
+	}
+	select {
+	case frame := <-connects:
+		t.Fatalf("expected a single connect message, got %x", frame)
+	case <-time.After(TEST_HANDSHAKE_TIMEOUT):
+	}
+}
+
+// Returns the codes of the frames written by the client
+func _SentCodes(t *testing.T, written []byte) []int {
+	t.Helper()
+	conn := NewFramedConn(&testConn{reader: bytes.NewReader(written)})
+	codes := make([]int, 0)
+	for {
+		frame, err := conn.ReadFrame(time.Time{})
+		if err == io.EOF {
+			return codes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		codes = append(codes, int(frame[SIZE_FIELD_LENGTH]))
+	}
+}
+
+// Returns a client waiting for the results on a connection with the given
+// capabilities that reads the server frames of the given messages
+func _NewConsultingClient(t *testing.T, capabilities uint32, poll_interval time.Duration, messages ...Message) (*Client, *testConn) {
+	t.Helper()
+	features := Features{Version: PROTOCOL_VERSION, Capabilities: capabilities}
+	conn := &testConn{reader: bytes.NewReader(_ServerFrames(t, features, messages...))}
+	client := NewClient(ClientConfig{ID: "1", PollInterval: poll_interval, Timeouts: TimeoutsConfig{Results: time.Second}})
+	client.conn = NewFramedConn(conn)
+	client.conn.SetFeatures(features)
+	client.features = features
+	client.phase = CONSULT_WINNERS_PHASE
+	return client, conn
+}
+
+func TestConsultWinnersSubscribesToPushedResults(t *testing.T) {
+	client, conn := _NewConsultingClient(t, CAP_PUSHED_RESULTS, time.Hour, &ResultsMessage{Winners: []int{30904465}})
+	if err := client.ConsultWinnersPhase(); err != nil {
+		t.Fatal(err)
+	}
+	if client.phase != ANNOUNCE_WINNERS_PHASE || len(client.winners) != 1 || client.winners[0] != 30904465 {
+		t.Fatalf("expected the pushed winners, got %v in phase %v", client.winners, client.phase)
+	}
+	if codes := _SentCodes(t, conn.written.Bytes()); len(codes) != 1 || codes[0] != SUBSCRIBE_RESULTS_CODE {
+		t.Fatalf("expected a single subscription, got codes %v", codes)
+	}
+}
+
+func TestPollIntervalShorterThanTheHeartbeatTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ClientConfig
+		expected time.Duration
+	}{
+		{
+			name:     "shorter",
+			config:   ClientConfig{PollInterval: time.Second, HeartbeatInterval: time.Second, MaxMissedPongs: 3},
+			expected: time.Second,
+		},
+		{
+			name:     "as long",
+			config:   ClientConfig{PollInterval: 3 * time.Second, HeartbeatInterval: time.Second, MaxMissedPongs: 3},
+			expected: 1500 * time.Millisecond,
+		},
+		{
+			name:     "longer",
+			config:   ClientConfig{PollInterval: time.Minute, HeartbeatInterval: time.Second, MaxMissedPongs: 2},
+			expected: time.Second,
+		},
+		{
+			name:     "heartbeat disabled",
+			config:   ClientConfig{PollInterval: time.Minute, MaxMissedPongs: 3},
+			expected: time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.ID = "1"
+			if poll_interval := NewClient(test.config).config.PollInterval; poll_interval != test.expected {
+				t.Fatalf("expected a poll interval of %v, got %v", test.expected, poll_interval)
+			}
+		})
+	}
+}
+
+func TestConsultWinnersPollsWithoutPushedResults(t *testing.T) {
+	poll_interval := 20 * time.Millisecond
+	client, conn := _NewConsultingClient(t, 0, poll_interval, &WaitMessage{}, &ResultsMessage{Winners: []int{30904465}})
+
+	start := time.Now()
+	if err := client.ConsultWinnersPhase(); err != nil {
+		t.Fatal(err)
+	}
+	if client.phase != CONSULT_WINNERS_PHASE {
+		t.Fatalf("expected to keep consulting after a wait, got phase %v", client.phase)
+	}
+	if elapsed := time.Since(start); elapsed < poll_interval {
+		t.Fatalf("expected to wait the poll interval before consulting again, waited %v", elapsed)
+	}
+
+	if err := client.ConsultWinnersPhase(); err != nil {
+		t.Fatal(err)
+	}
+	if client.phase != ANNOUNCE_WINNERS_PHASE || len(client.winners) != 1 {
+		t.Fatalf("expected the winners, got %v in phase %v", client.winners, client.phase)
+	}
+	codes := _SentCodes(t, conn.written.Bytes())
+	if len(codes) != 2 || codes[0] != CONSULT_CODE || codes[1] != CONSULT_CODE {
+		t.Fatalf("expected two consults, got codes %v", codes)
+	}
+}
+
+func TestApplyCorrectionRetriesOnlyRateLimited(t *testing.T) {
+	loop_period := 20 * time.Millisecond
+	tests := []struct {
+		name      string
+		responses []Message
+		expected  error
+		sent      int
+	}{
+		{
+			name:      "rate limited",
+			responses: []Message{&ErrorMessage{Reason: ERROR_RATE_LIMITED}, &ConfirmationMessage{Sequence: 1}},
+			sent:      2,
+		},
+		{
+			name:      "bet not found",
+			responses: []Message{&ErrorMessage{Reason: ERROR_BET_NOT_FOUND}, &ConfirmationMessage{Sequence: 1}},
+			expected:  ErrBetNotFound,
+			sent:      1,
+		},
+		{
+			name:      "betting closed",
+			responses: []Message{&ErrorMessage{Reason: ERROR_BETTING_CLOSED}, &ConfirmationMessage{Sequence: 1}},
+			expected:  ErrBettingClosed,
+			sent:      1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &testConn{reader: bytes.NewReader(_ServerFrames(t, sequencedFeatures, test.responses...))}
+			client := NewClient(ClientConfig{ID: "1", LoopPeriod: loop_period, MaxRetransmissions: 2})
+			client.conn = NewFramedConn(conn)
+			client.conn.SetFeatures(sequencedFeatures)
+
+			start := time.Now()
+			err := client._ApplyCorrection(&Correction{Number: 7574, DNI: 30904465})
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+			if test.expected == nil && time.Since(start) < loop_period {
+				t.Fatalf("expected to wait a loop period before retrying, waited %v", time.Since(start))
+			}
+			codes := _SentCodes(t, conn.written.Bytes())
+			if len(codes) != test.sent {
+				t.Fatalf("expected %v cancels sent, got codes %v", test.sent, codes)
+			}
+		})
+	}
+}
@@ -1,14 +1,23 @@
 package common
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
-	"net"
+	"hash/crc32"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Constants for the communication protocol
 const SIZE_FIELD_LENGTH = 2      // Size of the length field in bytes
+const MAX_FRAME_SIZE = 1<<16 - 1 // Largest frame size the length field can hold
 const MSG_CODE_LENGTH = 1        // Size of the type field in bytes
+const CHECKSUM_LENGTH = 4        // Size of the CRC32 trailer in bytes
+const SEQUENCE_LENGTH = 4        // Size of the batch sequence number in bytes
 const NUMBER_LENGTH_IN_BYTES = 2 // Size of the number field in bytes
 const AGENCY_LENGTH_IN_BYTES = 1 // Size of the agency field in bytes
 const DNI_LENGTH_IN_BYTES = 4    // Size of the DNI field in bytes
@@ -16,180 +25,745 @@ const YEAR_LENGTH_IN_BYTES = 2   // Size of the year field in bytes
 const MONTH_LENGTH_IN_BYTES = 1  // Size of the month field in bytes
 const DAY_LENGTH_IN_BYTES = 1    // Size of the day field in bytes
 
+// Constants for the wide fields introduced in version 2
+const AGENCY_LENGTH_IN_BYTES_V2 = 2 // Size of the agency field in bytes
+const DNI_LENGTH_IN_BYTES_V2 = 8    // Size of the DNI field in bytes
+
+// Constants for the bet layout
+const STRING_LENGTH_FIELD_LENGTH = 1 // Size of the length prefix of the name fields in bytes
+const MAX_STRING_FIELD_LENGTH = 255  // Largest name field the length prefix can hold
+
+// Constants for the compressed bet body
+const UNCOMPRESSED_LENGTH_IN_BYTES = 4  // Size of the uncompressed length field in bytes
+const MAX_UNCOMPRESSED_LENGTH = 1 << 20 // Largest uncompressed bet body accepted
+
+// Constants for the paged results
+const PAGE_INDEX_LENGTH_IN_BYTES = 4 // Size of the page index in bytes
+const PAGE_FLAGS_LENGTH_IN_BYTES = 1 // Size of the page flags in bytes
+const PAGE_FLAG_LAST = 1 << 0        // The page is the last one of the results
+
+// Constants for the authentication
+const NONCE_LENGTH = 32               // Size of the challenge nonce in bytes
+const AUTH_RESPONSE_LENGTH = 32       // Size of the HMAC-SHA256 answer in bytes
+const AUTH_AGENCY_LENGTH_IN_BYTES = 4 // Size of the agency appended to the nonce before signing it
+
+// Constants for the handshake
+const VERSION_LENGTH_IN_BYTES = 1      // Size of the protocol version field in bytes
+const CAPABILITIES_LENGTH_IN_BYTES = 4 // Size of the capabilities bitmask in bytes
+const SESSION_LENGTH_IN_BYTES = 4      // Size of the session of the batch sequence in bytes
+const LEGACY_PROTOCOL_VERSION = 1      // Version spoken by servers that do not negotiate
+const WIDE_FIELDS_PROTOCOL_VERSION = 2 // First version with wide agency and DNI fields
+const PROTOCOL_VERSION = 2             // Highest version spoken by the client
+
 // Client Codes
-const CONNECT_CODE = 10  // The code the client uses to connect to the server
-const BET_MSG_CODE = 14  // The code the client uses to send a bet
-const FINISHED_CODE = 20 // The code the client uses to end betting
-const CONSULT_CODE = 23  // The code the client uses to request the results
+const CONNECT_CODE = 10            // The code the client uses to connect to the server
+const AUTH_CODE = 13               // The code the client uses to answer the challenge
+const BET_MSG_CODE = 14            // The code the client uses to send a bet
+const COMPRESSED_BET_MSG_CODE = 15 // The code the client uses to send a compressed bet
+const QUERY_DNI_CODE = 16          // The code the client uses to ask whether a bettor won
+const CANCEL_BET_CODE = 17         // The code the client uses to cancel a bet it sent
+const AMEND_BET_CODE = 18          // The code the client uses to replace a bet it sent
+const SUBSCRIBE_RESULTS_CODE = 19  // The code the client uses to have the results pushed once drawn
+const FINISHED_CODE = 20           // The code the client uses to end betting
+const CONSULT_CODE = 23            // The code the client uses to request the results
 
 // Server Codes
+const CONNECT_ACK_CODE = 11  // The code the server uses to accept a connection
+const CHALLENGE_CODE = 12    // The code the server uses to send the authentication nonce
 const CONFIRMATION_CODE = 21 // The code the server uses to confirm a bet batch
 const RESULTS_MSG_CODE = 22  // The code the server uses to send the results
+const RESULTS_PAGE_CODE = 24 // The code the server uses to send a page of the results
 const WAIT_MSG_CODE = 25     // The code the server uses to tell the client to wait
+const NACK_CODE = 26         // The code the server uses to reject a corrupted bet batch
+const AUTH_OK_CODE = 27      // The code the server uses to accept an authenticated agency
+const AUTH_FAILED_CODE = 28  // The code the server uses to reject an agency that failed to authenticate
+const ERROR_CODE = 29        // The code the server uses to report why it rejected a message
+
+// Codes used by both sides
+const PING_CODE = 30 // The code either side uses to check that the other is alive
+const PONG_CODE = 31 // The code either side uses to answer a ping
+
+// Server codes of the detailed results
+const DETAILED_RESULTS_CODE = 32      // The code the server uses to send the winning bets
+const DETAILED_RESULTS_PAGE_CODE = 33 // The code the server uses to send a page of the winning bets
+
+// Server codes of the bettor queries
+const QUERY_RESULT_CODE = 34 // The code the server uses to answer whether a bettor won
+
+// Reasons of an error message
+const ERROR_REASON_LENGTH_IN_BYTES = 1 // Size of the reason field in bytes
+const ERROR_MALFORMED_BATCH = 1        // A bet batch could not be parsed
+const ERROR_UNKNOWN_AGENCY = 2         // The agency is not one the server expects
+const ERROR_BETTING_CLOSED = 3         // The agency already finished sending bets
+const ERROR_RATE_LIMITED = 4           // The agency sent too many batches, it may retry later
+const ERROR_BET_NOT_FOUND = 5          // The agency has no bet to cancel or amend with that number and document
+
+// Delimiters
+const MSG_TERMINATOR = '\n'       // Byte the server appends to every message it sends
+const BETTOR_INFO_DELIMITER = '|' // Byte that ends the name and lastname fields
+
+// ErrResultsNotReady Returned when a bettor is queried before the lottery
+// is drawn
+var ErrResultsNotReady = errors.New("the lottery results are not ready yet")
+
+// ErrLegacyServer Returned when the server does not answer the connect
+// message in time, which servers that do not negotiate never do
+var ErrLegacyServer = errors.New("server did not answer the negotiation")
+
+// ErrBatchRejected Returned when the server rejects a bet batch because it
+// arrived corrupted
+var ErrBatchRejected = errors.New("bet batch rejected by the server")
+
+// ErrServer Returned when the server reports an error. Errors with the same
+// reason match each other with errors.Is regardless of their description
+type ErrServer struct {
+	Reason      int
+	Description string
+}
 
-// Sends bets to the server and returns an error if any.
-func SendBets(bets []*Bet, conn net.Conn, agency_id int) error {
+// Names of the error reasons, used for logging
+var errorReasonNames = map[int]string{
+	ERROR_MALFORMED_BATCH: "malformed batch",
+	ERROR_UNKNOWN_AGENCY:  "unknown agency",
+	ERROR_BETTING_CLOSED:  "betting closed",
+	ERROR_RATE_LIMITED:    "rate limited",
+	ERROR_BET_NOT_FOUND:   "bet not found",
+}
 
-	total_bets_sent := 0
-	for total_bets_sent < len(bets) {
-		buffer := make([]byte, 0)
-		bets_that_fit := _SerializeBets(bets, &buffer)
-		total_bets_sent += bets_that_fit
-		err := _SendAux(buffer, conn, agency_id, BET_MSG_CODE)
-		if err != nil {
-			return err
-		}
+func (e *ErrServer) Error() string {
+	reason, ok := errorReasonNames[e.Reason]
+	if !ok {
+		reason = fmt.Sprintf("reason %v", e.Reason)
 	}
-	return nil
+	if e.Description == "" {
+		return fmt.Sprintf("server error: %v", reason)
+	}
+	return fmt.Sprintf("server error: %v: %v", reason, e.Description)
 }
 
-// Sends a message to the server indicating that the client has finished sending bets.
-func SendFinishedMessage(conn net.Conn, agency_id int) error {
-	return _SendAux([]byte{}, conn, agency_id, FINISHED_CODE)
+func (e *ErrServer) Is(target error) bool {
+	server_err, ok := target.(*ErrServer)
+	return ok && server_err.Reason == e.Reason
+}
+
+// Errors reported by the server, to be matched with errors.Is
+var ErrMalformedBatch = &ErrServer{Reason: ERROR_MALFORMED_BATCH}
+var ErrUnknownAgency = &ErrServer{Reason: ERROR_UNKNOWN_AGENCY}
+var ErrBettingClosed = &ErrServer{Reason: ERROR_BETTING_CLOSED}
+var ErrRateLimited = &ErrServer{Reason: ERROR_RATE_LIMITED}
+var ErrBetNotFound = &ErrServer{Reason: ERROR_BET_NOT_FOUND}
+
+// ErrChecksumMismatch Returned when a frame does not match its checksum
+type ErrChecksumMismatch struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %08x, got %08x", e.Expected, e.Actual)
+}
+
+// ErrUnexpectedSequence Returned when the server confirms a batch other than
+// the one that was sent
+type ErrUnexpectedSequence struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ErrUnexpectedSequence) Error() string {
+	return fmt.Sprintf("confirmation for batch %v while waiting for batch %v", e.Actual, e.Expected)
+}
+
+// ErrUnexpectedPage Returned when the server sends a page of the results out
+// of order
+type ErrUnexpectedPage struct {
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ErrUnexpectedPage) Error() string {
+	return fmt.Sprintf("results page %v while waiting for page %v", e.Actual, e.Expected)
+}
+
+// ErrBetTooLarge Returned when a single bet does not fit in a frame
+type ErrBetTooLarge struct {
+	Size         int
+	MaxFrameSize int
+}
+
+func (e *ErrBetTooLarge) Error() string {
+	return fmt.Sprintf("bet of %v bytes does not fit in a frame of at most %v bytes", e.Size, e.MaxFrameSize)
+}
+
+// ErrFrameTooLarge Returned when a message does not fit in a frame
+type ErrFrameTooLarge struct {
+	Size         int
+	MaxFrameSize int
+}
+
+func (e *ErrFrameTooLarge) Error() string {
+	return fmt.Sprintf("frame of %v bytes exceeds the maximum of %v bytes", e.Size, e.MaxFrameSize)
+}
+
+// ErrFieldOverflow Returned when a value does not fit in its field
+type ErrFieldOverflow struct {
+	Field  string
+	Value  int
+	Length int
+}
+
+func (e *ErrFieldOverflow) Error() string {
+	return fmt.Sprintf("%v %v does not fit in %v bytes", e.Field, e.Value, e.Length)
+}
+
+// Sends bets to the server and returns an error if any. The bets are split in
+// as many frames as needed to honor the maximum frame size of the connection
+// and each frame is confirmed by the server before sending the next one.
+// Frames rejected by the server are sent again up to max_retransmissions times.
+// Each frame is numbered with the next number of the sequence, which records
+// the frames confirmed by the server. Frames are compressed if compression is
+// enabled and the server supports it.
+func SendBets(bets []*Bet, conn *FramedConn, agency_id, max_retransmissions int, sequence *BatchSequence, compression bool) error {
+	window := NewBetWindow(BetWindowConfig{
+		Size:               1,
+		AgencyID:           agency_id,
+		MaxRetransmissions: max_retransmissions,
+		Compression:        compression,
+	}, sequence)
+	err := window.Attach(conn)
+	if err != nil {
+		return err
+	}
+	defer window.Detach()
+
+	err = window.Enqueue(bets)
+	if err != nil {
+		return err
+	}
+	return window.Drain()
+}
+
+// Sends a batch of bets with the given sequence number. If compression is
+// enabled and was agreed the batch is compressed, unless that does not make
+// it smaller
+func _SendBatch(conn *FramedConn, agency_id int, sequence uint32, bets []*Bet, compression bool) error {
+	msg := &BetsMessage{Sequence: sequence, Bets: bets}
+	if !compression || !conn.Features().Has(CAP_COMPRESSION) {
+		return SendMessage(conn, agency_id, msg)
+	}
+
+	body, err := EncodeMessage(msg, conn.Features())
+	if err != nil {
+		return err
+	}
+	compressed_body, err := EncodeMessage(&CompressedBetsMessage{Sequence: sequence, Bets: bets}, conn.Features())
+	if err != nil {
+		return err
+	}
+	log.Debugf("action: compress_batch | result: success | client_id: %v | sequence: %v | size: %v | compressed_size: %v | ratio: %.2f",
+		agency_id, sequence, len(body), len(compressed_body), float64(len(compressed_body))/float64(len(body)))
+
+	if len(compressed_body) < len(body) {
+		return _SendAux(compressed_body, conn, agency_id, COMPRESSED_BET_MSG_CODE)
+	}
+	return _SendAux(body, conn, agency_id, BET_MSG_CODE)
 }
 
 // Sends a message to the server indicating that the client has finished sending bets.
-func SendConnectMessage(conn net.Conn, agency_id int) error {
-	return _SendAux([]byte{}, conn, agency_id, CONNECT_CODE)
+func SendFinishedMessage(conn *FramedConn, agency_id int) error {
+	return SendMessage(conn, agency_id, &FinishedMessage{})
+}
+
+// Sends a message to the server to connect with the given agency and
+// proposing the client protocol version and the given capabilities. The
+// connect message is always framed with the legacy header, so agencies that
+// do not fit in it are only carried in the body and the header field is left
+// as zero. The session of the sequence numbers is only sent if it is not zero.
+func SendConnectMessage(conn *FramedConn, agency_id int, capabilities uint32, session uint32) error {
+	header_agency_id := agency_id
+	if !_FitsIn(agency_id, AGENCY_LENGTH_IN_BYTES) {
+		header_agency_id = 0
+	}
+	return SendMessage(conn, header_agency_id, &ConnectMessage{Version: PROTOCOL_VERSION, Capabilities: capabilities, Agency: agency_id, Session: session})
+}
+
+// Connects to the server and negotiates the features of the session out of
+// the given capabilities, telling it the session the sequence numbers belong to. Servers that do not negotiate never answer the connect message, so if no answer
+// arrives within timeout ErrLegacyServer is returned. A new server slower than the timeout may still answer
+// later, so the connection must not be reused: the caller connects again with a zero timeout, which skips
+// the negotiation altogether. The agreed features are set on the connection, and an error is returned if
+// the agency does not fit in their header.
+func Handshake(conn *FramedConn, agency_id int, capabilities uint32, session uint32, timeout time.Duration) (Features, error) {
+	if timeout <= 0 {
+		err := SendMessage(conn, agency_id, &ConnectMessage{})
+		return conn.Features(), err
+	}
+
+	err := SendConnectMessage(conn, agency_id, capabilities, session)
+	if err != nil {
+		return conn.Features(), err
+	}
+
+	message, err := ReceiveMessageWithin(conn, timeout)
+	if err != nil {
+		var timeout_err *ErrTimeout
+		if errors.As(err, &timeout_err) {
+			return conn.Features(), ErrLegacyServer
+		}
+		return conn.Features(), err
+	}
+
+	ack, ok := message.(*ConnectAckMessage)
+	if !ok {
+		return conn.Features(), fmt.Errorf("unexpected message code: %v", message.Code())
+	}
+	if ack.Version < LEGACY_PROTOCOL_VERSION || ack.Version > PROTOCOL_VERSION {
+		return conn.Features(), fmt.Errorf("unsupported protocol version: %v", ack.Version)
+	}
+
+	features := Features{Version: ack.Version, Capabilities: ack.Capabilities & capabilities}
+	conn.SetFeatures(features)
+	return features, ValidateAgency(agency_id, features)
+}
+
+// Returns an error if the agency does not fit in the agency field of the
+// frame header for the given features.
+func ValidateAgency(agency_id int, features Features) error {
+	if !_FitsIn(agency_id, features.AgencyLength()) {
+		return &ErrFieldOverflow{Field: "agency", Value: agency_id, Length: features.AgencyLength()}
+	}
+	return nil
 }
 
 // Sends a message to the server requesting the results of the lottery.
-func ConsultResults(conn net.Conn, agency_id int) error {
-	return _SendAux([]byte{}, conn, agency_id, CONSULT_CODE)
+func ConsultResults(conn *FramedConn, agency_id int) error {
+	return SendMessage(conn, agency_id, &ConsultMessage{})
 }
 
-// Receives the results from the server and returns the winners, whether the server told the client to wait,
-// and an error if any.
-func ReceiveResults(conn net.Conn) ([]int, bool, error) {
+// Sends a message to the server subscribing to the results of the lottery, if subscriptions were agreed. The
+// server holds the subscription and pushes the results once the lottery is drawn instead of telling the client
+// to wait, so they are received as those of a consult.
+func SubscribeResults(conn *FramedConn, agency_id int) error {
+	return SendMessage(conn, agency_id, &SubscribeResultsMessage{})
+}
 
-	message, code, err := _ReadMessage(conn)
+// Receives the results from the server within timeout and returns the winners, whether the server told the
+// client to wait, and an error if any. If paging was agreed the results may come in pages, which are sent one
+// after the other, so only the first one is awaited for timeout and the rest for the read timeout. The winners
+// are only returned once the last page arrives.
+func ReceiveResults(conn *FramedConn, timeout time.Duration) ([]int, bool, error) {
+	messages, wait, err := _ReceiveResultsPages(conn, timeout, RESULTS_MSG_CODE, RESULTS_PAGE_CODE)
+	if err != nil || wait {
+		return make([]int, 0), wait, err
+	}
 	winners := make([]int, 0)
+	for _, message := range messages {
+		switch msg := message.(type) {
+		case *ResultsMessage:
+			winners = append(winners, msg.Winners...)
+		case *ResultsPageMessage:
+			winners = append(winners, msg.Winners...)
+		}
+	}
+	return winners, false, nil
+}
 
-	if err != nil {
-		return winners, false, err
+// Receives the detailed results from the server like ReceiveResults, if detailed results were agreed, and
+// returns the winning bets instead of their documents. The bets carry no agency.
+func ReceiveDetailedResults(conn *FramedConn, timeout time.Duration) ([]*Bet, bool, error) {
+	messages, wait, err := _ReceiveResultsPages(conn, timeout, DETAILED_RESULTS_CODE, DETAILED_RESULTS_PAGE_CODE)
+	if err != nil || wait {
+		return make([]*Bet, 0), wait, err
+	}
+	bets := make([]*Bet, 0)
+	for _, message := range messages {
+		switch msg := message.(type) {
+		case *DetailedResultsMessage:
+			bets = append(bets, msg.Bets...)
+		case *DetailedResultsPageMessage:
+			bets = append(bets, msg.Bets...)
+		}
 	}
+	return bets, false, nil
+}
+
+// Receives the messages that carry the results, which are either a single one with the given results code or
+// pages with the given page code up to the last one. Returns the messages, whether the server told the client
+// to wait, and an error if any.
+func _ReceiveResultsPages(conn *FramedConn, timeout time.Duration, results_code, page_code int) ([]Message, bool, error) {
+	messages := make([]Message, 0)
+	for {
+		message, err := ReceiveMessageWithin(conn, timeout)
+		if err != nil {
+			return nil, false, err
+		}
+
+		page := uint32(len(messages))
+		switch {
+		case message.Code() == WAIT_MSG_CODE && page == 0:
+			return nil, true, nil
+		case message.Code() == results_code && page == 0:
+			return []Message{message}, false, nil
+		case message.Code() != page_code:
+			return nil, false, fmt.Errorf("unexpected message code: %v", message.Code())
+		}
+
+		index, last := _PageOf(message)
+		if index != page {
+			return nil, false, &ErrUnexpectedPage{Expected: page, Actual: index}
+		}
+		messages = append(messages, message)
+		if last {
+			return messages, false, nil
+		}
+		timeout = conn.ReadTimeout()
+	}
+}
 
-	if code == WAIT_MSG_CODE {
-		return winners, true, nil
+// Returns the index of a page of the results and whether it is the last one.
+func _PageOf(message Message) (uint32, bool) {
+	switch msg := message.(type) {
+	case *ResultsPageMessage:
+		return msg.Index, msg.Last
+	case *DetailedResultsPageMessage:
+		return msg.Index, msg.Last
+	}
+	return 0, true
+}
+
+// Asks the server whether the bettor with the given document won and returns the numbers of the winning bets
+// of the bettor, which are none if the bettor did not win. ErrResultsNotReady is returned if the server told
+// the client to wait, as the lottery was not drawn yet.
+func QueryDNI(conn *FramedConn, agency_id, dni int) ([]int, error) {
+	err := SendMessage(conn, agency_id, &QueryDNIMessage{DNI: dni})
+	if err != nil {
+		return nil, err
 	}
 
-	if code == RESULTS_MSG_CODE {
-		// Read the winners documents from the 4 bytes encoding
-		for i := SIZE_FIELD_LENGTH + MSG_CODE_LENGTH; i < len(message)-DNI_LENGTH_IN_BYTES; i += DNI_LENGTH_IN_BYTES {
-			winner := int(message[i])<<24 + int(message[i+1])<<16 + int(message[i+2])<<8 + int(message[i+3])
-			winners = append(winners, winner)
+	message, err := ReceiveMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch msg := message.(type) {
+	case *WaitMessage:
+		return nil, ErrResultsNotReady
+	case *QueryResultMessage:
+		if msg.DNI != dni {
+			return nil, fmt.Errorf("answer for dni %v while waiting for dni %v", msg.DNI, dni)
 		}
-		return winners, false, nil
+		return msg.Numbers, nil
 	}
+	return nil, fmt.Errorf("unexpected message code: %v", message.Code())
+}
+
+// Asks the server to cancel the bet of the agency with the given number and bettor document and waits for the
+// confirmation. The request carries the given sequence number if sequence numbers were agreed. The server reports
+// ErrBetNotFound if the agency has no such bet and ErrBettingClosed if it already finished sending bets.
+func CancelBet(conn *FramedConn, agency_id int, sequence uint32, number, dni int) error {
+	return _SendCorrection(conn, agency_id, sequence, &CancelBetMessage{Sequence: sequence, Number: number, DNI: dni})
+}
+
+// Asks the server to replace the bet of the agency with the given number and bettor document with another bet and
+// waits for the confirmation, as CancelBet does.
+func AmendBet(conn *FramedConn, agency_id int, sequence uint32, number, dni int, bet *Bet) error {
+	return _SendCorrection(conn, agency_id, sequence, &AmendBetMessage{Sequence: sequence, Number: number, DNI: dni, Bet: bet})
+}
 
-	return winners, false, fmt.Errorf("invalid message code")
+// Sends a correction of a bet and waits for the server to confirm it
+func _SendCorrection(conn *FramedConn, agency_id int, sequence uint32, msg Message) error {
+	err := SendMessage(conn, agency_id, msg)
+	if err != nil {
+		return err
+	}
+	return RecieveBatchConfirmation(conn, sequence)
 }
 
 // Receives a packet from the server and returns an error if cannot read the
-// packet or the packet is not a confirmation.
-func RecieveBatchConfirmation(conn net.Conn) error {
+// packet or the packet is not a confirmation. If sequence numbers were agreed
+// the confirmation must be for the batch with the given number.
+func RecieveBatchConfirmation(conn *FramedConn, sequence_number uint32) error {
 	// Read confirmation from the server
-	_, code, err := _ReadMessage(conn)
+	message, err := ReceiveMessage(conn)
 	if err != nil {
 		return err
 	}
-	if code != CONFIRMATION_CODE {
-		return fmt.Errorf("invalid confirmation message")
+	switch msg := message.(type) {
+	case *ConfirmationMessage:
+		if conn.Features().Has(CAP_SEQUENCE_NUMBERS) && msg.Sequence != sequence_number {
+			return &ErrUnexpectedSequence{Expected: sequence_number, Actual: msg.Sequence}
+		}
+		return nil
+	case *NackMessage:
+		if conn.Features().Has(CAP_SEQUENCE_NUMBERS) && msg.Sequence != sequence_number {
+			return &ErrUnexpectedSequence{Expected: sequence_number, Actual: msg.Sequence}
+		}
+		return ErrBatchRejected
 	}
-	return nil
+	return fmt.Errorf("invalid confirmation message")
 }
 
 // Sends a buffer to the server guarding against short writes and returns an error if any.
 // Adds a header to the packet with the length of the packet and the agency id.
-func _SendAux(buffer []byte, conn net.Conn, agency_id, message_code int) error {
+func _SendAux(buffer []byte, conn *FramedConn, agency_id, message_code int) error {
 
-	header := make([]byte, SIZE_FIELD_LENGTH+MSG_CODE_LENGTH+AGENCY_LENGTH_IN_BYTES)
+	header := make([]byte, conn.Features().HeaderLength())
+	packet_size := len(buffer) + len(header) + conn.Features().TrailerLength()
+	if packet_size > conn.MaxFrameSize() {
+		return &ErrFrameTooLarge{Size: packet_size, MaxFrameSize: conn.MaxFrameSize()}
+	}
 	// Add the length of the packet as the packet header
-	header[0] = byte((len(buffer) + len(header)) >> 8)
-	header[1] = byte((len(buffer) + len(header)))
+	header[0] = byte(packet_size >> 8)
+	header[1] = byte(packet_size)
 	header[2] = byte(message_code)
-	header[3] = byte(agency_id)
+	if !_PutField(header[SIZE_FIELD_LENGTH+MSG_CODE_LENGTH:], agency_id) {
+		return &ErrFieldOverflow{Field: "agency", Value: agency_id, Length: conn.Features().AgencyLength()}
+	}
 	buffer = append(header, buffer...)
 
-	total_bytes_written := 0
-	// Send the packet avoiding short writes
-	for total_bytes_written < len(buffer) {
-		bytes_written, err := conn.Write(buffer[total_bytes_written:])
-		if err != nil {
-			return err
-		}
-		total_bytes_written += bytes_written
+	// Append the checksum of the whole packet, which is included in its length
+	if conn.Features().Has(CAP_CHECKSUM) {
+		buffer = _AppendChecksum(buffer)
 	}
 
-	// log.Debugf("Sent %v bytes to the server: %x", total_bytes_written, buffer)
+	// Send the packet avoiding short writes
+	err := conn.WriteFrame(buffer)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
-// Writes a serialization for a list of Bets in a buffer. Returns the number of Bets that were serialized.
-func _SerializeBets(bets []*Bet, buffer *[]byte) int {
+// Appends to a frame the CRC32 of its contents, updating its size field.
+func _AppendChecksum(frame []byte) []byte {
+	_PutField(frame[:SIZE_FIELD_LENGTH], len(frame)+CHECKSUM_LENGTH)
+	checksum := make([]byte, CHECKSUM_LENGTH)
+	_PutField(checksum, int(crc32.ChecksumIEEE(frame)))
+	return append(frame, checksum...)
+}
+
+// Verifies the CRC32 trailer of a frame and returns the frame without it.
+func _VerifyChecksum(frame []byte) ([]byte, error) {
+	if len(frame) < SIZE_FIELD_LENGTH+MSG_CODE_LENGTH+CHECKSUM_LENGTH {
+		return nil, fmt.Errorf("frame of %v bytes too short for a checksum", len(frame))
+	}
+	contents := frame[:len(frame)-CHECKSUM_LENGTH]
+	expected := uint32(_GetField(frame[len(contents):]))
+	actual := crc32.ChecksumIEEE(contents)
+	if expected != actual {
+		return nil, &ErrChecksumMismatch{Expected: expected, Actual: actual}
+	}
+	return contents, nil
+}
+
+// Writes a serialization for a list of Bets in a buffer. Returns the number of Bets that were serialized
+// and an error if a Bet cannot be serialized.
+func _SerializeBets(bets []*Bet, buffer *[]byte, features Features) (int, error) {
 
 	bets_serialized := 0
 	for _, bet := range bets {
-		serialized_bet := _SerializeBet(bet)
+		serialized_bet, err := _SerializeBet(bet, features)
+		if err != nil {
+			return bets_serialized, err
+		}
 		*buffer = append(*buffer, serialized_bet...)
 		bets_serialized++
 
 	}
 
-	return bets_serialized
+	return bets_serialized, nil
+}
+
+// Returns how many of the first bets of a list fit together in max_size bytes.
+func _BetsThatFit(bets []*Bet, max_size int, features Features) int {
+	total_size := 0
+	for i, bet := range bets {
+		total_size += _BetSerializaitionLength(bet, features)
+		if total_size > max_size {
+			return i
+		}
+	}
+	return len(bets)
 }
 
-// Writes a serialization for a Bet and returns it.
-func _SerializeBet(bet *Bet) []byte {
-	packet_size := _BetSerializaitionLength(bet)
-	serialized_bet := make([]byte, packet_size)
+// Writes a serialization for a Bet and returns it, or an error if a field
+// cannot be encoded with the layout agreed for the session.
+func _SerializeBet(bet *Bet, features Features) ([]byte, error) {
+	packet_size := _BetSerializaitionLength(bet, features)
+	serialized_bet := make([]byte, _BetFixedLength(features), packet_size)
 
 	// Bet info
-	serialized_bet[0] = byte(bet.number >> 8)
-	serialized_bet[1] = byte(bet.number)
+	if !_PutField(serialized_bet[:NUMBER_LENGTH_IN_BYTES], bet.number) {
+		return nil, &ErrFieldOverflow{Field: "number", Value: bet.number, Length: NUMBER_LENGTH_IN_BYTES}
+	}
 
 	// DNI
-	serialized_bet[2] = byte(bet.bettor.dni >> 24)
-	serialized_bet[3] = byte(bet.bettor.dni >> 16)
-	serialized_bet[4] = byte(bet.bettor.dni >> 8)
-	serialized_bet[5] = byte(bet.bettor.dni)
+	i := NUMBER_LENGTH_IN_BYTES
+	if !_PutField(serialized_bet[i:i+features.DNILength()], bet.bettor.dni) {
+		return nil, &ErrFieldOverflow{Field: "dni", Value: bet.bettor.dni, Length: features.DNILength()}
+	}
+	i += features.DNILength()
 
 	// Birthdate
-	serialized_bet[6] = byte(bet.bettor.birthdate.Day())
-	serialized_bet[7] = byte(int(bet.bettor.birthdate.Month()))
-	serialized_bet[8] = byte(bet.bettor.birthdate.Year() >> 8)
-	serialized_bet[9] = byte(bet.bettor.birthdate.Year())
+	serialized_bet[i] = byte(bet.bettor.birthdate.Day())
+	serialized_bet[i+1] = byte(int(bet.bettor.birthdate.Month()))
+	serialized_bet[i+2] = byte(bet.bettor.birthdate.Year() >> 8)
+	serialized_bet[i+3] = byte(bet.bettor.birthdate.Year())
 
 	// Name and Lastname
-	bettor_info_str := fmt.Sprintf("%s|%s|", bet.bettor.name, bet.bettor.lastname)
-	copy(serialized_bet[10:], []byte(bettor_info_str))
+	for _, field := range []struct{ name, value string }{{"name", bet.bettor.name}, {"lastname", bet.bettor.lastname}} {
+		err := _ValidateBettorField(field.name, field.value, features)
+		if err != nil {
+			return nil, err
+		}
+		if features.Has(CAP_PREFIXED_STRINGS) {
+			serialized_bet = append(serialized_bet, byte(len(field.value)))
+			serialized_bet = append(serialized_bet, field.value...)
+		} else {
+			serialized_bet = append(serialized_bet, field.value...)
+			serialized_bet = append(serialized_bet, BETTOR_INFO_DELIMITER)
+		}
+	}
 
-	return serialized_bet
+	return serialized_bet, nil
 }
 
-// Returns the size of the packet in bytes or -1 if the packet is too big
-func _BetSerializaitionLength(bet *Bet) int {
-	// Returns the size of the packet in bytes or -1 if the packet is too big
+// ErrInvalidBettorField Returned when a name or lastname cannot be encoded
+type ErrInvalidBettorField struct {
+	Field  string
+	Reason string
+}
 
-	// Max packet size in bytes
-	bettor_info_str := fmt.Sprintf("%s|%s|", bet.bettor.name, bet.bettor.lastname)
+func (e *ErrInvalidBettorField) Error() string {
+	return fmt.Sprintf("invalid bettor %v: %v", e.Field, e.Reason)
+}
 
-	// Calculate packet size
-	return NUMBER_LENGTH_IN_BYTES + DNI_LENGTH_IN_BYTES + DAY_LENGTH_IN_BYTES + MONTH_LENGTH_IN_BYTES + YEAR_LENGTH_IN_BYTES + len(bettor_info_str)
+// Returns an error if a name or lastname cannot be encoded with the layout
+// agreed for the session.
+func _ValidateBettorField(field, value string, features Features) error {
+	if !utf8.ValidString(value) {
+		return &ErrInvalidBettorField{Field: field, Reason: "invalid UTF-8"}
+	}
+	if features.Has(CAP_PREFIXED_STRINGS) {
+		if len(value) > MAX_STRING_FIELD_LENGTH {
+			return &ErrInvalidBettorField{Field: field, Reason: fmt.Sprintf("longer than %v bytes", MAX_STRING_FIELD_LENGTH)}
+		}
+	} else if strings.IndexByte(value, BETTOR_INFO_DELIMITER) != -1 {
+		return &ErrInvalidBettorField{Field: field, Reason: fmt.Sprintf("contains the delimiter %q", BETTOR_INFO_DELIMITER)}
+	}
+	return nil
 }
 
-// Returns the bytes received from the server and its code, or an error if any.
-func _ReadMessage(conn net.Conn) ([]byte, int, error) {
-	// Read message from the server
-	msg := make([]byte, 0)
+// Returns the size of the serialization of a Bet in bytes with the layout
+// agreed for the session.
+func _BetSerializaitionLength(bet *Bet, features Features) int {
+	if features.Has(CAP_PREFIXED_STRINGS) {
+		return _BetFixedLength(features) + 2*STRING_LENGTH_FIELD_LENGTH + len(bet.bettor.name) + len(bet.bettor.lastname)
+	}
+	return _BetFixedLength(features) + len(bet.bettor.name) + len(bet.bettor.lastname) + 2
+}
 
-	for len(msg) < 2 || len(msg) < int(msg[0])<<8+int(msg[1]) {
-		just_read, err := bufio.NewReader(conn).ReadBytes(byte('\n'))
-		msg = append(msg, just_read...)
+// Returns the size of the fixed length fields of a serialized Bet in bytes.
+func _BetFixedLength(features Features) int {
+	return NUMBER_LENGTH_IN_BYTES + features.DNILength() + DAY_LENGTH_IN_BYTES + MONTH_LENGTH_IN_BYTES + YEAR_LENGTH_IN_BYTES
+}
+
+// Returns whether a value fits in a field of the given length in bytes.
+func _FitsIn(value, length int) bool {
+	return value >= 0 && (length >= 8 || value < 1<<(8*length))
+}
+
+// Writes a value in a field in big endian order, or returns false if it does not fit.
+func _PutField(field []byte, value int) bool {
+	if !_FitsIn(value, len(field)) {
+		return false
+	}
+	for i := len(field) - 1; i >= 0; i-- {
+		field[i] = byte(value)
+		value >>= 8
+	}
+	return true
+}
+
+// Reads a value written in a field in big endian order.
+func _GetField(field []byte) int {
+	value := 0
+	for _, b := range field {
+		value = value<<8 + int(b)
+	}
+	return value
+}
+
+// Reads a DNI written in a field in big endian order, or returns an error if
+// it does not fit in an int.
+func _GetDNI(field []byte) (int, error) {
+	dni := _GetField(field)
+	written := make([]byte, len(field))
+	if !_PutField(written, dni) || !bytes.Equal(written, field) {
+		return 0, fmt.Errorf("dni %x out of range", field)
+	}
+	return dni, nil
+}
+
+// Reads the bets serialized one after the other in a buffer and returns them.
+func _DeserializeBets(buffer []byte, agency_id int, features Features) ([]*Bet, error) {
+	bets := make([]*Bet, 0)
+
+	for offset := 0; offset < len(buffer); {
+		if len(buffer)-offset < _BetFixedLength(features) {
+			return nil, fmt.Errorf("truncated bet at offset %v", offset)
+		}
+		b := buffer[offset:]
+		number := _GetField(b[:NUMBER_LENGTH_IN_BYTES])
+		i := NUMBER_LENGTH_IN_BYTES
+		dni, err := _GetDNI(b[i : i+features.DNILength()])
 		if err != nil {
-			return msg, 0, err
+			return nil, fmt.Errorf("bet at offset %v: %w", offset, err)
+		}
+		i += features.DNILength()
+		birthdate := time.Date(_GetField(b[i+2:i+4]), time.Month(b[i+1]), int(b[i]), 0, 0, 0, 0, time.UTC)
+		i += DAY_LENGTH_IN_BYTES + MONTH_LENGTH_IN_BYTES + YEAR_LENGTH_IN_BYTES
+
+		// Name and Lastname
+		var fields [2]string
+		for f := range fields {
+			if features.Has(CAP_PREFIXED_STRINGS) {
+				if i+STRING_LENGTH_FIELD_LENGTH > len(b) || i+STRING_LENGTH_FIELD_LENGTH+int(b[i]) > len(b) {
+					return nil, fmt.Errorf("truncated name field at offset %v", offset+i)
+				}
+				fields[f] = string(b[i+STRING_LENGTH_FIELD_LENGTH : i+STRING_LENGTH_FIELD_LENGTH+int(b[i])])
+				i += STRING_LENGTH_FIELD_LENGTH + int(b[i])
+			} else {
+				end := bytes.IndexByte(b[i:], BETTOR_INFO_DELIMITER)
+				if end == -1 {
+					return nil, fmt.Errorf("unterminated name field at offset %v", offset+i)
+				}
+				fields[f] = string(b[i : i+end])
+				i += end + 1
+			}
+			if !utf8.ValidString(fields[f]) {
+				return nil, fmt.Errorf("invalid UTF-8 in name field at offset %v", offset+i)
+			}
 		}
+
+		bettor := BettorInfo{name: fields[0], lastname: fields[1], dni: dni, birthdate: birthdate}
+		bets = append(bets, &Bet{number: number, agency: agency_id, bettor: bettor})
+		offset += i
+	}
+
+	return bets, nil
+}
+
+// Returns the bytes received from the server before deadline and its code,
+// or an error if any.
+func _ReadMessage(conn *FramedConn, deadline time.Time) ([]byte, int, error) {
+	// Read a whole frame from the server
+	msg, err := conn.ReadFrame(deadline)
+	if err != nil {
+		return msg, 0, err
+	}
+	if len(msg) < SIZE_FIELD_LENGTH+MSG_CODE_LENGTH {
+		return nil, 0, fmt.Errorf("frame of %v bytes too short for a header", len(msg))
 	}
 
 	message_code_bytes := msg[SIZE_FIELD_LENGTH : SIZE_FIELD_LENGTH+MSG_CODE_LENGTH]
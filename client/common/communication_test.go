@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSerializeBetFieldOverflow(t *testing.T) {
+	bettor := NewBettorInfo("Santiago Lionel", "Lorca", 30904465, "1999-03-17")
+	wide := Features{Version: PROTOCOL_VERSION}
+	tests := []struct {
+		name     string
+		bet      *Bet
+		features Features
+		field    string
+	}{
+		{name: "number too large", bet: &Bet{number: 1 << 16, agency: 1, bettor: *bettor}, features: wide, field: "number"},
+		{name: "negative number", bet: &Bet{number: -1, agency: 1, bettor: *bettor}, features: wide, field: "number"},
+		{name: "dni too large", bet: &Bet{number: 7574, agency: 1, bettor: BettorInfo{dni: 1 << 32}}, features: LegacyFeatures(), field: "dni"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := _SerializeBet(test.bet, test.features)
+			var overflow_err *ErrFieldOverflow
+			if !errors.As(err, &overflow_err) || overflow_err.Field != test.field {
+				t.Fatalf("expected the %v field to overflow, got %v", test.field, err)
+			}
+		})
+	}
+
+	if _, err := _SerializeBet(&Bet{number: 1<<16 - 1, agency: 1, bettor: *bettor}, wide); err != nil {
+		t.Fatalf("expected the largest number to fit, got %v", err)
+	}
+}
+
+// Returns the frames written by the client along with their decoded messages
+func _SentFrames(t *testing.T, features Features, written []byte) ([][]byte, []Message) {
+	t.Helper()
+	conn := NewFramedConn(&testConn{reader: bytes.NewReader(written)})
+	frames, messages := make([][]byte, 0), make([]Message, 0)
+	for {
+		frame, err := conn.ReadFrame(time.Time{})
+		if err == io.EOF {
+			return frames, messages
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		agency_id := _GetField(frame[SIZE_FIELD_LENGTH+MSG_CODE_LENGTH : features.HeaderLength()])
+		message, err := DecodeMessage(int(frame[SIZE_FIELD_LENGTH]), features, agency_id, frame[features.HeaderLength():])
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, messages = append(frames, frame), append(messages, message)
+	}
+}
+
+// Returns bets of bettors with the given documents
+func _TestBets(dnis ...int) []*Bet {
+	bets := make([]*Bet, 0, len(dnis))
+	for i, dni := range dnis {
+		bettor := NewBettorInfo("Santiago Lionel", "Lorca", dni, "1999-03-17")
+		bets = append(bets, NewBet(7574+i, 1, *bettor))
+	}
+	return bets
+}
+
+func TestSendBetsSplitsBatchesLargerThanAFrame(t *testing.T) {
+	bets := _TestBets(30904465, 30904466, 30904467, 30904468, 30904469)
+	// Frames fit two bets each
+	bet_size := _BetSerializaitionLength(bets[0], sequencedFeatures)
+	max_frame_size := sequencedFeatures.HeaderLength() + SEQUENCE_LENGTH + 2*bet_size + sequencedFeatures.TrailerLength()
+
+	frames := _ServerFrames(t, sequencedFeatures,
+		&ConfirmationMessage{Sequence: 1}, &ConfirmationMessage{Sequence: 2}, &ConfirmationMessage{Sequence: 3})
+	conn := &testConn{reader: bytes.NewReader(frames)}
+	framed_conn := NewFramedConn(conn)
+	framed_conn.SetFeatures(sequencedFeatures)
+	framed_conn.SetMaxFrameSize(max_frame_size)
+	if err := SendBets(bets, framed_conn, 1, 0, NewBatchSequence(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, messages := _SentFrames(t, sequencedFeatures, conn.written.Bytes())
+	if len(sent) != 3 {
+		t.Fatalf("expected the bets to be split in 3 frames, got %v", len(sent))
+	}
+	sent_bets := make([]*Bet, 0)
+	for i, message := range messages {
+		if len(sent[i]) > max_frame_size {
+			t.Fatalf("expected frames of at most %v bytes, got %v", max_frame_size, len(sent[i]))
+		}
+		batch := message.(*BetsMessage)
+		if batch.Sequence != uint32(i+1) {
+			t.Fatalf("expected batch %v, got %v", i+1, batch.Sequence)
+		}
+		sent_bets = append(sent_bets, batch.Bets...)
+	}
+	if len(sent_bets) != len(bets) {
+		t.Fatalf("expected %v bets sent, got %v", len(bets), len(sent_bets))
+	}
+	for i, bet := range sent_bets {
+		if bet.number != bets[i].number || bet.bettor.dni != bets[i].bettor.dni {
+			t.Fatalf("expected bet %v to be %v, got %v", i, bets[i], bet)
+		}
+	}
+}
+
+func TestSendBetsRejectsBetsLargerThanAFrame(t *testing.T) {
+	bets := _TestBets(30904465)
+	bet_size := _BetSerializaitionLength(bets[0], sequencedFeatures)
+	max_frame_size := sequencedFeatures.HeaderLength() + SEQUENCE_LENGTH + bet_size - 1 + sequencedFeatures.TrailerLength()
+
+	conn := &testConn{reader: bytes.NewReader(nil)}
+	framed_conn := NewFramedConn(conn)
+	framed_conn.SetFeatures(sequencedFeatures)
+	framed_conn.SetMaxFrameSize(max_frame_size)
+	err := SendBets(bets, framed_conn, 1, 0, NewBatchSequence(), false)
+
+	var too_large_err *ErrBetTooLarge
+	if !errors.As(err, &too_large_err) || too_large_err.Size != bet_size || too_large_err.MaxFrameSize != max_frame_size {
+		t.Fatalf("expected a bet of %v bytes to be too large, got %v", bet_size, err)
+	}
+	if conn.written.Len() != 0 {
+		t.Fatalf("expected nothing to be sent, got %x", conn.written.Bytes())
+	}
+}
+
+func TestSendBatchCompressesOnlyWhenSmaller(t *testing.T) {
+	compressed := Features{Version: PROTOCOL_VERSION, Capabilities: CAP_COMPRESSION}
+	repeated := make([]int, 100)
+	for i := range repeated {
+		repeated[i] = 30904465
+	}
+	tests := []struct {
+		name        string
+		features    Features
+		compression bool
+		bets        []*Bet
+		code        int
+	}{
+		{name: "compressible batch", features: compressed, compression: true, bets: _TestBets(repeated...), code: COMPRESSED_BET_MSG_CODE},
+		{name: "incompressible batch", features: compressed, compression: true, bets: _TestBets(30904465), code: BET_MSG_CODE},
+		{name: "compression disabled", features: compressed, bets: _TestBets(repeated...), code: BET_MSG_CODE},
+		{name: "compression not agreed", features: LegacyFeatures(), compression: true, bets: _TestBets(repeated...), code: BET_MSG_CODE},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &testConn{}
+			framed_conn := NewFramedConn(conn)
+			framed_conn.SetFeatures(test.features)
+			if err := _SendBatch(framed_conn, 1, 0, test.bets, test.compression); err != nil {
+				t.Fatal(err)
+			}
+
+			frames, messages := _SentFrames(t, test.features, conn.written.Bytes())
+			if len(frames) != 1 || int(frames[0][SIZE_FIELD_LENGTH]) != test.code {
+				t.Fatalf("expected a single %v frame, got %x", MessageCodeName(test.code), conn.written.Bytes())
+			}
+			var bets []*Bet
+			switch msg := messages[0].(type) {
+			case *BetsMessage:
+				bets = msg.Bets
+			case *CompressedBetsMessage:
+				bets = msg.Bets
+			}
+			if len(bets) != len(test.bets) {
+				t.Fatalf("expected %v bets sent, got %v", len(test.bets), len(bets))
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/conformance"
+)
+
+// A connection that records what is written to it and reads from a buffer
+type testConn struct {
+	net.Conn
+	written bytes.Buffer
+	reader  io.Reader
+}
+
+func (c *testConn) Read(b []byte) (int, error)         { return c.reader.Read(b) }
+func (c *testConn) Write(b []byte) (int, error)        { return c.written.Write(b) }
+func (c *testConn) Close() error                       { return nil }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Returns the golden vectors of the frames sent by the given side
+func _LoadVectors(t *testing.T, sender string) []conformance.Vector {
+	t.Helper()
+	vectors, err := conformance.Vectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := make([]conformance.Vector, 0)
+	for _, vector := range vectors {
+		if vector.Sender == sender {
+			selected = append(selected, vector)
+		}
+	}
+	if len(selected) == 0 {
+		t.Fatalf("no %v vectors", sender)
+	}
+	return selected
+}
+
+// Returns the frame, the features and the message of a vector
+func _ParseVector(t *testing.T, vector conformance.Vector) ([]byte, Features, Message) {
+	t.Helper()
+	frame, err := vector.Bytes()
+	if err != nil {
+		t.Fatalf("invalid frame: %v", err)
+	}
+	message, err := DecodeJSONMessage(vector.Message)
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	return frame, Features{Version: vector.Version, Capabilities: vector.Capabilities}, message
+}
+
+// Fails the test unless both messages are the same, comparing them in the
+// JSON lines encoding
+func _AssertSameMessage(t *testing.T, agency_id int, expected, actual Message) {
+	t.Helper()
+	expected_json, err := EncodeJSONMessage(expected, agency_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual_json, err := EncodeJSONMessage(actual, agency_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected_json, actual_json) {
+		t.Fatalf("expected message %s, got %s", expected_json, actual_json)
+	}
+}
+
+func TestConformanceSerializeBet(t *testing.T) {
+	for _, vector := range _LoadVectors(t, conformance.SENDER_CLIENT) {
+		frame, features, message := _ParseVector(t, vector)
+		bets_message, ok := message.(*BetsMessage)
+		if !ok {
+			continue
+		}
+		t.Run(vector.Name, func(t *testing.T) {
+			body := frame[features.HeaderLength() : len(frame)-features.TrailerLength()]
+			body = body[len(_EncodeSequence(0, features)):]
+			serialized := make([]byte, 0)
+			for _, bet := range bets_message.Bets {
+				serialized_bet, err := _SerializeBet(bet, features)
+				if err != nil {
+					t.Fatal(err)
+				}
+				serialized = append(serialized, serialized_bet...)
+			}
+			if !bytes.Equal(serialized, body) {
+				t.Fatalf("expected bets %x, got %x", body, serialized)
+			}
+		})
+	}
+}
+
+func TestConformanceSendAux(t *testing.T) {
+	for _, vector := range _LoadVectors(t, conformance.SENDER_CLIENT) {
+		if vector.DecodeOnly {
+			continue
+		}
+		t.Run(vector.Name, func(t *testing.T) {
+			frame, features, message := _ParseVector(t, vector)
+			conn := &testConn{}
+			framed_conn := NewFramedConn(conn)
+			framed_conn.SetFeatures(features)
+
+			var err error
+			if connect, ok := message.(*ConnectMessage); ok && connect.Version != 0 {
+				err = SendConnectMessage(framed_conn, vector.Agency, connect.Capabilities, connect.Session)
+			} else {
+				var body []byte
+				body, err = EncodeMessage(message, features)
+				if err == nil {
+					err = _SendAux(body, framed_conn, vector.Agency, message.Code())
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(conn.written.Bytes(), frame) {
+				t.Fatalf("expected frame %x, got %x", frame, conn.written.Bytes())
+			}
+		})
+	}
+}
+
+func TestConformanceDecodeClientFrames(t *testing.T) {
+	for _, vector := range _LoadVectors(t, conformance.SENDER_CLIENT) {
+		t.Run(vector.Name, func(t *testing.T) {
+			frame, features, expected := _ParseVector(t, vector)
+			// The handshake is framed before any feature is agreed
+			if expected.Code() == CONNECT_CODE {
+				features = LegacyFeatures()
+			}
+			if features.Has(CAP_CHECKSUM) {
+				var err error
+				if frame, err = _VerifyChecksum(frame); err != nil {
+					t.Fatal(err)
+				}
+			}
+			header_agency := _GetField(frame[SIZE_FIELD_LENGTH+MSG_CODE_LENGTH : features.HeaderLength()])
+			message, err := DecodeMessage(int(frame[SIZE_FIELD_LENGTH]), features, header_agency, frame[features.HeaderLength():])
+			if err != nil {
+				t.Fatal(err)
+			}
+			_AssertSameMessage(t, vector.Agency, expected, message)
+		})
+	}
+}
+
+func TestConformanceReceiveServerFrames(t *testing.T) {
+	for _, vector := range _LoadVectors(t, conformance.SENDER_SERVER) {
+		t.Run(vector.Name, func(t *testing.T) {
+			frame, features, expected := _ParseVector(t, vector)
+			conn := NewFramedConn(&testConn{reader: bytes.NewReader(frame)})
+			conn.SetFeatures(features)
+			message, err := _ReceiveBinaryMessage(conn, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_AssertSameMessage(t, 0, expected, message)
+		})
+	}
+}
+
+func TestConformanceReceiveResults(t *testing.T) {
+	for _, vector := range _LoadVectors(t, conformance.SENDER_SERVER) {
+		frame, features, expected := _ParseVector(t, vector)
+		if expected.Code() != RESULTS_MSG_CODE && expected.Code() != WAIT_MSG_CODE {
+			continue
+		}
+		t.Run(vector.Name, func(t *testing.T) {
+			conn := NewFramedConn(&testConn{reader: bytes.NewReader(frame)})
+			conn.SetFeatures(features)
+			winners, wait, err := ReceiveResults(conn, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			results, ok := expected.(*ResultsMessage)
+			if wait != !ok {
+				t.Fatalf("expected wait to be %v", !ok)
+			}
+			if !ok {
+				return
+			}
+			if len(winners) != len(results.Winners) {
+				t.Fatalf("expected winners %v, got %v", results.Winners, winners)
+			}
+			for i := range winners {
+				if winners[i] != results.Winners[i] {
+					t.Fatalf("expected winners %v, got %v", results.Winners, winners)
+				}
+			}
+		})
+	}
+}
+
+func TestConformanceReceiveDetailedResults(t *testing.T) {
+	for _, vector := range _LoadVectors(t, conformance.SENDER_SERVER) {
+		frame, features, expected := _ParseVector(t, vector)
+		if expected.Code() != DETAILED_RESULTS_CODE {
+			continue
+		}
+		t.Run(vector.Name, func(t *testing.T) {
+			conn := NewFramedConn(&testConn{reader: bytes.NewReader(frame)})
+			conn.SetFeatures(features)
+			bets, wait, err := ReceiveDetailedResults(conn, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wait {
+				t.Fatal("expected the winning bets, got a wait")
+			}
+			_AssertSameMessage(t, 0, expected, &DetailedResultsMessage{Bets: bets})
+		})
+	}
+}
+
+func TestConformanceReceiveResultsPages(t *testing.T) {
+	var first, last []byte
+	var features Features
+	for _, vector := range _LoadVectors(t, conformance.SENDER_SERVER) {
+		switch vector.Name {
+		case "results_page_v2_first":
+			first, features, _ = _ParseVector(t, vector)
+		case "results_page_v2_last":
+			last, _, _ = _ParseVector(t, vector)
+		}
+	}
+	if first == nil || last == nil {
+		t.Fatal("no page vectors")
+	}
+
+	conn := NewFramedConn(&testConn{reader: bytes.NewReader(append(append([]byte{}, first...), last...))})
+	conn.SetFeatures(features)
+	winners, wait, err := ReceiveResults(conn, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait || len(winners) != 3 || winners[0] != 30904465 || winners[1] != 21689196 || winners[2] != 95123456 {
+		t.Fatalf("expected the winners of both pages, got %v (wait %v)", winners, wait)
+	}
+
+	conn = NewFramedConn(&testConn{reader: bytes.NewReader(last)})
+	conn.SetFeatures(features)
+	var page_err *ErrUnexpectedPage
+	if _, _, err := ReceiveResults(conn, time.Second); !errors.As(err, &page_err) {
+		t.Fatalf("expected an unexpected page error, got %v", err)
+	}
+}
+
+func TestConformanceQueryDNI(t *testing.T) {
+	frames := make(map[string][]byte)
+	var features Features
+	for _, vector := range append(_LoadVectors(t, conformance.SENDER_CLIENT), _LoadVectors(t, conformance.SENDER_SERVER)...) {
+		if vector.Name == "query_dni_v2" || vector.Name == "query_result_v2" {
+			frames[vector.Name], features, _ = _ParseVector(t, vector)
+		}
+	}
+	if len(frames) != 2 {
+		t.Fatal("no query vectors")
+	}
+
+	conn := &testConn{reader: bytes.NewReader(frames["query_result_v2"])}
+	framed_conn := NewFramedConn(conn)
+	framed_conn.SetFeatures(features)
+	numbers, err := QueryDNI(framed_conn, 1, 30904465)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.written.Bytes(), frames["query_dni_v2"]) {
+		t.Fatalf("expected frame %x, got %x", frames["query_dni_v2"], conn.written.Bytes())
+	}
+	if len(numbers) != 1 || numbers[0] != 7574 {
+		t.Fatalf("expected numbers [7574], got %v", numbers)
+	}
+
+	// The answer must be for the queried bettor
+	framed_conn = NewFramedConn(&testConn{reader: bytes.NewReader(frames["query_result_v2"])})
+	framed_conn.SetFeatures(features)
+	if _, err := QueryDNI(framed_conn, 1, 21689196); err == nil {
+		t.Fatal("expected an error for an answer about another bettor")
+	}
+}
+
+func TestConformanceCancelBet(t *testing.T) {
+	frames := make(map[string][]byte)
+	var features Features
+	for _, vector := range append(_LoadVectors(t, conformance.SENDER_CLIENT), _LoadVectors(t, conformance.SENDER_SERVER)...) {
+		switch vector.Name {
+		case "cancel_bet_v2_sequence":
+			frames[vector.Name], features, _ = _ParseVector(t, vector)
+		case "confirmation_v2_sequence", "error_bet_not_found_v2":
+			frames[vector.Name], _, _ = _ParseVector(t, vector)
+		}
+	}
+	if len(frames) != 3 {
+		t.Fatal("no cancel bet vectors")
+	}
+
+	conn := &testConn{reader: bytes.NewReader(frames["confirmation_v2_sequence"])}
+	framed_conn := NewFramedConn(conn)
+	framed_conn.SetFeatures(features)
+	if err := CancelBet(framed_conn, 1, 7, 7574, 30904465); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(conn.written.Bytes(), frames["cancel_bet_v2_sequence"]) {
+		t.Fatalf("expected frame %x, got %x", frames["cancel_bet_v2_sequence"], conn.written.Bytes())
+	}
+
+	// The confirmation must be for the correction sent
+	framed_conn = NewFramedConn(&testConn{reader: bytes.NewReader(frames["confirmation_v2_sequence"])})
+	framed_conn.SetFeatures(features)
+	var sequence_err *ErrUnexpectedSequence
+	if err := CancelBet(framed_conn, 1, 8, 7574, 30904465); !errors.As(err, &sequence_err) {
+		t.Fatalf("expected an unexpected sequence error, got %v", err)
+	}
+
+	framed_conn = NewFramedConn(&testConn{reader: bytes.NewReader(frames["error_bet_not_found_v2"])})
+	framed_conn.SetFeatures(features)
+	if err := CancelBet(framed_conn, 1, 7, 7574, 30904465); !errors.Is(err, ErrBetNotFound) {
+		t.Fatalf("expected a bet not found error, got %v", err)
+	}
+}
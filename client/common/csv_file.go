@@ -2,7 +2,11 @@ package common
 
 import (
 	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
 	"strconv"
+	"time"
 
 	"os"
 	"strings"
@@ -10,6 +14,19 @@ import (
 
 const MAX_READ_SIZE = 1024
 
+// Actions of the lines of a corrections file
+const CORRECTION_CANCEL = "cancel" // cancel,<dni>,<number>
+const CORRECTION_AMEND = "amend"   // amend,<dni>,<number>,<name>,<lastname>,<dni>,<birthdate>,<number>
+
+// Correction A change to a bet already sent, which is identified by its
+// number and the document of the bettor. Bet is the bet that replaces it, or
+// nil if the bet is cancelled
+type Correction struct {
+	Number int
+	DNI    int
+	Bet    *Bet
+}
+
 type CSVFile struct {
 	FilePath string
 	File     *os.File
@@ -53,6 +70,113 @@ func (f *CSVFile) ReadBetsFromCSVFile(bets_to_read, agency_id int) ([]*Bet, erro
 	return bets, nil
 }
 
+// WriteBetsToCSVFile Writes bets to the file at file_path, replacing it if it
+// exists, with the same columns the bets are read from
+func WriteBetsToCSVFile(file_path string, bets []*Bet) error {
+	file, err := os.Create(file_path)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	for _, bet := range bets {
+		writer.Write([]string{
+			bet.bettor.name,
+			bet.bettor.lastname,
+			strconv.Itoa(bet.bettor.dni),
+			bet.bettor.birthdate.Format("2006-01-02"),
+			strconv.Itoa(bet.number),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadCorrectionsFromCSVFile Reads the corrections to the bets of the agency
+// in the file at file_path. Each line starts with the action and the
+// document and number of the bet, and amendments go on with the replacing
+// bet in the columns the bets are read from. Lines starting with # are
+// comments. Returns an error with the line number if any line is invalid
+func ReadCorrectionsFromCSVFile(file_path string, agency_id int) ([]*Correction, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	corrections := make([]*Correction, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return corrections, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		correction, err := _ParseCorrection(record, agency_id)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%v:%v: %w", file_path, line, err)
+		}
+		corrections = append(corrections, correction)
+	}
+}
+
+// Parses a line of a corrections file
+func _ParseCorrection(record []string, agency_id int) (*Correction, error) {
+	expected_fields := map[string]int{CORRECTION_CANCEL: 3, CORRECTION_AMEND: 8}[record[0]]
+	if expected_fields == 0 {
+		return nil, fmt.Errorf("unknown correction %q, expected %v or %v", record[0], CORRECTION_CANCEL, CORRECTION_AMEND)
+	}
+	if len(record) != expected_fields {
+		return nil, fmt.Errorf("%v correction of %v fields, expected %v", record[0], len(record), expected_fields)
+	}
+
+	correction := &Correction{}
+	var err error
+	if correction.DNI, err = _ParseCSVNumber("dni", record[1], -1); err != nil {
+		return nil, err
+	}
+	if correction.Number, err = _ParseCSVNumber("number", record[2], 1<<16-1); err != nil {
+		return nil, err
+	}
+	if record[0] == CORRECTION_CANCEL {
+		return correction, nil
+	}
+
+	name, lastname, birthdate := record[3], record[4], record[6]
+	dni, err := _ParseCSVNumber("dni", record[5], -1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := time.Parse("2006-01-02", birthdate); err != nil {
+		return nil, fmt.Errorf("invalid birthdate %q", birthdate)
+	}
+	number, err := _ParseCSVNumber("number", record[7], 1<<16-1)
+	if err != nil {
+		return nil, err
+	}
+	correction.Bet = NewBet(number, agency_id, *NewBettorInfo(name, lastname, dni, birthdate))
+	return correction, nil
+}
+
+// Parses a non negative integer field, which must not be greater than max
+// unless max is negative
+func _ParseCSVNumber(field, value string, max int) (int, error) {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 || (max >= 0 && parsed > max) {
+		return 0, fmt.Errorf("invalid %v %q", field, value)
+	}
+	return parsed, nil
+}
+
 // Returns the next line in the CSVFile or any error that occurs
 func (f *CSVFile) _NextLineTokens() (map[string]string, error) {
 	if f.File == nil {
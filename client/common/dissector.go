@@ -0,0 +1,264 @@
+package common
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// Senders of the frames of a capture, which are framed differently
+const SENDER_CLIENT = "client" // Frames carry the agency in the header
+const SENDER_SERVER = "server" // Frames have no agency and end with a terminator
+
+// Names of the message codes, as used in the protocol documentation
+var messageCodeNames = map[int]string{
+	CONNECT_CODE:               "CONNECT",
+	CONNECT_ACK_CODE:           "CONNECT_ACK",
+	CHALLENGE_CODE:             "CHALLENGE",
+	AUTH_CODE:                  "AUTH",
+	BET_MSG_CODE:               "BET",
+	COMPRESSED_BET_MSG_CODE:    "COMPRESSED_BET",
+	QUERY_DNI_CODE:             "QUERY_DNI",
+	CANCEL_BET_CODE:            "CANCEL_BET",
+	AMEND_BET_CODE:             "AMEND_BET",
+	FINISHED_CODE:              "FINISHED",
+	CONSULT_CODE:               "CONSULT",
+	SUBSCRIBE_RESULTS_CODE:     "SUBSCRIBE_RESULTS",
+	CONFIRMATION_CODE:          "CONFIRMATION",
+	RESULTS_MSG_CODE:           "RESULTS",
+	RESULTS_PAGE_CODE:          "RESULTS_PAGE",
+	DETAILED_RESULTS_CODE:      "DETAILED_RESULTS",
+	DETAILED_RESULTS_PAGE_CODE: "DETAILED_RESULTS_PAGE",
+	QUERY_RESULT_CODE:          "QUERY_RESULT",
+	WAIT_MSG_CODE:              "WAIT",
+	NACK_CODE:                  "NACK",
+	AUTH_OK_CODE:               "AUTH_OK",
+	AUTH_FAILED_CODE:           "AUTH_FAILED",
+	ERROR_CODE:                 "ERROR",
+	PING_CODE:                  "PING",
+	PONG_CODE:                  "PONG",
+}
+
+// MessageCodeName Returns the name of a message code, or UNKNOWN if the code
+// has no message
+func MessageCodeName(code int) string {
+	name, ok := messageCodeNames[code]
+	if !ok {
+		return "UNKNOWN"
+	}
+	return name
+}
+
+// DissectedFrame A frame found in a capture, decoded as far as possible.
+// Agency is -1 for frames without an agency field, and Message is nil if the
+// body could not be decoded. Problems lists the inconsistencies found in the
+// frame
+type DissectedFrame struct {
+	Offset   int
+	Size     int
+	Code     int
+	Agency   int
+	Features Features
+	Message  Message
+	Problems []string
+}
+
+// DissectFrames Splits a capture of the frames sent by one side of a
+// connection and decodes each of them with the given features. The features
+// found in a CONNECT or CONNECT_ACK frame are used for the frames that follow
+// it, as the server agrees to every framing capability the client proposes.
+// Returns the frames and the bytes left at the end of the capture that do
+// not form a frame
+func DissectFrames(capture []byte, sender string, features Features) ([]*DissectedFrame, []byte) {
+	frames := make([]*DissectedFrame, 0)
+	offset := 0
+	for len(capture)-offset >= SIZE_FIELD_LENGTH+MSG_CODE_LENGTH {
+		frame := _DissectFrame(capture[offset:], sender, features)
+		frame.Offset = offset
+		frames = append(frames, frame)
+		if frame.Size < SIZE_FIELD_LENGTH+MSG_CODE_LENGTH {
+			// The frame boundaries cannot be trusted from here on
+			return frames, capture[offset:]
+		}
+
+		switch msg := frame.Message.(type) {
+		case *ConnectMessage:
+			if msg.Version != 0 {
+				features = Features{Version: msg.Version, Capabilities: msg.Capabilities & SUPPORTED_CAPABILITIES}
+			}
+		case *ConnectAckMessage:
+			features = Features{Version: msg.Version, Capabilities: msg.Capabilities}
+		}
+		offset += frame.Size
+		if offset > len(capture) {
+			offset = len(capture)
+		}
+	}
+	return frames, capture[offset:]
+}
+
+// Decodes the frame at the start of data. The size of the returned frame is
+// the declared one, which may not match the bytes available
+func _DissectFrame(data []byte, sender string, features Features) *DissectedFrame {
+	frame := &DissectedFrame{
+		Size:     _GetField(data[:SIZE_FIELD_LENGTH]),
+		Code:     int(data[SIZE_FIELD_LENGTH]),
+		Agency:   -1,
+		Features: features,
+	}
+	// The handshake is framed before any feature is agreed
+	if frame.Code == CONNECT_CODE || frame.Code == CONNECT_ACK_CODE {
+		frame.Features = LegacyFeatures()
+	}
+
+	header_length := SIZE_FIELD_LENGTH + MSG_CODE_LENGTH
+	if sender == SENDER_CLIENT {
+		header_length = frame.Features.HeaderLength()
+	}
+	if frame.Size < header_length {
+		frame._Problem("declared size %v is shorter than the header of %v bytes", frame.Size, header_length)
+		return frame
+	}
+	if frame.Size > len(data) {
+		frame._Problem("declared size %v but only %v bytes are left", frame.Size, len(data))
+	}
+
+	contents := data
+	if frame.Size < len(data) {
+		contents = data[:frame.Size]
+	}
+	if len(contents) < header_length {
+		return frame
+	}
+	if sender == SENDER_CLIENT {
+		frame.Agency = _GetField(contents[SIZE_FIELD_LENGTH+MSG_CODE_LENGTH : header_length])
+	} else if contents[len(contents)-1] != MSG_TERMINATOR {
+		frame._Problem("missing terminator")
+	} else {
+		contents = contents[:len(contents)-1]
+	}
+
+	if frame.Features.Has(CAP_CHECKSUM) {
+		if len(contents) < header_length+CHECKSUM_LENGTH {
+			frame._Problem("frame of %v bytes too short for a checksum", len(contents))
+			return frame
+		}
+		body_end := len(contents) - CHECKSUM_LENGTH
+		expected := uint32(_GetField(contents[body_end:]))
+		if actual := crc32.ChecksumIEEE(contents[:body_end]); actual != expected {
+			frame._Problem("%v", &ErrChecksumMismatch{Expected: expected, Actual: actual})
+		}
+		contents = contents[:body_end]
+	}
+
+	agency_id := frame.Agency
+	if agency_id < 0 {
+		agency_id = 0
+	}
+	message, err := DecodeMessage(frame.Code, frame.Features, agency_id, contents[header_length:])
+	if err != nil {
+		frame._Problem("%v", err)
+		return frame
+	}
+	frame.Message = message
+	return frame
+}
+
+// Records an inconsistency found in the frame
+func (f *DissectedFrame) _Problem(format string, args ...interface{}) {
+	f.Problems = append(f.Problems, fmt.Sprintf(format, args...))
+}
+
+// String Returns the frame as a header line followed by a line for each
+// decoded field and each problem found
+func (f *DissectedFrame) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "offset: %v | size: %v | code: %v (%v)", f.Offset, f.Size, MessageCodeName(f.Code), f.Code)
+	if f.Agency >= 0 {
+		fmt.Fprintf(&b, " | agency: %v", f.Agency)
+	}
+	fmt.Fprintf(&b, " | version: %v | capabilities: %v\n", f.Features.Version, f.Features)
+	for _, line := range _DescribeMessage(f.Message) {
+		fmt.Fprintf(&b, "  %v\n", line)
+	}
+	for _, problem := range f.Problems {
+		fmt.Fprintf(&b, "  ! %v\n", problem)
+	}
+	return b.String()
+}
+
+// Returns a line for each field of a message worth showing
+func _DescribeMessage(message Message) []string {
+	lines := make([]string, 0)
+	switch msg := message.(type) {
+	case *ConnectMessage:
+		if msg.Version == 0 {
+			return append(lines, "legacy connect, no negotiation")
+		}
+		features := Features{Version: msg.Version, Capabilities: msg.Capabilities}
+		lines = append(lines, fmt.Sprintf("version: %v | capabilities: %v (%v) | agency: %v", msg.Version, features, msg.Capabilities, msg.Agency))
+		if msg.Session != 0 {
+			lines = append(lines, fmt.Sprintf("session: %v", msg.Session))
+		}
+	case *ConnectAckMessage:
+		features := Features{Version: msg.Version, Capabilities: msg.Capabilities}
+		lines = append(lines, fmt.Sprintf("version: %v | capabilities: %v (%v)", msg.Version, features, msg.Capabilities))
+	case *ChallengeMessage:
+		lines = append(lines, fmt.Sprintf("nonce: %x", msg.Nonce))
+	case *AuthMessage:
+		lines = append(lines, fmt.Sprintf("response: %x", msg.Response))
+	case *BetsMessage:
+		lines = append(lines, fmt.Sprintf("sequence: %v | bets: %v", msg.Sequence, len(msg.Bets)))
+		lines = append(lines, _DescribeBets(msg.Bets)...)
+	case *CompressedBetsMessage:
+		lines = append(lines, fmt.Sprintf("sequence: %v | bets: %v", msg.Sequence, len(msg.Bets)))
+		lines = append(lines, _DescribeBets(msg.Bets)...)
+	case *ConfirmationMessage:
+		lines = append(lines, fmt.Sprintf("sequence: %v", msg.Sequence))
+	case *NackMessage:
+		lines = append(lines, fmt.Sprintf("sequence: %v", msg.Sequence))
+	case *ResultsMessage:
+		lines = append(lines, fmt.Sprintf("winners: %v", len(msg.Winners)))
+		lines = append(lines, _DescribeWinners(msg.Winners)...)
+	case *ResultsPageMessage:
+		lines = append(lines, fmt.Sprintf("page: %v | last: %v | winners: %v", msg.Index, msg.Last, len(msg.Winners)))
+		lines = append(lines, _DescribeWinners(msg.Winners)...)
+	case *DetailedResultsMessage:
+		lines = append(lines, fmt.Sprintf("bets: %v", len(msg.Bets)))
+		lines = append(lines, _DescribeBets(msg.Bets)...)
+	case *DetailedResultsPageMessage:
+		lines = append(lines, fmt.Sprintf("page: %v | last: %v | bets: %v", msg.Index, msg.Last, len(msg.Bets)))
+		lines = append(lines, _DescribeBets(msg.Bets)...)
+	case *QueryDNIMessage:
+		lines = append(lines, fmt.Sprintf("dni: %v", msg.DNI))
+	case *CancelBetMessage:
+		lines = append(lines, fmt.Sprintf("sequence: %v | number: %v | dni: %v", msg.Sequence, msg.Number, msg.DNI))
+	case *AmendBetMessage:
+		lines = append(lines, fmt.Sprintf("sequence: %v | number: %v | dni: %v | amended to:", msg.Sequence, msg.Number, msg.DNI))
+		lines = append(lines, _DescribeBets([]*Bet{msg.Bet})...)
+	case *QueryResultMessage:
+		lines = append(lines, fmt.Sprintf("dni: %v | numbers: %v", msg.DNI, msg.Numbers))
+	case *ErrorMessage:
+		lines = append(lines, (&ErrServer{Reason: msg.Reason, Description: msg.Description}).Error())
+	}
+	return lines
+}
+
+// Returns a line for each winner of the results
+func _DescribeWinners(winners []int) []string {
+	lines := make([]string, 0, len(winners))
+	for _, winner := range winners {
+		lines = append(lines, fmt.Sprintf("dni: %v", winner))
+	}
+	return lines
+}
+
+// Returns a line for each bet of a batch
+func _DescribeBets(bets []*Bet) []string {
+	lines := make([]string, 0, len(bets))
+	for _, bet := range bets {
+		lines = append(lines, fmt.Sprintf("number: %v | dni: %v | birthdate: %v | name: %q | lastname: %q",
+			bet.number, bet.bettor.dni, bet.bettor.birthdate.Format("2006-01-02"), bet.bettor.name, bet.bettor.lastname))
+	}
+	return lines
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/conformance"
+)
+
+// Returns the frames a client sends to negotiate the given capabilities and
+// then send a batch and end betting
+func _ClientCapture(t *testing.T, capabilities uint32) []byte {
+	t.Helper()
+	conn := &testConn{}
+	framed_conn := NewFramedConn(conn)
+	if err := SendConnectMessage(framed_conn, 1, capabilities, 0); err != nil {
+		t.Fatal(err)
+	}
+	framed_conn.SetFeatures(Features{Version: PROTOCOL_VERSION, Capabilities: capabilities})
+	bettor := NewBettorInfo("Santiago Lionel", "Lorca", 30904465, "1999-03-17")
+	if err := SendMessage(framed_conn, 1, &BetsMessage{Sequence: 7, Bets: []*Bet{NewBet(7574, 1, *bettor)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SendMessage(framed_conn, 1, &FinishedMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	return conn.written.Bytes()
+}
+
+func _AssertFrameCodes(t *testing.T, frames []*DissectedFrame, codes ...int) {
+	t.Helper()
+	if len(frames) != len(codes) {
+		t.Fatalf("expected %v frames, got %v", len(codes), len(frames))
+	}
+	for i, frame := range frames {
+		if frame.Code != codes[i] {
+			t.Fatalf("expected frame %v to be %v, got %v", i, MessageCodeName(codes[i]), MessageCodeName(frame.Code))
+		}
+	}
+}
+
+func TestDissectClientCapture(t *testing.T) {
+	capabilities := uint32(CAP_CHECKSUM | CAP_PREFIXED_STRINGS | CAP_SEQUENCE_NUMBERS)
+	capture := _ClientCapture(t, capabilities)
+
+	frames, rest := DissectFrames(capture, SENDER_CLIENT, LegacyFeatures())
+	if len(rest) != 0 {
+		t.Fatalf("expected the whole capture to be dissected, %x left", rest)
+	}
+	_AssertFrameCodes(t, frames, CONNECT_CODE, BET_MSG_CODE, FINISHED_CODE)
+	offset := 0
+	for _, frame := range frames {
+		if len(frame.Problems) != 0 || frame.Message == nil || frame.Agency != 1 {
+			t.Fatalf("expected frame at %v to be decoded, got:\n%v", frame.Offset, frame)
+		}
+		if frame.Offset != offset {
+			t.Fatalf("expected frame at offset %v, got %v", offset, frame.Offset)
+		}
+		offset += frame.Size
+	}
+	// The features of the frames that follow the handshake are the agreed ones
+	if frames[1].Features.Capabilities != capabilities {
+		t.Fatalf("expected the features proposed in the handshake, got %v", frames[1].Features)
+	}
+	if batch := frames[1].Message.(*BetsMessage); batch.Sequence != 7 || len(batch.Bets) != 1 || batch.Bets[0].number != 7574 {
+		t.Fatalf("unexpected batch %v", frames[1])
+	}
+}
+
+func TestDissectTruncatedCapture(t *testing.T) {
+	capture := _ClientCapture(t, CAP_CHECKSUM)
+	truncated := capture[:len(capture)-3]
+
+	frames, rest := DissectFrames(truncated, SENDER_CLIENT, LegacyFeatures())
+	if len(rest) != 0 {
+		t.Fatalf("expected no bytes left, got %x", rest)
+	}
+	_AssertFrameCodes(t, frames, CONNECT_CODE, BET_MSG_CODE, FINISHED_CODE)
+	last := frames[len(frames)-1]
+	if last.Message != nil || len(last.Problems) == 0 || !strings.Contains(last.Problems[0], "only") {
+		t.Fatalf("expected the truncated frame to be reported, got:\n%v", last)
+	}
+
+	// Fewer bytes than a header are left undissected
+	frames, rest = DissectFrames(capture[:2], SENDER_CLIENT, LegacyFeatures())
+	if len(frames) != 0 || !bytes.Equal(rest, capture[:2]) {
+		t.Fatalf("expected a partial header to be left, got %v frames and %x", len(frames), rest)
+	}
+
+	// A size that cannot hold a header makes the rest of the capture unusable
+	broken := append([]byte{0x00, 0x01, BET_MSG_CODE}, capture...)
+	frames, rest = DissectFrames(broken, SENDER_CLIENT, LegacyFeatures())
+	if len(frames) != 1 || len(frames[0].Problems) == 0 || !bytes.Equal(rest, broken) {
+		t.Fatalf("expected the capture to be left undissected, got %v frames and %x", len(frames), rest)
+	}
+}
+
+func TestDissectServerCapture(t *testing.T) {
+	var capture []byte
+	var features Features
+	expected := make([]Message, 0)
+	for _, vector := range _LoadVectors(t, conformance.SENDER_SERVER) {
+		if vector.Name == "confirmation_v2_sequence_checksum" || vector.Name == "nack_v2_sequence_checksum" {
+			frame, vector_features, message := _ParseVector(t, vector)
+			capture = append(capture, frame...)
+			features = vector_features
+			expected = append(expected, message)
+		}
+	}
+	// A corrupted checksum is reported without losing the frame boundaries
+	corrupted := append([]byte{}, capture...)
+	corrupted[len(corrupted)-2] ^= 0xff
+
+	frames, rest := DissectFrames(corrupted, SENDER_SERVER, features)
+	if len(rest) != 0 {
+		t.Fatalf("expected the whole capture to be dissected, %x left", rest)
+	}
+	_AssertFrameCodes(t, frames, CONFIRMATION_CODE, NACK_CODE)
+	if frames[0].Agency != -1 || len(frames[0].Problems) != 0 {
+		t.Fatalf("unexpected first frame:\n%v", frames[0])
+	}
+	_AssertSameMessage(t, 0, expected[0], frames[0].Message)
+	if len(frames[1].Problems) == 0 || !strings.Contains(frames[1].Problems[0], "checksum") {
+		t.Fatalf("expected the checksum mismatch to be reported, got:\n%v", frames[1])
+	}
+}
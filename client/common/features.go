@@ -0,0 +1,103 @@
+package common
+
+import (
+	"strings"
+)
+
+// Capabilities that can be negotiated with the server. Each one is a bit of
+// the capabilities bitmask sent in the connect message
+const CAP_COMPRESSION = 1 << 0      // Bet batches may be compressed
+const CAP_CHECKSUM = 1 << 1         // Frames carry a checksum
+const CAP_PAGING = 1 << 2           // Results may be sent in pages
+const CAP_PREFIXED_STRINGS = 1 << 3 // Name fields are length-prefixed instead of delimited
+const CAP_SEQUENCE_NUMBERS = 1 << 4 // Bet batches and their confirmations carry a sequence number
+const CAP_AUTHENTICATION = 1 << 5   // Agencies prove their identity answering a challenge
+const CAP_HEARTBEAT = 1 << 6        // Either side may ping the other while the connection is idle
+const CAP_DETAILED_RESULTS = 1 << 7 // Results carry the winning bets instead of their documents
+const CAP_BETTOR_QUERY = 1 << 8     // Agencies may ask whether a bettor won by their document
+const CAP_CORRECTIONS = 1 << 9      // Agencies may cancel or amend their bets before finishing
+const CAP_PUSHED_RESULTS = 1 << 10  // Results are pushed to subscribed agencies once drawn instead of polled
+
+// Capabilities implemented by the client
+const SUPPORTED_CAPABILITIES = CAP_PREFIXED_STRINGS | CAP_CHECKSUM | CAP_SEQUENCE_NUMBERS | CAP_COMPRESSION | CAP_AUTHENTICATION | CAP_HEARTBEAT | CAP_PAGING | CAP_DETAILED_RESULTS | CAP_BETTOR_QUERY | CAP_CORRECTIONS | CAP_PUSHED_RESULTS
+
+// Capabilities that only make sense in the binary encoding
+const BINARY_CAPABILITIES = CAP_COMPRESSION | CAP_CHECKSUM | CAP_PREFIXED_STRINGS
+
+// Names of the capabilities, used for logging
+var capabilityNames = []struct {
+	capability uint32
+	name       string
+}{
+	{CAP_COMPRESSION, "compression"},
+	{CAP_CHECKSUM, "checksum"},
+	{CAP_PAGING, "paging"},
+	{CAP_PREFIXED_STRINGS, "prefixed_strings"},
+	{CAP_SEQUENCE_NUMBERS, "sequence_numbers"},
+	{CAP_AUTHENTICATION, "authentication"},
+	{CAP_HEARTBEAT, "heartbeat"},
+	{CAP_DETAILED_RESULTS, "detailed_results"},
+	{CAP_BETTOR_QUERY, "bettor_query"},
+	{CAP_CORRECTIONS, "corrections"},
+	{CAP_PUSHED_RESULTS, "pushed_results"},
+}
+
+// Features Protocol version and capabilities agreed with the server
+type Features struct {
+	Version      int
+	Capabilities uint32
+}
+
+// LegacyFeatures Returns the features of a server that does not negotiate
+func LegacyFeatures() Features {
+	return Features{Version: LEGACY_PROTOCOL_VERSION, Capabilities: 0}
+}
+
+// AgencyLength Returns the size of the agency field of the frame header in bytes
+func (f Features) AgencyLength() int {
+	if f.Version >= WIDE_FIELDS_PROTOCOL_VERSION {
+		return AGENCY_LENGTH_IN_BYTES_V2
+	}
+	return AGENCY_LENGTH_IN_BYTES
+}
+
+// DNILength Returns the size of the DNI fields in bytes
+func (f Features) DNILength() int {
+	if f.Version >= WIDE_FIELDS_PROTOCOL_VERSION {
+		return DNI_LENGTH_IN_BYTES_V2
+	}
+	return DNI_LENGTH_IN_BYTES
+}
+
+// HeaderLength Returns the size of the header of the frames sent by the client in bytes
+func (f Features) HeaderLength() int {
+	return SIZE_FIELD_LENGTH + MSG_CODE_LENGTH + f.AgencyLength()
+}
+
+// TrailerLength Returns the size of the trailer of the frames in bytes
+func (f Features) TrailerLength() int {
+	if f.Has(CAP_CHECKSUM) {
+		return CHECKSUM_LENGTH
+	}
+	return 0
+}
+
+// Has Returns whether the given capability was agreed
+func (f Features) Has(capability uint32) bool {
+	return f.Capabilities&capability == capability
+}
+
+// String Returns the names of the agreed capabilities separated by commas,
+// or "none" if no capability was agreed
+func (f Features) String() string {
+	names := make([]string, 0)
+	for _, c := range capabilityNames {
+		if f.Has(c.capability) {
+			names = append(names, c.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
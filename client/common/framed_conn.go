@@ -0,0 +1,195 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// FramedConn Wraps a net.Conn and reads and writes whole protocol frames.
+// A single buffered reader is kept for the whole session so bytes read past
+// the end of a frame are kept for the next one instead of being discarded.
+// It also keeps the features agreed for the session and the largest frame
+// that may be written. Frames may be written from several goroutines. Every
+// read and write is bounded by its timeout and by an overall deadline. In the
+// JSON lines encoding each message is a line instead of a frame
+type FramedConn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	write_mutex    sync.Mutex
+	features       Features
+	max_frame_size int
+	heartbeat      *Heartbeat
+	read_timeout   time.Duration
+	write_timeout  time.Duration
+	deadline       time.Time
+	encoding       string
+}
+
+// NewFramedConn Initializes a new FramedConn over an established connection
+func NewFramedConn(conn net.Conn) *FramedConn {
+	return &FramedConn{
+		conn:           conn,
+		reader:         bufio.NewReader(conn),
+		features:       LegacyFeatures(),
+		max_frame_size: MAX_FRAME_SIZE,
+		encoding:       ENCODING_BINARY,
+	}
+}
+
+// ReadFrame Reads exactly one frame from the connection before deadline,
+// which is capped by the overall deadline: the size field followed by as many
+// bytes as it declares. The returned slice includes the size field. Returns
+// an error if the connection fails, the deadline passes or the declared size
+// is too small to hold a frame header
+func (f *FramedConn) ReadFrame(deadline time.Time) ([]byte, error) {
+	if err := f._SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	size_field := make([]byte, SIZE_FIELD_LENGTH)
+	if _, err := io.ReadFull(f.reader, size_field); err != nil {
+		return nil, err
+	}
+
+	frame_size := int(size_field[0])<<8 + int(size_field[1])
+	if frame_size < SIZE_FIELD_LENGTH+MSG_CODE_LENGTH {
+		return nil, fmt.Errorf("invalid frame size: %v", frame_size)
+	}
+
+	frame := make([]byte, frame_size)
+	copy(frame, size_field)
+	if _, err := io.ReadFull(f.reader, frame[SIZE_FIELD_LENGTH:]); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
+
+// ReadLine Reads one line from the connection before deadline, which is
+// capped by the overall deadline. The returned slice includes the line
+// terminator. Returns an error if the connection fails, the deadline passes
+// or the line is longer than MAX_LINE_LENGTH
+func (f *FramedConn) ReadLine(deadline time.Time) ([]byte, error) {
+	if err := f._SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	line := make([]byte, 0)
+	for {
+		chunk, err := f.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > MAX_LINE_LENGTH {
+			return nil, fmt.Errorf("line exceeds the maximum of %v bytes", MAX_LINE_LENGTH)
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// Sets the deadline of the reads of the underlying connection, capped by the
+// overall deadline
+func (f *FramedConn) _SetReadDeadline(deadline time.Time) error {
+	if !f.deadline.IsZero() && (deadline.IsZero() || f.deadline.Before(deadline)) {
+		deadline = f.deadline
+	}
+	return f.conn.SetReadDeadline(deadline)
+}
+
+// WriteFrame Writes a whole frame to the connection within the write
+// timeout guarding against short writes and returns an error if any. A
+// timeout is returned as ErrTimeout, or as ErrLoopLapsed if the overall
+// deadline passed
+func (f *FramedConn) WriteFrame(frame []byte) error {
+	f.write_mutex.Lock()
+	defer f.write_mutex.Unlock()
+
+	deadline := _Deadline(f.write_timeout, f.deadline)
+	if err := f.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	total_bytes_written := 0
+	for total_bytes_written < len(frame) {
+		bytes_written, err := f.conn.Write(frame[total_bytes_written:])
+		if err != nil {
+			return _TimeoutError("write", f.write_timeout, deadline, f.deadline, err)
+		}
+		total_bytes_written += bytes_written
+	}
+	return nil
+}
+
+// Features Returns the features agreed for the session
+func (f *FramedConn) Features() Features {
+	return f.features
+}
+
+// SetFeatures Sets the features agreed for the session
+func (f *FramedConn) SetFeatures(features Features) {
+	f.features = features
+}
+
+// MaxFrameSize Returns the size of the largest frame that may be written
+func (f *FramedConn) MaxFrameSize() int {
+	return f.max_frame_size
+}
+
+// SetMaxFrameSize Sets the size of the largest frame that may be written. It
+// can never exceed what the size field can hold
+func (f *FramedConn) SetMaxFrameSize(max_frame_size int) {
+	if max_frame_size <= 0 || max_frame_size > MAX_FRAME_SIZE {
+		max_frame_size = MAX_FRAME_SIZE
+	}
+	f.max_frame_size = max_frame_size
+}
+
+// SetTimeouts Sets the time reading and writing a frame may take. Zero
+// means no limit other than the overall deadline
+func (f *FramedConn) SetTimeouts(read_timeout, write_timeout time.Duration) {
+	f.read_timeout = read_timeout
+	f.write_timeout = write_timeout
+}
+
+// ReadTimeout Returns the time reading a frame may take
+func (f *FramedConn) ReadTimeout() time.Duration {
+	return f.read_timeout
+}
+
+// SetDeadline Sets the overall deadline no read or write may go past,
+// whatever its timeout. The zero value means none
+func (f *FramedConn) SetDeadline(deadline time.Time) {
+	f.deadline = deadline
+}
+
+// Deadline Returns the overall deadline of the connection
+func (f *FramedConn) Deadline() time.Time {
+	return f.deadline
+}
+
+// Encoding Returns the encoding of the messages on the connection
+func (f *FramedConn) Encoding() string {
+	return f.encoding
+}
+
+// SetEncoding Sets the encoding of the messages on the connection
+func (f *FramedConn) SetEncoding(encoding string) {
+	f.encoding = encoding
+}
+
+// Heartbeat Returns the heartbeat bound to the connection, or nil if none
+func (f *FramedConn) Heartbeat() *Heartbeat {
+	return f.heartbeat
+}
+
+// Close Stops the heartbeat bound to the connection, if any, and closes the
+// underlying connection
+func (f *FramedConn) Close() error {
+	if f.heartbeat != nil {
+		f.heartbeat.Stop()
+	}
+	return f.conn.Close()
+}
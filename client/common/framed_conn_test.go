@@ -0,0 +1,94 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A connection that writes a single byte at a time, so frames written
+// concurrently would interleave unless the writes are serialized
+type shortWriteConn struct {
+	testConn
+	mutex sync.Mutex
+}
+
+func (c *shortWriteConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	c.mutex.Lock()
+	n, err := c.written.Write(b[:1])
+	c.mutex.Unlock()
+	// Let other writers run between the bytes of a frame
+	runtime.Gosched()
+	return n, err
+}
+
+// Returns a frame of the given size whose body is filled with fill
+func _FillerFrame(size int, fill byte) []byte {
+	frame := bytes.Repeat([]byte{fill}, size)
+	frame[0], frame[1], frame[2] = byte(size>>8), byte(size), BET_MSG_CODE
+	return frame
+}
+
+func TestReadFrameKeepsBytesPastTheFrame(t *testing.T) {
+	first, second := _FillerFrame(5, 0xaa), _FillerFrame(7, 0xbb)
+	// Both frames arrive in a single read of the connection
+	conn := NewFramedConn(&testConn{reader: bytes.NewReader(append(append([]byte{}, first...), second...))})
+
+	for _, expected := range [][]byte{first, second} {
+		frame, err := conn.ReadFrame(time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(frame, expected) {
+			t.Fatalf("expected frame %x, got %x", expected, frame)
+		}
+	}
+	if _, err := conn.ReadFrame(time.Time{}); err != io.EOF {
+		t.Fatalf("expected the capture to end, got %v", err)
+	}
+}
+
+func TestReadFrameRejectsSizesShorterThanTheHeader(t *testing.T) {
+	for _, size := range []int{0, SIZE_FIELD_LENGTH, SIZE_FIELD_LENGTH + MSG_CODE_LENGTH - 1} {
+		conn := NewFramedConn(&testConn{reader: bytes.NewReader([]byte{byte(size >> 8), byte(size), BET_MSG_CODE, 0})})
+		if _, err := conn.ReadFrame(time.Time{}); err == nil {
+			t.Fatalf("expected a declared size of %v to be rejected", size)
+		}
+	}
+}
+
+func TestWriteFrameDoesNotInterleave(t *testing.T) {
+	conn := &shortWriteConn{}
+	framed_conn := NewFramedConn(conn)
+
+	const writers = 8
+	const frame_size = 64
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(fill byte) {
+			defer wg.Done()
+			if err := framed_conn.WriteFrame(_FillerFrame(frame_size, fill)); err != nil {
+				t.Error(err)
+			}
+		}(byte(0xa0 + i))
+	}
+	wg.Wait()
+
+	written := conn.written.Bytes()
+	if len(written) != writers*frame_size {
+		t.Fatalf("expected %v bytes written, got %v", writers*frame_size, len(written))
+	}
+	for offset := 0; offset < len(written); offset += frame_size {
+		frame := written[offset : offset+frame_size]
+		if !bytes.Equal(frame, _FillerFrame(frame_size, frame[frame_size-1])) {
+			t.Fatalf("expected whole frames, got interleaved bytes %x", frame)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//go:build go1.18
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/conformance"
+)
+
+// Adds the frames of the golden vectors sent by the given side to the seed
+// corpus of a fuzz target, along with the capabilities they were encoded with
+func _AddVectorSeeds(f *testing.F, sender string) {
+	vectors, err := conformance.Vectors()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, vector := range vectors {
+		frame, err := vector.Bytes()
+		if err != nil {
+			f.Fatal(err)
+		}
+		if vector.Sender == sender {
+			f.Add(frame, vector.Version == WIDE_FIELDS_PROTOCOL_VERSION, vector.Capabilities)
+		}
+	}
+}
+
+// Returns the features of a session out of the fuzzed parameters
+func _FuzzFeatures(wide bool, capabilities uint32) Features {
+	if wide {
+		return Features{Version: WIDE_FIELDS_PROTOCOL_VERSION, Capabilities: capabilities}
+	}
+	return Features{Version: LEGACY_PROTOCOL_VERSION, Capabilities: capabilities}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	_AddVectorSeeds(f, conformance.SENDER_SERVER)
+	f.Fuzz(func(t *testing.T, frame []byte, wide bool, capabilities uint32) {
+		if len(frame) < SIZE_FIELD_LENGTH+MSG_CODE_LENGTH {
+			return
+		}
+		features := _FuzzFeatures(wide, capabilities)
+		code := int(frame[SIZE_FIELD_LENGTH])
+		body := frame[SIZE_FIELD_LENGTH+MSG_CODE_LENGTH:]
+		message, err := DecodeMessage(code, features, 0, body)
+		if err != nil {
+			var malformed_err *ErrMalformedMessage
+			var unknown_err *ErrUnknownMessage
+			if !errors.As(err, &malformed_err) && !errors.As(err, &unknown_err) {
+				t.Fatalf("untyped error: %v", err)
+			}
+			return
+		}
+
+		// The winners are exactly the DNIs the body carries
+		if results, ok := message.(*ResultsMessage); ok {
+			encoded, err := EncodeMessage(results, features)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encoded, body) {
+				t.Fatalf("winners %v encode to %x, decoded from %x", results.Winners, encoded, body)
+			}
+		}
+	})
+}
+
+func FuzzReceiveMessage(f *testing.F) {
+	_AddVectorSeeds(f, conformance.SENDER_SERVER)
+	// A frame whose code is the terminator
+	f.Add([]byte{0, 3, MSG_TERMINATOR}, false, uint32(0))
+	f.Fuzz(func(t *testing.T, stream []byte, wide bool, capabilities uint32) {
+		conn := NewFramedConn(&testConn{reader: bytes.NewReader(stream)})
+		conn.SetFeatures(_FuzzFeatures(wide, capabilities))
+		// Every frame takes at least one byte, so this reads the whole stream
+		for i := 0; i <= len(stream); i++ {
+			if _, err := _ReceiveMessage(conn, time.Time{}); err != nil {
+				return
+			}
+		}
+		t.Fatal("more messages than bytes in the stream")
+	})
+}
+
+func FuzzReceiveResults(f *testing.F) {
+	_AddVectorSeeds(f, conformance.SENDER_SERVER)
+	f.Fuzz(func(t *testing.T, stream []byte, wide bool, capabilities uint32) {
+		features := _FuzzFeatures(wide, capabilities)
+		conn := NewFramedConn(&testConn{reader: bytes.NewReader(stream)})
+		conn.SetFeatures(features)
+		winners, _, err := ReceiveResults(conn, time.Second)
+		if err != nil {
+			return
+		}
+		for _, winner := range winners {
+			if !_FitsIn(winner, features.DNILength()) {
+				t.Fatalf("winner %v does not fit in a DNI", winner)
+			}
+		}
+	})
+}
+
+func FuzzDecodeJSONMessage(f *testing.F) {
+	vectors, err := conformance.Vectors()
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, vector := range vectors {
+		f.Add([]byte(vector.Message))
+	}
+	f.Fuzz(func(t *testing.T, line []byte) {
+		message, err := DecodeJSONMessage(line)
+		if err != nil {
+			return
+		}
+		// Decoded messages can always be sent again
+		if _, err := EncodeJSONMessage(message, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
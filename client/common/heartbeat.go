@@ -0,0 +1,122 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPeerDead Returned when the server stopped answering the heartbeat pings
+// and the connection was closed because of it
+var ErrPeerDead = errors.New("server stopped answering heartbeats")
+
+// Heartbeat Pings the server through a connection at a fixed interval while
+// it is running and closes the connection once max_missed pings in a row go
+// unanswered. Pongs are received by whoever is reading from the connection,
+// which hands them to the heartbeat, so a peer that is alive but slow to
+// produce an answer is not taken for a dead one
+type Heartbeat struct {
+	conn       *FramedConn
+	agency_id  int
+	interval   time.Duration
+	max_missed int
+
+	mutex   sync.Mutex
+	missed  int
+	dead    bool
+	started bool
+	stopped bool
+	stop    chan struct{}
+}
+
+// NewHeartbeat Binds a new heartbeat to a connection. From then on the pings
+// of the server received on the connection are answered, but no ping is sent
+// until the heartbeat is started
+func NewHeartbeat(conn *FramedConn, agency_id int, interval time.Duration, max_missed int) *Heartbeat {
+	heartbeat := &Heartbeat{
+		conn:       conn,
+		agency_id:  agency_id,
+		interval:   interval,
+		max_missed: max_missed,
+		stop:       make(chan struct{}),
+	}
+	conn.heartbeat = heartbeat
+	return heartbeat
+}
+
+// Start Starts pinging the server. Starting a running or stopped heartbeat
+// does nothing
+func (h *Heartbeat) Start() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.started || h.stopped || h.interval <= 0 {
+		return
+	}
+	h.started = true
+	go h._Run()
+}
+
+// Stop Stops pinging the server
+func (h *Heartbeat) Stop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.stopped {
+		h.stopped = true
+		close(h.stop)
+	}
+}
+
+// Dead Returns whether the server was given up on
+func (h *Heartbeat) Dead() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.dead
+}
+
+// Sends a ping every interval until stopped, and closes the connection if
+// too many of them were not answered. Closing it unblocks any read in
+// progress, which then fails with ErrPeerDead
+func (h *Heartbeat) _Run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+
+		h.mutex.Lock()
+		if h.missed >= h.max_missed {
+			h.dead = true
+			h.mutex.Unlock()
+			log.Warnf("action: heartbeat | result: fail | client_id: %v | missed_pongs: %v | error: %v",
+				h.agency_id, h.max_missed, ErrPeerDead)
+			h.conn.Close()
+			return
+		}
+		h.missed++
+		h.mutex.Unlock()
+
+		if err := SendMessage(h.conn, h.agency_id, &PingMessage{}); err != nil {
+			// The reader of the connection notices the failure as well
+			log.Debugf("action: heartbeat | result: fail | client_id: %v | error: %v", h.agency_id, err)
+			return
+		}
+	}
+}
+
+// Answers a ping of the server
+func (h *Heartbeat) _AnswerPing() error {
+	return SendMessage(h.conn, h.agency_id, &PongMessage{})
+}
+
+// Records that the server answered the pings sent so far
+func (h *Heartbeat) _ReceivePong() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.missed = 0
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Features of a session where heartbeats were agreed
+var heartbeatFeatures = Features{Version: PROTOCOL_VERSION, Capabilities: CAP_HEARTBEAT}
+
+// Returns both ends of an in-memory connection, the client one framed with
+// the heartbeat features
+func _NewHeartbeatConns(t *testing.T) (*FramedConn, *FramedConn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client_conn := NewFramedConn(client)
+	client_conn.SetFeatures(heartbeatFeatures)
+	server_conn := NewFramedConn(server)
+	server_conn.SetFeatures(heartbeatFeatures)
+	return client_conn, server_conn
+}
+
+// Reads the frames the client sends until the connection fails, answering
+// the pings with answer if it is not nil, and returns the codes read
+func _ServeHeartbeat(conn *FramedConn, answer []byte) chan []int {
+	codes := make(chan []int, 1)
+	go func() {
+		read := make([]int, 0)
+		for {
+			frame, err := conn.ReadFrame(time.Time{})
+			if err != nil {
+				codes <- read
+				return
+			}
+			read = append(read, int(frame[SIZE_FIELD_LENGTH]))
+			if answer != nil && int(frame[SIZE_FIELD_LENGTH]) == PING_CODE {
+				if err := conn.WriteFrame(answer); err != nil {
+					codes <- read
+					return
+				}
+			}
+		}
+	}()
+	return codes
+}
+
+func TestHeartbeatClosesAfterMissedPongs(t *testing.T) {
+	client_conn, server_conn := _NewHeartbeatConns(t)
+	codes := _ServeHeartbeat(server_conn, nil)
+	heartbeat := NewHeartbeat(client_conn, 1, 10*time.Millisecond, 3)
+	heartbeat.Start()
+
+	// The read only ends when the heartbeat gives up and closes the connection
+	if _, err := ReceiveMessage(client_conn); !errors.Is(err, ErrPeerDead) {
+		t.Fatalf("expected %v, got %v", ErrPeerDead, err)
+	}
+	if !heartbeat.Dead() {
+		t.Fatal("expected the server to be given up on")
+	}
+	if read := <-codes; len(read) != 3 {
+		t.Fatalf("expected 3 pings before giving up, got %v", read)
+	}
+}
+
+func TestHeartbeatKeepsAnsweredConnections(t *testing.T) {
+	client_conn, server_conn := _NewHeartbeatConns(t)
+	codes := _ServeHeartbeat(server_conn, _ServerFrames(t, heartbeatFeatures, &PongMessage{}))
+	heartbeat := NewHeartbeat(client_conn, 1, 5*time.Millisecond, 2)
+	heartbeat.Start()
+
+	// Pongs are handed to the heartbeat and never returned
+	_, err := ReceiveMessageWithin(client_conn, 100*time.Millisecond)
+	var timeout_err *ErrTimeout
+	if !errors.As(err, &timeout_err) {
+		t.Fatalf("expected a read timeout, got %v", err)
+	}
+	if heartbeat.Dead() {
+		t.Fatal("expected the server to be alive")
+	}
+	client_conn.Close()
+	if read := <-codes; len(read) <= 2 {
+		t.Fatalf("expected more pings than the ones that may be missed, got %v", read)
+	}
+}
+
+func TestHeartbeatAnswersPings(t *testing.T) {
+	client_conn, server_conn := _NewHeartbeatConns(t)
+	NewHeartbeat(client_conn, 1, 0, 2)
+	codes := _ServeHeartbeat(server_conn, nil)
+	go server_conn.WriteFrame(_ServerFrames(t, heartbeatFeatures, &PingMessage{}, &ConfirmationMessage{}))
+
+	message, err := ReceiveMessage(client_conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := message.(*ConfirmationMessage); !ok {
+		t.Fatalf("expected the ping to be skipped, got %T", message)
+	}
+	client_conn.Close()
+	if read := <-codes; len(read) != 1 || read[0] != PONG_CODE {
+		t.Fatalf("expected the ping to be answered with a pong, got %v", read)
+	}
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Encodings of the messages on the wire
+const ENCODING_BINARY = "binary" // Length-prefixed binary frames
+const ENCODING_JSONL = "jsonl"   // One JSON object per line, meant for debugging
+
+// Longest line accepted in the JSON lines encoding
+const MAX_LINE_LENGTH = 1 << 20
+
+// Types of the messages in the JSON lines encoding, by message code. Each
+// object carries its type along with the fields of the message
+var jsonMessageTypes = map[int]string{
+	CONNECT_CODE:               "connect",
+	CONNECT_ACK_CODE:           "connect_ack",
+	CHALLENGE_CODE:             "challenge",
+	AUTH_CODE:                  "auth",
+	AUTH_OK_CODE:               "auth_ok",
+	AUTH_FAILED_CODE:           "auth_failed",
+	BET_MSG_CODE:               "bets",
+	COMPRESSED_BET_MSG_CODE:    "compressed_bets",
+	QUERY_DNI_CODE:             "query_dni",
+	CANCEL_BET_CODE:            "cancel_bet",
+	AMEND_BET_CODE:             "amend_bet",
+	FINISHED_CODE:              "finished",
+	CONSULT_CODE:               "consult",
+	SUBSCRIBE_RESULTS_CODE:     "subscribe_results",
+	CONFIRMATION_CODE:          "confirmation",
+	NACK_CODE:                  "nack",
+	RESULTS_MSG_CODE:           "results",
+	RESULTS_PAGE_CODE:          "results_page",
+	DETAILED_RESULTS_CODE:      "detailed_results",
+	DETAILED_RESULTS_PAGE_CODE: "detailed_results_page",
+	QUERY_RESULT_CODE:          "query_result",
+	WAIT_MSG_CODE:              "wait",
+	ERROR_CODE:                 "error",
+	PING_CODE:                  "ping",
+	PONG_CODE:                  "pong",
+}
+
+// Builders of the messages in the JSON lines encoding, by type
+var jsonMessageBuilders = map[string]func() Message{
+	"connect":               func() Message { return &ConnectMessage{} },
+	"connect_ack":           func() Message { return &ConnectAckMessage{} },
+	"challenge":             func() Message { return &ChallengeMessage{} },
+	"auth":                  func() Message { return &AuthMessage{} },
+	"auth_ok":               func() Message { return &AuthOkMessage{} },
+	"auth_failed":           func() Message { return &AuthFailedMessage{} },
+	"bets":                  func() Message { return &BetsMessage{} },
+	"compressed_bets":       func() Message { return &CompressedBetsMessage{} },
+	"query_dni":             func() Message { return &QueryDNIMessage{} },
+	"cancel_bet":            func() Message { return &CancelBetMessage{} },
+	"amend_bet":             func() Message { return &AmendBetMessage{} },
+	"finished":              func() Message { return &FinishedMessage{} },
+	"consult":               func() Message { return &ConsultMessage{} },
+	"subscribe_results":     func() Message { return &SubscribeResultsMessage{} },
+	"confirmation":          func() Message { return &ConfirmationMessage{} },
+	"nack":                  func() Message { return &NackMessage{} },
+	"results":               func() Message { return &ResultsMessage{} },
+	"results_page":          func() Message { return &ResultsPageMessage{} },
+	"detailed_results":      func() Message { return &DetailedResultsMessage{} },
+	"detailed_results_page": func() Message { return &DetailedResultsPageMessage{} },
+	"query_result":          func() Message { return &QueryResultMessage{} },
+	"wait":                  func() Message { return &WaitMessage{} },
+	"error":                 func() Message { return &ErrorMessage{} },
+	"ping":                  func() Message { return &PingMessage{} },
+	"pong":                  func() Message { return &PongMessage{} },
+}
+
+// Representation of a bet in the JSON lines encoding, with the field names
+// the server uses
+type jsonBet struct {
+	Agency    int    `json:"agency"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Document  int    `json:"document"`
+	Birthdate string `json:"birthdate"`
+	Number    int    `json:"number"`
+}
+
+// MarshalJSON Returns a bet as a JSON object
+func (b *Bet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonBet{
+		Agency:    b.agency,
+		FirstName: b.bettor.name,
+		LastName:  b.bettor.lastname,
+		Document:  b.bettor.dni,
+		Birthdate: b.bettor.birthdate.Format("2006-01-02"),
+		Number:    b.number,
+	})
+}
+
+// UnmarshalJSON Reads a bet from a JSON object
+func (b *Bet) UnmarshalJSON(data []byte) error {
+	var bet jsonBet
+	if err := json.Unmarshal(data, &bet); err != nil {
+		return err
+	}
+	if bet.Number < 0 || bet.Number > 1<<16-1 {
+		return fmt.Errorf("invalid bet number: %v", bet.Number)
+	}
+	*b = Bet{number: bet.Number, agency: bet.Agency, bettor: *NewBettorInfo(bet.FirstName, bet.LastName, bet.Document, bet.Birthdate)}
+	return nil
+}
+
+// EncodeJSONMessage Returns a message as a JSON object on its own line. The
+// agency is added to the object unless the message already carries it or
+// agency_id is zero, as for the messages of the server
+func EncodeJSONMessage(msg Message, agency_id int) ([]byte, error) {
+	message_type, ok := jsonMessageTypes[msg.Code()]
+	if !ok {
+		return nil, &ErrUnknownMessage{Code: msg.Code()}
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	fields["type"], _ = json.Marshal(message_type)
+	if _, ok := fields["agency"]; !ok && agency_id != 0 {
+		fields["agency"], _ = json.Marshal(agency_id)
+	}
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// DecodeJSONMessage Returns the message in a line of the JSON lines encoding
+func DecodeJSONMessage(line []byte) (Message, error) {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	line = bytes.TrimSpace(line)
+	if err := json.Unmarshal(line, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid json message: %w", err)
+	}
+	newMessage, ok := jsonMessageBuilders[envelope.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown json message type: %q", envelope.Type)
+	}
+	message := newMessage()
+	if err := json.Unmarshal(line, message); err != nil {
+		return nil, &ErrMalformedMessage{Code: message.Code(), Err: err}
+	}
+
+	// Null bets are left as nil instead of being unmarshaled
+	var bets []*Bet
+	switch msg := message.(type) {
+	case *BetsMessage:
+		bets = msg.Bets
+	case *CompressedBetsMessage:
+		bets = msg.Bets
+	case *DetailedResultsMessage:
+		bets = msg.Bets
+	case *DetailedResultsPageMessage:
+		bets = msg.Bets
+	case *AmendBetMessage:
+		bets = []*Bet{msg.Bet}
+	}
+	for i, bet := range bets {
+		if bet == nil {
+			return nil, &ErrMalformedMessage{Code: message.Code(), Err: fmt.Errorf("null bet at index %v", i)}
+		}
+	}
+	return message, nil
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// Returns both ends of an in-memory connection encoded as JSON lines
+func _NewJSONConns(t *testing.T) (*FramedConn, *FramedConn) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client_conn := NewFramedConn(client)
+	client_conn.SetEncoding(ENCODING_JSONL)
+	server_conn := NewFramedConn(server)
+	server_conn.SetEncoding(ENCODING_JSONL)
+	return client_conn, server_conn
+}
+
+func TestJSONMessagesOverAConnection(t *testing.T) {
+	client_conn, server_conn := _NewJSONConns(t)
+
+	bettor := NewBettorInfo("Tiago Nicolás", "Rivera", 30904465, "1999-03-17")
+	sent := &BetsMessage{Sequence: 7, Bets: []*Bet{NewBet(7574, 1, *bettor)}}
+	go SendMessage(client_conn, 1, sent)
+	line, err := server_conn.ReadLine(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line[len(line)-1] != '\n' {
+		t.Fatalf("expected a whole line, got %q", line)
+	}
+	received, err := DecodeJSONMessage(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_AssertSameMessage(t, 1, sent, received)
+
+	// Several lines in a single write are read one at a time, and a line
+	// split across writes is read whole
+	confirmation, _ := EncodeJSONMessage(&ConfirmationMessage{Sequence: 7}, 0)
+	results, _ := EncodeJSONMessage(&ResultsMessage{Winners: []int{30904465}}, 0)
+	failure, _ := EncodeJSONMessage(&ErrorMessage{Reason: ERROR_RATE_LIMITED, Description: "retry later"}, 0)
+	go func() {
+		server_conn.WriteFrame(append(append([]byte{}, confirmation...), results[:5]...))
+		server_conn.WriteFrame(results[5:])
+		server_conn.WriteFrame(failure)
+	}()
+
+	expected := []Message{&ConfirmationMessage{Sequence: 7}, &ResultsMessage{Winners: []int{30904465}}}
+	for _, message := range expected {
+		received, err := ReceiveMessageWithin(client_conn, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_AssertSameMessage(t, 0, message, received)
+	}
+	if _, err := ReceiveMessageWithin(client_conn, time.Second); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected %v, got %v", ErrRateLimited, err)
+	}
+}
@@ -0,0 +1,906 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Message A protocol message. Each concrete message corresponds to exactly
+// one message code and knows nothing about how it is framed
+type Message interface {
+	Code() int
+}
+
+// ConnectMessage Sent by the client as the first message to identify its agency
+// and propose a protocol version and capabilities. A zero version stands for a
+// client that does not negotiate, which sends no body. From version 2 on the
+// body also carries the agency, which may not fit in the legacy header, and
+// optionally the session the sequence numbers of the client belong to
+type ConnectMessage struct {
+	Version      int    `json:"version,omitempty"`
+	Capabilities uint32 `json:"capabilities,omitempty"`
+	Agency       int    `json:"agency,omitempty"`
+	Session      uint32 `json:"session,omitempty"`
+}
+
+// ConnectAckMessage Sent by the server to accept a connection with the agreed
+// protocol version and capabilities
+type ConnectAckMessage struct {
+	Version      int    `json:"version"`
+	Capabilities uint32 `json:"capabilities"`
+}
+
+// ChallengeMessage Sent by the server after the connect acknowledgement with
+// the nonce the agency must sign, if authentication was agreed
+type ChallengeMessage struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// AuthMessage Sent by the client with the signature of the challenge nonce
+type AuthMessage struct {
+	Response []byte `json:"response"`
+}
+
+// AuthOkMessage Sent by the server once the agency is authenticated
+type AuthOkMessage struct{}
+
+// AuthFailedMessage Sent by the server to reject an agency that failed to
+// authenticate, before closing the connection
+type AuthFailedMessage struct{}
+
+// ErrorMessage Sent by the server when it rejects a message, with the reason
+// and a description meant for humans
+type ErrorMessage struct {
+	Reason      int    `json:"reason"`
+	Description string `json:"description"`
+}
+
+// BetsMessage Sent by the client with a batch of bets. The sequence number
+// is only sent if sequence numbers were agreed
+type BetsMessage struct {
+	Sequence uint32 `json:"sequence,omitempty"`
+	Bets     []*Bet `json:"bets"`
+}
+
+// CompressedBetsMessage Sent by the client with a batch of bets whose body is
+// compressed with DEFLATE, if compression was agreed. The body carries the
+// uncompressed length so the receiver can bound the memory it allocates
+type CompressedBetsMessage struct {
+	Sequence uint32 `json:"sequence,omitempty"`
+	Bets     []*Bet `json:"bets"`
+}
+
+// FinishedMessage Sent by the client once all of its bets have been sent
+type FinishedMessage struct{}
+
+// ConsultMessage Sent by the client to request the results of the lottery
+type ConsultMessage struct{}
+
+// SubscribeResultsMessage Sent by the client to request the results of the
+// lottery once it is drawn, if subscriptions were agreed
+type SubscribeResultsMessage struct{}
+
+// QueryDNIMessage Sent by the client to ask whether the bettor with the given
+// document won in its agency, if bettor queries were agreed
+type QueryDNIMessage struct {
+	DNI int `json:"dni"`
+}
+
+// CancelBetMessage Sent by the client to cancel one of its bets, identified by
+// its number and the document of the bettor, if corrections were agreed. The
+// sequence number is only sent if sequence numbers were agreed
+type CancelBetMessage struct {
+	Sequence uint32 `json:"sequence,omitempty"`
+	Number   int    `json:"number"`
+	DNI      int    `json:"dni"`
+}
+
+// AmendBetMessage Sent by the client to replace one of its bets, identified
+// as in CancelBetMessage, with another bet laid out as in a bet batch
+type AmendBetMessage struct {
+	Sequence uint32 `json:"sequence,omitempty"`
+	Number   int    `json:"number"`
+	DNI      int    `json:"dni"`
+	Bet      *Bet   `json:"bet"`
+}
+
+// ConfirmationMessage Sent by the server to confirm a bet batch, echoing its
+// sequence number if sequence numbers were agreed
+type ConfirmationMessage struct {
+	Sequence uint32 `json:"sequence,omitempty"`
+}
+
+// ResultsMessage Sent by the server with the documents of the agency winners
+type ResultsMessage struct {
+	Winners []int `json:"winners"`
+}
+
+// ResultsPageMessage Sent by the server with a page of the documents of the
+// agency winners, if paging was agreed. Pages are numbered from zero and the
+// last one is flagged, so results too large for a frame can be sent in several
+type ResultsPageMessage struct {
+	Index   uint32 `json:"index"`
+	Last    bool   `json:"last"`
+	Winners []int  `json:"winners"`
+}
+
+// DetailedResultsMessage Sent by the server with the winning bets of the
+// agency instead of their documents, if detailed results were agreed. The
+// bets are laid out as in a bet batch, without the agency
+type DetailedResultsMessage struct {
+	Bets []*Bet `json:"bets"`
+}
+
+// DetailedResultsPageMessage Sent by the server with a page of the winning
+// bets of the agency, if both detailed results and paging were agreed
+type DetailedResultsPageMessage struct {
+	Index uint32 `json:"index"`
+	Last  bool   `json:"last"`
+	Bets  []*Bet `json:"bets"`
+}
+
+// QueryResultMessage Sent by the server to answer a query with the numbers
+// of the winning bets of the bettor, which are none if the bettor did not win
+type QueryResultMessage struct {
+	DNI     int   `json:"dni"`
+	Numbers []int `json:"numbers"`
+}
+
+// WaitMessage Sent by the server when the results are not ready yet
+type WaitMessage struct{}
+
+// NackMessage Sent by the server instead of a confirmation when a bet batch
+// arrived corrupted, echoing its sequence number if sequence numbers were agreed
+type NackMessage struct {
+	Sequence uint32 `json:"sequence,omitempty"`
+}
+
+// PingMessage Sent by either side to check that the other is alive, if
+// heartbeats were agreed
+type PingMessage struct{}
+
+// PongMessage Sent by either side to answer a ping
+type PongMessage struct{}
+
+func (m *ConnectMessage) Code() int             { return CONNECT_CODE }
+func (m *ConnectAckMessage) Code() int          { return CONNECT_ACK_CODE }
+func (m *BetsMessage) Code() int                { return BET_MSG_CODE }
+func (m *CompressedBetsMessage) Code() int      { return COMPRESSED_BET_MSG_CODE }
+func (m *FinishedMessage) Code() int            { return FINISHED_CODE }
+func (m *ConsultMessage) Code() int             { return CONSULT_CODE }
+func (m *SubscribeResultsMessage) Code() int    { return SUBSCRIBE_RESULTS_CODE }
+func (m *QueryDNIMessage) Code() int            { return QUERY_DNI_CODE }
+func (m *CancelBetMessage) Code() int           { return CANCEL_BET_CODE }
+func (m *AmendBetMessage) Code() int            { return AMEND_BET_CODE }
+func (m *ConfirmationMessage) Code() int        { return CONFIRMATION_CODE }
+func (m *ResultsMessage) Code() int             { return RESULTS_MSG_CODE }
+func (m *ResultsPageMessage) Code() int         { return RESULTS_PAGE_CODE }
+func (m *DetailedResultsMessage) Code() int     { return DETAILED_RESULTS_CODE }
+func (m *DetailedResultsPageMessage) Code() int { return DETAILED_RESULTS_PAGE_CODE }
+func (m *QueryResultMessage) Code() int         { return QUERY_RESULT_CODE }
+func (m *WaitMessage) Code() int                { return WAIT_MSG_CODE }
+func (m *NackMessage) Code() int                { return NACK_CODE }
+func (m *ChallengeMessage) Code() int           { return CHALLENGE_CODE }
+func (m *AuthMessage) Code() int                { return AUTH_CODE }
+func (m *AuthOkMessage) Code() int              { return AUTH_OK_CODE }
+func (m *AuthFailedMessage) Code() int          { return AUTH_FAILED_CODE }
+func (m *ErrorMessage) Code() int               { return ERROR_CODE }
+func (m *PingMessage) Code() int                { return PING_CODE }
+func (m *PongMessage) Code() int                { return PONG_CODE }
+
+// ErrUnknownMessage Returned when a frame carries a code that has no
+// registered message
+type ErrUnknownMessage struct {
+	Code int
+}
+
+func (e *ErrUnknownMessage) Error() string {
+	return fmt.Sprintf("unknown message code: %v", e.Code)
+}
+
+// ErrMalformedMessage Returned when the body of a message cannot be decoded,
+// such as when a length it declares does not match the bytes it carries
+type ErrMalformedMessage struct {
+	Code int
+	Err  error
+}
+
+func (e *ErrMalformedMessage) Error() string {
+	return fmt.Sprintf("malformed %v message: %v", MessageCodeName(e.Code), e.Err)
+}
+
+func (e *ErrMalformedMessage) Unwrap() error {
+	return e.Err
+}
+
+// MessageEncoder Serializes the body of a message for a session with the
+// given features
+type MessageEncoder func(msg Message, features Features) ([]byte, error)
+
+// MessageDecoder Deserializes the body of a message received in a session with
+// the given features. agency_id is the agency found in the frame header, or 0
+// if the frame has none
+type MessageDecoder func(features Features, agency_id int, body []byte) (Message, error)
+
+type messageCodec struct {
+	encode MessageEncoder
+	decode MessageDecoder
+}
+
+// Registered codecs by message code
+var messageCodecs = make(map[int]messageCodec)
+
+// RegisterMessage Registers the functions used to encode and decode the
+// body of the messages with the given code. Registering a code twice
+// replaces the previous functions
+func RegisterMessage(code int, encode MessageEncoder, decode MessageDecoder) {
+	messageCodecs[code] = messageCodec{encode: encode, decode: decode}
+}
+
+func init() {
+	RegisterMessage(CONNECT_CODE, _EncodeConnectMessage, _DecodeConnectMessage)
+	RegisterMessage(CONNECT_ACK_CODE, _EncodeConnectAckMessage, _DecodeConnectAckMessage)
+	RegisterMessage(BET_MSG_CODE, _EncodeBetsMessage, _DecodeBetsMessage)
+	RegisterMessage(COMPRESSED_BET_MSG_CODE, _EncodeCompressedBetsMessage, _DecodeCompressedBetsMessage)
+	RegisterMessage(FINISHED_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &FinishedMessage{} }))
+	RegisterMessage(CONSULT_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &ConsultMessage{} }))
+	RegisterMessage(SUBSCRIBE_RESULTS_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &SubscribeResultsMessage{} }))
+	RegisterMessage(QUERY_DNI_CODE, _EncodeQueryDNIMessage, _DecodeQueryDNIMessage)
+	RegisterMessage(CANCEL_BET_CODE, _EncodeCancelBetMessage, _DecodeCancelBetMessage)
+	RegisterMessage(AMEND_BET_CODE, _EncodeAmendBetMessage, _DecodeAmendBetMessage)
+	RegisterMessage(CONFIRMATION_CODE, _EncodeConfirmationMessage, _DecodeConfirmationMessage)
+	RegisterMessage(RESULTS_MSG_CODE, _EncodeResultsMessage, _DecodeResultsMessage)
+	RegisterMessage(RESULTS_PAGE_CODE, _EncodeResultsPageMessage, _DecodeResultsPageMessage)
+	RegisterMessage(DETAILED_RESULTS_CODE, _EncodeDetailedResultsMessage, _DecodeDetailedResultsMessage)
+	RegisterMessage(DETAILED_RESULTS_PAGE_CODE, _EncodeDetailedResultsPageMessage, _DecodeDetailedResultsPageMessage)
+	RegisterMessage(QUERY_RESULT_CODE, _EncodeQueryResultMessage, _DecodeQueryResultMessage)
+	RegisterMessage(WAIT_MSG_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &WaitMessage{} }))
+	RegisterMessage(NACK_CODE, _EncodeNackMessage, _DecodeNackMessage)
+	RegisterMessage(CHALLENGE_CODE, _EncodeChallengeMessage, _DecodeChallengeMessage)
+	RegisterMessage(AUTH_CODE, _EncodeAuthMessage, _DecodeAuthMessage)
+	RegisterMessage(AUTH_OK_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &AuthOkMessage{} }))
+	RegisterMessage(AUTH_FAILED_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &AuthFailedMessage{} }))
+	RegisterMessage(ERROR_CODE, _EncodeErrorMessage, _DecodeErrorMessage)
+	RegisterMessage(PING_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &PingMessage{} }))
+	RegisterMessage(PONG_CODE, _EncodeEmptyBody, _DecodeEmptyBody(func() Message { return &PongMessage{} }))
+}
+
+// EncodeMessage Returns the serialized body of a message
+func EncodeMessage(msg Message, features Features) ([]byte, error) {
+	codec, ok := messageCodecs[msg.Code()]
+	if !ok {
+		return nil, &ErrUnknownMessage{Code: msg.Code()}
+	}
+	return codec.encode(msg, features)
+}
+
+// DecodeMessage Returns the message with the given code and body. Bodies
+// that cannot be decoded are reported as ErrMalformedMessage
+func DecodeMessage(code int, features Features, agency_id int, body []byte) (Message, error) {
+	codec, ok := messageCodecs[code]
+	if !ok {
+		return nil, &ErrUnknownMessage{Code: code}
+	}
+	message, err := codec.decode(features, agency_id, body)
+	if err != nil {
+		return nil, &ErrMalformedMessage{Code: code, Err: err}
+	}
+	return message, nil
+}
+
+// SendMessage Encodes a message in the encoding of the connection and sends
+// it to the server on behalf of an agency
+func SendMessage(conn *FramedConn, agency_id int, msg Message) error {
+	if conn.Encoding() == ENCODING_JSONL {
+		line, err := EncodeJSONMessage(msg, agency_id)
+		if err != nil {
+			return err
+		}
+		return conn.WriteFrame(line)
+	}
+
+	body, err := EncodeMessage(msg, conn.Features())
+	if err != nil {
+		return err
+	}
+	return _SendAux(body, conn, agency_id, msg.Code())
+}
+
+// ReceiveMessage Reads the next message sent by the server within the read
+// timeout of the connection. The server may reject the agency or report an
+// error at any point, so an AuthFailedMessage is returned as
+// ErrAuthenticationFailed and an ErrorMessage as ErrServer. If a heartbeat is
+// bound to the connection, pings and pongs are handled by it and skipped, and
+// ErrPeerDead is returned once it gives up on the server
+func ReceiveMessage(conn *FramedConn) (Message, error) {
+	return ReceiveMessageWithin(conn, conn.ReadTimeout())
+}
+
+// ReceiveMessageWithin Reads the next message sent by the server like
+// ReceiveMessage, but within the given timeout. A timeout is returned as
+// ErrTimeout, or as ErrLoopLapsed if the overall deadline passed
+func ReceiveMessageWithin(conn *FramedConn, timeout time.Duration) (Message, error) {
+	deadline := _Deadline(timeout, conn.Deadline())
+	for {
+		message, err := _ReceiveMessage(conn, deadline)
+		heartbeat := conn.Heartbeat()
+		if err != nil && heartbeat != nil && heartbeat.Dead() {
+			return nil, ErrPeerDead
+		}
+		err = _TimeoutError("read", timeout, deadline, conn.Deadline(), err)
+		if heartbeat == nil {
+			return message, err
+		}
+
+		switch message.(type) {
+		case *PingMessage:
+			err = heartbeat._AnswerPing()
+		case *PongMessage:
+			heartbeat._ReceivePong()
+		default:
+			return message, err
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Reads and decodes the next message sent by the server before deadline
+func _ReceiveMessage(conn *FramedConn, deadline time.Time) (Message, error) {
+	var message Message
+	var err error
+	if conn.Encoding() == ENCODING_JSONL {
+		message, err = _ReceiveJSONMessage(conn, deadline)
+	} else {
+		message, err = _ReceiveBinaryMessage(conn, deadline)
+	}
+	switch msg := message.(type) {
+	case *AuthFailedMessage:
+		return nil, ErrAuthenticationFailed
+	case *ErrorMessage:
+		return nil, &ErrServer{Reason: msg.Reason, Description: msg.Description}
+	}
+	return message, err
+}
+
+// Reads and decodes the next frame sent by the server before deadline
+func _ReceiveBinaryMessage(conn *FramedConn, deadline time.Time) (Message, error) {
+	frame, code, err := _ReadMessage(conn, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	// Server frames have no agency field and end with a terminator, which
+	// is never taken for the code of a frame that has no room for both
+	if len(frame) > SIZE_FIELD_LENGTH+MSG_CODE_LENGTH && frame[len(frame)-1] == MSG_TERMINATOR {
+		frame = frame[:len(frame)-1]
+	}
+	if conn.Features().Has(CAP_CHECKSUM) {
+		frame, err = _VerifyChecksum(frame)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return DecodeMessage(code, conn.Features(), 0, frame[SIZE_FIELD_LENGTH+MSG_CODE_LENGTH:])
+}
+
+// Reads and decodes the next line sent by the server before deadline
+func _ReceiveJSONMessage(conn *FramedConn, deadline time.Time) (Message, error) {
+	line, err := conn.ReadLine(deadline)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeJSONMessage(line)
+}
+
+// Encoder for messages without body
+func _EncodeEmptyBody(msg Message, features Features) ([]byte, error) {
+	return []byte{}, nil
+}
+
+// Returns a decoder for messages without body that builds them with newMessage
+func _DecodeEmptyBody(newMessage func() Message) MessageDecoder {
+	return func(features Features, agency_id int, body []byte) (Message, error) {
+		if len(body) != 0 {
+			return nil, fmt.Errorf("unexpected body of %v bytes", len(body))
+		}
+		return newMessage(), nil
+	}
+}
+
+// Serializes a protocol version and a capabilities bitmask
+func _EncodeVersion(version int, capabilities uint32) []byte {
+	return []byte{byte(version), byte(capabilities >> 24), byte(capabilities >> 16), byte(capabilities >> 8), byte(capabilities)}
+}
+
+// Deserializes a protocol version and a capabilities bitmask
+func _DecodeVersion(body []byte) (int, uint32, error) {
+	if len(body) != VERSION_LENGTH_IN_BYTES+CAPABILITIES_LENGTH_IN_BYTES {
+		return 0, 0, fmt.Errorf("invalid version body of %v bytes", len(body))
+	}
+	capabilities := uint32(body[1])<<24 | uint32(body[2])<<16 | uint32(body[3])<<8 | uint32(body[4])
+	return int(body[0]), capabilities, nil
+}
+
+func _EncodeConnectMessage(msg Message, features Features) ([]byte, error) {
+	connect := msg.(*ConnectMessage)
+	if connect.Version == 0 {
+		return []byte{}, nil
+	}
+	body := _EncodeVersion(connect.Version, connect.Capabilities)
+	if connect.Version >= WIDE_FIELDS_PROTOCOL_VERSION {
+		agency := make([]byte, AGENCY_LENGTH_IN_BYTES_V2)
+		if !_PutField(agency, connect.Agency) {
+			return nil, &ErrFieldOverflow{Field: "agency", Value: connect.Agency, Length: AGENCY_LENGTH_IN_BYTES_V2}
+		}
+		body = append(body, agency...)
+		if connect.Session != 0 {
+			session := make([]byte, SESSION_LENGTH_IN_BYTES)
+			_PutField(session, int(connect.Session))
+			body = append(body, session...)
+		}
+	}
+	return body, nil
+}
+
+func _DecodeConnectMessage(features Features, agency_id int, body []byte) (Message, error) {
+	if len(body) == 0 {
+		return &ConnectMessage{Agency: agency_id}, nil
+	}
+	version_length := VERSION_LENGTH_IN_BYTES + CAPABILITIES_LENGTH_IN_BYTES
+	var session uint32
+	if len(body) == version_length+AGENCY_LENGTH_IN_BYTES_V2+SESSION_LENGTH_IN_BYTES {
+		session = uint32(_GetField(body[version_length+AGENCY_LENGTH_IN_BYTES_V2:]))
+		body = body[:version_length+AGENCY_LENGTH_IN_BYTES_V2]
+	}
+	if len(body) == version_length+AGENCY_LENGTH_IN_BYTES_V2 {
+		agency_id = _GetField(body[version_length:])
+		body = body[:version_length]
+	}
+	version, capabilities, err := _DecodeVersion(body)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectMessage{Version: version, Capabilities: capabilities, Agency: agency_id, Session: session}, nil
+}
+
+func _EncodeConnectAckMessage(msg Message, features Features) ([]byte, error) {
+	ack := msg.(*ConnectAckMessage)
+	return _EncodeVersion(ack.Version, ack.Capabilities), nil
+}
+
+func _DecodeConnectAckMessage(features Features, agency_id int, body []byte) (Message, error) {
+	version, capabilities, err := _DecodeVersion(body)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectAckMessage{Version: version, Capabilities: capabilities}, nil
+}
+
+// Serializes a sequence number if sequence numbers were agreed
+func _EncodeSequence(sequence uint32, features Features) []byte {
+	if !features.Has(CAP_SEQUENCE_NUMBERS) {
+		return []byte{}
+	}
+	buffer := make([]byte, SEQUENCE_LENGTH)
+	_PutField(buffer, int(sequence))
+	return buffer
+}
+
+// Deserializes the sequence number at the start of a body if sequence
+// numbers were agreed, and returns it along with the rest of the body
+func _DecodeSequence(body []byte, features Features) (uint32, []byte, error) {
+	if !features.Has(CAP_SEQUENCE_NUMBERS) {
+		return 0, body, nil
+	}
+	if len(body) < SEQUENCE_LENGTH {
+		return 0, nil, fmt.Errorf("body of %v bytes too short for a sequence number", len(body))
+	}
+	return uint32(_GetField(body[:SEQUENCE_LENGTH])), body[SEQUENCE_LENGTH:], nil
+}
+
+func _EncodeBetsMessage(msg Message, features Features) ([]byte, error) {
+	bets_message := msg.(*BetsMessage)
+	buffer := _EncodeSequence(bets_message.Sequence, features)
+	_, err := _SerializeBets(bets_message.Bets, &buffer, features)
+	return buffer, err
+}
+
+func _DecodeBetsMessage(features Features, agency_id int, body []byte) (Message, error) {
+	sequence, body, err := _DecodeSequence(body, features)
+	if err != nil {
+		return nil, err
+	}
+	bets, err := _DeserializeBets(body, agency_id, features)
+	if err != nil {
+		return nil, err
+	}
+	return &BetsMessage{Sequence: sequence, Bets: bets}, nil
+}
+
+func _EncodeCompressedBetsMessage(msg Message, features Features) ([]byte, error) {
+	bets_message := msg.(*CompressedBetsMessage)
+	body := make([]byte, 0)
+	_, err := _SerializeBets(bets_message.Bets, &body, features)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MAX_UNCOMPRESSED_LENGTH {
+		return nil, &ErrFieldOverflow{Field: "uncompressed length", Value: len(body), Length: UNCOMPRESSED_LENGTH_IN_BYTES}
+	}
+
+	buffer := bytes.NewBuffer(_EncodeSequence(bets_message.Sequence, features))
+	length := make([]byte, UNCOMPRESSED_LENGTH_IN_BYTES)
+	_PutField(length, len(body))
+	buffer.Write(length)
+
+	writer, err := flate.NewWriter(buffer, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func _DecodeCompressedBetsMessage(features Features, agency_id int, body []byte) (Message, error) {
+	sequence, body, err := _DecodeSequence(body, features)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < UNCOMPRESSED_LENGTH_IN_BYTES {
+		return nil, fmt.Errorf("body of %v bytes too short for an uncompressed length", len(body))
+	}
+	length := _GetField(body[:UNCOMPRESSED_LENGTH_IN_BYTES])
+	if length > MAX_UNCOMPRESSED_LENGTH {
+		return nil, fmt.Errorf("uncompressed length of %v bytes exceeds the maximum of %v", length, MAX_UNCOMPRESSED_LENGTH)
+	}
+
+	// Read one byte past the announced length to detect longer bodies
+	reader := flate.NewReader(bytes.NewReader(body[UNCOMPRESSED_LENGTH_IN_BYTES:]))
+	defer reader.Close()
+	uncompressed, err := io.ReadAll(io.LimitReader(reader, int64(length)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(uncompressed) != length {
+		return nil, fmt.Errorf("uncompressed body of %v bytes, expected %v", len(uncompressed), length)
+	}
+
+	bets, err := _DeserializeBets(uncompressed, agency_id, features)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedBetsMessage{Sequence: sequence, Bets: bets}, nil
+}
+
+func _EncodeConfirmationMessage(msg Message, features Features) ([]byte, error) {
+	return _EncodeSequence(msg.(*ConfirmationMessage).Sequence, features), nil
+}
+
+func _DecodeConfirmationMessage(features Features, agency_id int, body []byte) (Message, error) {
+	sequence, body, err := _DecodeSequence(body, features)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("unexpected body of %v bytes", len(body))
+	}
+	return &ConfirmationMessage{Sequence: sequence}, nil
+}
+
+func _EncodeNackMessage(msg Message, features Features) ([]byte, error) {
+	return _EncodeSequence(msg.(*NackMessage).Sequence, features), nil
+}
+
+func _DecodeNackMessage(features Features, agency_id int, body []byte) (Message, error) {
+	sequence, body, err := _DecodeSequence(body, features)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("unexpected body of %v bytes", len(body))
+	}
+	return &NackMessage{Sequence: sequence}, nil
+}
+
+func _EncodeResultsMessage(msg Message, features Features) ([]byte, error) {
+	return _EncodeWinners(msg.(*ResultsMessage).Winners, features)
+}
+
+func _DecodeResultsMessage(features Features, agency_id int, body []byte) (Message, error) {
+	winners, err := _DecodeWinners(body, features)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultsMessage{Winners: winners}, nil
+}
+
+func _EncodeResultsPageMessage(msg Message, features Features) ([]byte, error) {
+	page := msg.(*ResultsPageMessage)
+	winners, err := _EncodeWinners(page.Winners, features)
+	if err != nil {
+		return nil, err
+	}
+	return append(_EncodePageHeader(page.Index, page.Last), winners...), nil
+}
+
+func _DecodeResultsPageMessage(features Features, agency_id int, body []byte) (Message, error) {
+	index, last, body, err := _DecodePageHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	winners, err := _DecodeWinners(body, features)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultsPageMessage{Index: index, Last: last, Winners: winners}, nil
+}
+
+func _EncodeDetailedResultsMessage(msg Message, features Features) ([]byte, error) {
+	buffer := make([]byte, 0)
+	_, err := _SerializeBets(msg.(*DetailedResultsMessage).Bets, &buffer, features)
+	return buffer, err
+}
+
+func _DecodeDetailedResultsMessage(features Features, agency_id int, body []byte) (Message, error) {
+	bets, err := _DeserializeBets(body, agency_id, features)
+	if err != nil {
+		return nil, err
+	}
+	return &DetailedResultsMessage{Bets: bets}, nil
+}
+
+func _EncodeDetailedResultsPageMessage(msg Message, features Features) ([]byte, error) {
+	page := msg.(*DetailedResultsPageMessage)
+	buffer := _EncodePageHeader(page.Index, page.Last)
+	_, err := _SerializeBets(page.Bets, &buffer, features)
+	return buffer, err
+}
+
+func _DecodeDetailedResultsPageMessage(features Features, agency_id int, body []byte) (Message, error) {
+	index, last, body, err := _DecodePageHeader(body)
+	if err != nil {
+		return nil, err
+	}
+	bets, err := _DeserializeBets(body, agency_id, features)
+	if err != nil {
+		return nil, err
+	}
+	return &DetailedResultsPageMessage{Index: index, Last: last, Bets: bets}, nil
+}
+
+func _EncodeQueryDNIMessage(msg Message, features Features) ([]byte, error) {
+	dni := msg.(*QueryDNIMessage).DNI
+	buffer := make([]byte, features.DNILength())
+	if !_PutField(buffer, dni) {
+		return nil, &ErrFieldOverflow{Field: "dni", Value: dni, Length: features.DNILength()}
+	}
+	return buffer, nil
+}
+
+func _DecodeQueryDNIMessage(features Features, agency_id int, body []byte) (Message, error) {
+	if len(body) != features.DNILength() {
+		return nil, fmt.Errorf("dni of %v bytes, expected %v", len(body), features.DNILength())
+	}
+	dni, err := _GetDNI(body)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryDNIMessage{DNI: dni}, nil
+}
+
+// Serializes the number and the bettor document that identify a bet
+func _EncodeBetKey(number, dni int, features Features) ([]byte, error) {
+	buffer := make([]byte, NUMBER_LENGTH_IN_BYTES+features.DNILength())
+	if !_PutField(buffer[:NUMBER_LENGTH_IN_BYTES], number) {
+		return nil, &ErrFieldOverflow{Field: "number", Value: number, Length: NUMBER_LENGTH_IN_BYTES}
+	}
+	if !_PutField(buffer[NUMBER_LENGTH_IN_BYTES:], dni) {
+		return nil, &ErrFieldOverflow{Field: "dni", Value: dni, Length: features.DNILength()}
+	}
+	return buffer, nil
+}
+
+// Deserializes the number and the bettor document that identify a bet at the
+// start of a body, and returns them along with the rest of the body
+func _DecodeBetKey(body []byte, features Features) (int, int, []byte, error) {
+	key_length := NUMBER_LENGTH_IN_BYTES + features.DNILength()
+	if len(body) < key_length {
+		return 0, 0, nil, fmt.Errorf("body of %v bytes too short for a number and a dni", len(body))
+	}
+	dni, err := _GetDNI(body[NUMBER_LENGTH_IN_BYTES:key_length])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return _GetField(body[:NUMBER_LENGTH_IN_BYTES]), dni, body[key_length:], nil
+}
+
+func _EncodeCancelBetMessage(msg Message, features Features) ([]byte, error) {
+	cancel := msg.(*CancelBetMessage)
+	key, err := _EncodeBetKey(cancel.Number, cancel.DNI, features)
+	if err != nil {
+		return nil, err
+	}
+	return append(_EncodeSequence(cancel.Sequence, features), key...), nil
+}
+
+func _DecodeCancelBetMessage(features Features, agency_id int, body []byte) (Message, error) {
+	sequence, body, err := _DecodeSequence(body, features)
+	if err != nil {
+		return nil, err
+	}
+	number, dni, body, err := _DecodeBetKey(body, features)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("%v bytes left after the bet to cancel", len(body))
+	}
+	return &CancelBetMessage{Sequence: sequence, Number: number, DNI: dni}, nil
+}
+
+func _EncodeAmendBetMessage(msg Message, features Features) ([]byte, error) {
+	amend := msg.(*AmendBetMessage)
+	if amend.Bet == nil {
+		return nil, fmt.Errorf("no bet to replace the amended one with")
+	}
+	key, err := _EncodeBetKey(amend.Number, amend.DNI, features)
+	if err != nil {
+		return nil, err
+	}
+	bet, err := _SerializeBet(amend.Bet, features)
+	if err != nil {
+		return nil, err
+	}
+	buffer := append(_EncodeSequence(amend.Sequence, features), key...)
+	return append(buffer, bet...), nil
+}
+
+func _DecodeAmendBetMessage(features Features, agency_id int, body []byte) (Message, error) {
+	sequence, body, err := _DecodeSequence(body, features)
+	if err != nil {
+		return nil, err
+	}
+	number, dni, body, err := _DecodeBetKey(body, features)
+	if err != nil {
+		return nil, err
+	}
+	bets, err := _DeserializeBets(body, agency_id, features)
+	if err != nil {
+		return nil, err
+	}
+	if len(bets) != 1 {
+		return nil, fmt.Errorf("%v bets to replace the amended one with, expected 1", len(bets))
+	}
+	return &AmendBetMessage{Sequence: sequence, Number: number, DNI: dni, Bet: bets[0]}, nil
+}
+
+func _EncodeQueryResultMessage(msg Message, features Features) ([]byte, error) {
+	result := msg.(*QueryResultMessage)
+	buffer := make([]byte, features.DNILength()+len(result.Numbers)*NUMBER_LENGTH_IN_BYTES)
+	if !_PutField(buffer[:features.DNILength()], result.DNI) {
+		return nil, &ErrFieldOverflow{Field: "dni", Value: result.DNI, Length: features.DNILength()}
+	}
+	for i, number := range result.Numbers {
+		offset := features.DNILength() + i*NUMBER_LENGTH_IN_BYTES
+		if !_PutField(buffer[offset:offset+NUMBER_LENGTH_IN_BYTES], number) {
+			return nil, &ErrFieldOverflow{Field: "number", Value: number, Length: NUMBER_LENGTH_IN_BYTES}
+		}
+	}
+	return buffer, nil
+}
+
+func _DecodeQueryResultMessage(features Features, agency_id int, body []byte) (Message, error) {
+	if len(body) < features.DNILength() || (len(body)-features.DNILength())%NUMBER_LENGTH_IN_BYTES != 0 {
+		return nil, fmt.Errorf("body of %v bytes is not a dni followed by numbers", len(body))
+	}
+	dni, err := _GetDNI(body[:features.DNILength()])
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, 0, (len(body)-features.DNILength())/NUMBER_LENGTH_IN_BYTES)
+	for i := features.DNILength(); i < len(body); i += NUMBER_LENGTH_IN_BYTES {
+		numbers = append(numbers, _GetField(body[i:i+NUMBER_LENGTH_IN_BYTES]))
+	}
+	return &QueryResultMessage{DNI: dni, Numbers: numbers}, nil
+}
+
+// Serializes the index and the flags of a page of the results
+func _EncodePageHeader(index uint32, last bool) []byte {
+	buffer := make([]byte, PAGE_INDEX_LENGTH_IN_BYTES+PAGE_FLAGS_LENGTH_IN_BYTES)
+	_PutField(buffer[:PAGE_INDEX_LENGTH_IN_BYTES], int(index))
+	if last {
+		buffer[PAGE_INDEX_LENGTH_IN_BYTES] = PAGE_FLAG_LAST
+	}
+	return buffer
+}
+
+// Deserializes the header at the start of a page of the results and returns
+// its index, whether it is the last page and the rest of the body
+func _DecodePageHeader(body []byte) (uint32, bool, []byte, error) {
+	if len(body) < PAGE_INDEX_LENGTH_IN_BYTES+PAGE_FLAGS_LENGTH_IN_BYTES {
+		return 0, false, nil, fmt.Errorf("body of %v bytes too short for a page header", len(body))
+	}
+	index := uint32(_GetField(body[:PAGE_INDEX_LENGTH_IN_BYTES]))
+	flags := body[PAGE_INDEX_LENGTH_IN_BYTES]
+	if flags&^PAGE_FLAG_LAST != 0 {
+		return 0, false, nil, fmt.Errorf("unknown page flags: %08b", flags)
+	}
+	return index, flags&PAGE_FLAG_LAST != 0, body[PAGE_INDEX_LENGTH_IN_BYTES+PAGE_FLAGS_LENGTH_IN_BYTES:], nil
+}
+
+// Serializes the documents of the winners in their fixed width encoding
+func _EncodeWinners(winners []int, features Features) ([]byte, error) {
+	buffer := make([]byte, len(winners)*features.DNILength())
+	for i, winner := range winners {
+		if !_PutField(buffer[i*features.DNILength():(i+1)*features.DNILength()], winner) {
+			return nil, &ErrFieldOverflow{Field: "dni", Value: winner, Length: features.DNILength()}
+		}
+	}
+	return buffer, nil
+}
+
+// Deserializes the documents of the winners from their fixed width encoding
+func _DecodeWinners(body []byte, features Features) ([]int, error) {
+	if len(body)%features.DNILength() != 0 {
+		return nil, fmt.Errorf("body of %v bytes is not a multiple of the %v bytes of a DNI", len(body), features.DNILength())
+	}
+	winners := make([]int, 0, len(body)/features.DNILength())
+	for i := 0; i < len(body); i += features.DNILength() {
+		dni, err := _GetDNI(body[i : i+features.DNILength()])
+		if err != nil {
+			return nil, fmt.Errorf("winner at offset %v: %w", i, err)
+		}
+		winners = append(winners, dni)
+	}
+	return winners, nil
+}
+
+func _EncodeChallengeMessage(msg Message, features Features) ([]byte, error) {
+	return msg.(*ChallengeMessage).Nonce, nil
+}
+
+func _DecodeChallengeMessage(features Features, agency_id int, body []byte) (Message, error) {
+	if len(body) != NONCE_LENGTH {
+		return nil, fmt.Errorf("nonce of %v bytes, expected %v", len(body), NONCE_LENGTH)
+	}
+	return &ChallengeMessage{Nonce: body}, nil
+}
+
+func _EncodeAuthMessage(msg Message, features Features) ([]byte, error) {
+	return msg.(*AuthMessage).Response, nil
+}
+
+func _DecodeAuthMessage(features Features, agency_id int, body []byte) (Message, error) {
+	if len(body) != AUTH_RESPONSE_LENGTH {
+		return nil, fmt.Errorf("authentication response of %v bytes, expected %v", len(body), AUTH_RESPONSE_LENGTH)
+	}
+	return &AuthMessage{Response: body}, nil
+}
+
+func _EncodeErrorMessage(msg Message, features Features) ([]byte, error) {
+	error_message := msg.(*ErrorMessage)
+	buffer := make([]byte, ERROR_REASON_LENGTH_IN_BYTES)
+	if !_PutField(buffer, error_message.Reason) {
+		return nil, &ErrFieldOverflow{Field: "reason", Value: error_message.Reason, Length: ERROR_REASON_LENGTH_IN_BYTES}
+	}
+	return append(buffer, error_message.Description...), nil
+}
+
+func _DecodeErrorMessage(features Features, agency_id int, body []byte) (Message, error) {
+	if len(body) < ERROR_REASON_LENGTH_IN_BYTES {
+		return nil, fmt.Errorf("body of %v bytes too short for an error reason", len(body))
+	}
+	reason := _GetField(body[:ERROR_REASON_LENGTH_IN_BYTES])
+	description := string(body[ERROR_REASON_LENGTH_IN_BYTES:])
+	return &ErrorMessage{Reason: reason, Description: description}, nil
+}
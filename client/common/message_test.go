@@ -0,0 +1,59 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnknownMessageCodes(t *testing.T) {
+	features := Features{Version: PROTOCOL_VERSION}
+	for _, code := range []int{0, 1, 99, 255} {
+		var unknown_err *ErrUnknownMessage
+		if _, err := DecodeMessage(code, features, 1, []byte{}); !errors.As(err, &unknown_err) || unknown_err.Code != code {
+			t.Fatalf("expected code %v to be unknown when decoding, got %v", code, err)
+		}
+	}
+
+	var unknown_err *ErrUnknownMessage
+	if _, err := EncodeMessage(&testMessage{}, features); !errors.As(err, &unknown_err) {
+		t.Fatalf("expected an unregistered message to be unknown when encoding, got %v", err)
+	}
+}
+
+// A message whose code is not registered
+type testMessage struct{}
+
+func (m *testMessage) Code() int { return 99 }
+
+func TestTruncatedMessageBodies(t *testing.T) {
+	legacy := LegacyFeatures()
+	sequenced := Features{Version: PROTOCOL_VERSION, Capabilities: CAP_SEQUENCE_NUMBERS}
+	paged := Features{Version: PROTOCOL_VERSION, Capabilities: CAP_PAGING}
+	tests := []struct {
+		name     string
+		code     int
+		features Features
+		body     []byte
+	}{
+		{name: "connect", code: CONNECT_CODE, features: legacy, body: []byte{2, 0, 0, 0}},
+		{name: "connect ack", code: CONNECT_ACK_CODE, features: legacy, body: []byte{2, 0, 0}},
+		{name: "confirmation sequence", code: CONFIRMATION_CODE, features: sequenced, body: []byte{0, 0, 7}},
+		{name: "nack sequence", code: NACK_CODE, features: sequenced, body: []byte{0, 0, 3}},
+		{name: "bets", code: BET_MSG_CODE, features: legacy, body: []byte{0x1d, 0x96, 0x01, 0xd7, 0x90}},
+		{name: "results dni", code: RESULTS_MSG_CODE, features: legacy, body: []byte{0x01, 0xd7, 0x90}},
+		{name: "results page header", code: RESULTS_PAGE_CODE, features: paged, body: []byte{0, 0, 0, 1}},
+		{name: "query dni", code: QUERY_DNI_CODE, features: legacy, body: []byte{0x01, 0xd7, 0x90}},
+		{name: "cancel bet", code: CANCEL_BET_CODE, features: legacy, body: []byte{0x1d, 0x96, 0x01}},
+		{name: "wait with body", code: WAIT_MSG_CODE, features: legacy, body: []byte{0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := DecodeMessage(test.code, test.features, 1, test.body)
+			var malformed_err *ErrMalformedMessage
+			if !errors.As(err, &malformed_err) || malformed_err.Code != test.code {
+				t.Fatalf("expected a malformed %v message, got %#v and %v", MessageCodeName(test.code), message, err)
+			}
+		})
+	}
+}
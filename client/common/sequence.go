@@ -0,0 +1,81 @@
+package common
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+// BatchSequence Numbers the bet batches sent by an agency and keeps track of
+// the ones confirmed by the server. Numbers start at 1 and are never reused,
+// so a batch sent again keeps its number and the server can tell it was
+// already applied. Numbers belong to a random session, so a sequence of a new
+// client process starting at 1 again is not taken for a retransmission
+type BatchSequence struct {
+	mutex          sync.Mutex
+	session        uint32
+	next           uint32
+	last_confirmed uint32
+	confirmed      map[uint32]bool
+}
+
+// NewBatchSequence Initializes a new BatchSequence
+func NewBatchSequence() *BatchSequence {
+	return &BatchSequence{
+		session:        _NewSession(),
+		next:           1,
+		last_confirmed: 0,
+		confirmed:      make(map[uint32]bool),
+	}
+}
+
+// Returns a random session number. Zero stands for no session, so it is never
+// returned
+func _NewSession() uint32 {
+	buffer := make([]byte, SESSION_LENGTH_IN_BYTES)
+	for {
+		if _, err := rand.Read(buffer); err != nil {
+			return uint32(time.Now().UnixNano()) | 1
+		}
+		if session := uint32(_GetField(buffer)); session != 0 {
+			return session
+		}
+	}
+}
+
+// Session Returns the session the numbers belong to
+func (s *BatchSequence) Session() uint32 {
+	return s.session
+}
+
+// Next Returns the number of the next batch
+func (s *BatchSequence) Next() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	number := s.next
+	s.next++
+	return number
+}
+
+// Confirm Records that the server confirmed the batch with the given number
+func (s *BatchSequence) Confirm(number uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if number <= s.last_confirmed {
+		return
+	}
+	s.confirmed[number] = true
+	for s.confirmed[s.last_confirmed+1] {
+		delete(s.confirmed, s.last_confirmed+1)
+		s.last_confirmed++
+	}
+}
+
+// LastConfirmed Returns the highest number such that it and every batch
+// before it were confirmed by the server, or 0 if the first batch was not
+// confirmed yet
+func (s *BatchSequence) LastConfirmed() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last_confirmed
+}
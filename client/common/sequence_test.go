@@ -0,0 +1,74 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestBatchSequenceNext(t *testing.T) {
+	sequence := NewBatchSequence()
+	for expected := uint32(1); expected <= 3; expected++ {
+		if number := sequence.Next(); number != expected {
+			t.Fatalf("expected batch number %v, got %v", expected, number)
+		}
+	}
+	if sequence.LastConfirmed() != 0 {
+		t.Fatalf("expected no batch confirmed, got %v", sequence.LastConfirmed())
+	}
+}
+
+func TestBatchSequenceConfirm(t *testing.T) {
+	sequence := NewBatchSequence()
+	for i := 0; i < 5; i++ {
+		sequence.Next()
+	}
+
+	steps := []struct {
+		confirmed uint32
+		expected  uint32
+	}{
+		// A gap keeps the later batches from counting as confirmed
+		{confirmed: 2, expected: 0},
+		{confirmed: 4, expected: 0},
+		{confirmed: 1, expected: 2},
+		// Confirming a batch again changes nothing
+		{confirmed: 1, expected: 2},
+		{confirmed: 3, expected: 4},
+		{confirmed: 5, expected: 5},
+	}
+	for _, step := range steps {
+		sequence.Confirm(step.confirmed)
+		if sequence.LastConfirmed() != step.expected {
+			t.Fatalf("expected %v confirmed after confirming %v, got %v", step.expected, step.confirmed, sequence.LastConfirmed())
+		}
+	}
+	if len(sequence.confirmed) != 0 {
+		t.Fatalf("expected no confirmation kept past the last confirmed batch, got %v", sequence.confirmed)
+	}
+	if number := sequence.Next(); number != 6 {
+		t.Fatalf("expected numbers not to be reused, got %v", number)
+	}
+}
+
+func TestBatchSequenceSession(t *testing.T) {
+	first, second := NewBatchSequence(), NewBatchSequence()
+	if first.Session() == 0 || second.Session() == 0 {
+		t.Fatalf("expected sessions, got %v and %v", first.Session(), second.Session())
+	}
+	// A restarted client numbers its batches from 1 again in another session
+	if first.Session() == second.Session() {
+		t.Fatalf("expected different sessions, got %v twice", first.Session())
+	}
+
+	conn := &testConn{}
+	if err := SendConnectMessage(NewFramedConn(conn), 1, CAP_SEQUENCE_NUMBERS, first.Session()); err != nil {
+		t.Fatal(err)
+	}
+	frame := conn.written.Bytes()
+	message, err := DecodeMessage(CONNECT_CODE, LegacyFeatures(), 1, frame[LegacyFeatures().HeaderLength():])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connect := message.(*ConnectMessage); connect.Session != first.Session() {
+		t.Fatalf("expected session %v in the connect message, got %v", first.Session(), connect.Session)
+	}
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// TimeoutsConfig Time each operation on the connection with the server may
+// take. Zero means the operation is only bounded by the overall deadline of
+// the client
+type TimeoutsConfig struct {
+	// Establishing the connection, including the TLS handshake
+	Connect time.Duration
+	// Writing a frame
+	Write time.Duration
+	// Reading a frame the server sends right away, such as a confirmation
+	Read time.Duration
+	// Waiting for the results, which are only sent once every agency is done
+	Results time.Duration
+}
+
+// ErrLoopLapsed Returned when an operation is interrupted because the overall
+// deadline of the client passed
+var ErrLoopLapsed = errors.New("loop lapse reached")
+
+// ErrTimeout Returned when an operation on the connection does not complete
+// within its timeout. It wraps the timeout of the connection, so it is handled
+// as a lost connection
+type ErrTimeout struct {
+	Operation string
+	Timeout   time.Duration
+	Err       error
+}
+
+func (e *ErrTimeout) Error() string {
+	return fmt.Sprintf("%v timed out after %v", e.Operation, e.Timeout)
+}
+
+func (e *ErrTimeout) Unwrap() error {
+	return e.Err
+}
+
+// IsTimeout Returns whether err is a timeout or the overall deadline of the
+// client passing, as opposed to a failure of the connection or the protocol
+func IsTimeout(err error) bool {
+	var timeout_err *ErrTimeout
+	return errors.As(err, &timeout_err) || errors.Is(err, ErrLoopLapsed)
+}
+
+// Returns the earliest of the time timeout from now and the overall
+// deadline. A zero timeout or deadline stands for none, and if both are
+// zero so is the result
+func _Deadline(timeout time.Duration, overall time.Time) time.Time {
+	if timeout <= 0 {
+		return overall
+	}
+	deadline := time.Now().Add(timeout)
+	if !overall.IsZero() && overall.Before(deadline) {
+		return overall
+	}
+	return deadline
+}
+
+// Returns err as ErrLoopLapsed if it is a timeout caused by the overall
+// deadline, or as an ErrTimeout of the given operation if it is any other
+// timeout. Other errors are returned as they are
+func _TimeoutError(operation string, timeout time.Duration, deadline, overall time.Time, err error) error {
+	var net_err net.Error
+	if err == nil || IsTimeout(err) || !errors.As(err, &net_err) || !net_err.Timeout() {
+		return err
+	}
+	if !overall.IsZero() && !deadline.Before(overall) {
+		return fmt.Errorf("%v interrupted: %w", operation, ErrLoopLapsed)
+	}
+	return &ErrTimeout{Operation: operation, Timeout: timeout, Err: err}
+}
@@ -0,0 +1,128 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	now := time.Now()
+	soon, later := now.Add(time.Second), now.Add(time.Hour)
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		overall  time.Time
+		expected time.Time
+	}{
+		{name: "neither", expected: time.Time{}},
+		{name: "only overall", overall: later, expected: later},
+		{name: "overall first", timeout: time.Minute, overall: soon, expected: soon},
+		{name: "timeout first", timeout: time.Second, overall: later, expected: now.Add(time.Second)},
+		{name: "only timeout", timeout: time.Second, expected: now.Add(time.Second)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deadline := _Deadline(test.timeout, test.overall)
+			// Deadlines set from the timeout are taken from the time of the call
+			difference := deadline.Sub(test.expected)
+			if deadline.IsZero() != test.expected.IsZero() || difference < 0 || difference > 100*time.Millisecond {
+				t.Fatalf("expected deadline %v, got %v", test.expected, deadline)
+			}
+		})
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	now := time.Now()
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	lapsed := &ErrTimeout{Operation: "read", Timeout: time.Second, Err: timeout}
+	tests := []struct {
+		name     string
+		deadline time.Time
+		overall  time.Time
+		err      error
+		check    func(error) bool
+	}{
+		{
+			name:  "no error",
+			check: func(err error) bool { return err == nil },
+		},
+		{
+			name:  "not a timeout",
+			err:   io.EOF,
+			check: func(err error) bool { return err == io.EOF },
+		},
+		{
+			name:     "operation timeout",
+			deadline: now,
+			overall:  now.Add(time.Hour),
+			err:      timeout,
+			check: func(err error) bool {
+				var timeout_err *ErrTimeout
+				return errors.As(err, &timeout_err) && timeout_err.Operation == "read" && errors.Is(err, os.ErrDeadlineExceeded)
+			},
+		},
+		{
+			name:     "operation timeout without overall deadline",
+			deadline: now,
+			err:      timeout,
+			check: func(err error) bool {
+				var timeout_err *ErrTimeout
+				return errors.As(err, &timeout_err)
+			},
+		},
+		{
+			name:     "overall deadline",
+			deadline: now,
+			overall:  now,
+			err:      timeout,
+			check:    func(err error) bool { return errors.Is(err, ErrLoopLapsed) && !errors.Is(err, os.ErrDeadlineExceeded) },
+		},
+		{
+			name:     "already classified",
+			deadline: now,
+			overall:  now,
+			err:      lapsed,
+			check:    func(err error) bool { return err == lapsed },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := _TimeoutError("read", time.Second, test.deadline, test.overall, test.err)
+			if !test.check(err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if test.err != nil && IsTimeout(err) != (test.err != io.EOF) {
+				t.Fatalf("expected IsTimeout to be %v for %v", test.err != io.EOF, err)
+			}
+		})
+	}
+}
+
+func TestReceiveMessageTimeouts(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := NewFramedConn(client)
+	defer conn.Close()
+
+	// The server never answers
+	_, err := ReceiveMessageWithin(conn, 10*time.Millisecond)
+	var timeout_err *ErrTimeout
+	if !errors.As(err, &timeout_err) || timeout_err.Timeout != 10*time.Millisecond {
+		t.Fatalf("expected a read timeout, got %v", err)
+	}
+	if !_IsConnectionError(err) {
+		t.Fatalf("expected %v to be handled as a lost connection", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := ReceiveMessageWithin(conn, time.Hour); !errors.Is(err, ErrLoopLapsed) {
+		t.Fatalf("expected %v, got %v", ErrLoopLapsed, err)
+	}
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// TLSConfig Configuration of the TLS transport. The client certificate is
+// optional and only needed if the server authenticates the agencies
+type TLSConfig struct {
+	Enabled bool
+	// PEM file with the certificates trusted to sign the server certificate.
+	// The system roots are used if empty
+	CAFile string
+	// PEM files with the certificate and key of the agency
+	CertFile string
+	KeyFile  string
+	// Name expected in the server certificate. The host of the server
+	// address is used if empty
+	ServerName string
+}
+
+// Causes of a failed TLS handshake
+var ErrServerNotTLS = errors.New("server does not speak TLS")
+var ErrUntrustedServerCertificate = errors.New("server certificate signed by an untrusted authority")
+var ErrServerNameMismatch = errors.New("server certificate does not match the server name")
+var ErrCertificateExpired = errors.New("certificate expired or not yet valid")
+var ErrClientCertificateRejected = errors.New("client certificate rejected by the server")
+var ErrTLSProtocol = errors.New("tls protocol error")
+
+// ErrTLSHandshake Returned when the TLS handshake with the server fails. Its
+// cause is one of the errors above and can be matched with errors.Is
+type ErrTLSHandshake struct {
+	Cause error
+	Err   error
+}
+
+func (e *ErrTLSHandshake) Error() string {
+	return fmt.Sprintf("tls handshake failed: %v: %v", e.Cause, e.Err)
+}
+
+func (e *ErrTLSHandshake) Unwrap() error {
+	return e.Err
+}
+
+func (e *ErrTLSHandshake) Is(target error) bool {
+	return target == e.Cause
+}
+
+// Alerts sent by a server that does not accept the client certificate
+var clientCertificateAlerts = []string{
+	"bad certificate",
+	"certificate required",
+	"unknown certificate authority",
+	"certificate expired",
+	"certificate revoked",
+	"unsupported certificate",
+}
+
+// NewTLSClientConfig Returns the crypto/tls configuration used to connect to
+// the server at address. Returns an error if the CA file or the client
+// certificate cannot be loaded, or if the server name is not set and cannot
+// be taken from the address, as with unix domain sockets
+func NewTLSClientConfig(config TLSConfig, address string) (*tls.Config, error) {
+	tls_config := &tls.Config{
+		ServerName: config.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tls_config.ServerName == "" && strings.HasPrefix(address, UNIX_ADDRESS_SCHEME) {
+		return nil, fmt.Errorf("tls server name must be set to connect to %v", address)
+	}
+	if tls_config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server address %v: %w", address, err)
+		}
+		tls_config.ServerName = host
+	}
+
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", config.CAFile)
+		}
+		tls_config.RootCAs = roots
+	}
+
+	if (config.CertFile == "") != (config.KeyFile == "") {
+		return nil, fmt.Errorf("client certificate and key files must be set together")
+	}
+	if config.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tls_config.Certificates = []tls.Certificate{certificate}
+	}
+	return tls_config, nil
+}
+
+// DialTLS Connects to the server at address on the given network with dialer
+// and performs the TLS handshake, both within the timeout and deadline of the
+// dialer. Handshake failures are returned as ErrTLSHandshake
+func DialTLS(dialer *net.Dialer, network, address string, config *tls.Config) (net.Conn, error) {
+	conn, err := tls.DialWithDialer(dialer, network, address, config)
+	if err != nil {
+		return nil, ClassifyTLSError(err)
+	}
+	return conn, nil
+}
+
+// ClassifyTLSError Returns an ErrTLSHandshake with the cause of err if it is a
+// TLS failure, or err itself otherwise. With TLS 1.3 the server validates the
+// client certificate after the client finished its handshake, so a rejected
+// certificate is only noticed when first reading from the connection.
+// Timeouts are not TLS failures and are returned as they are. Only meant for
+// the errors of the handshake, since errors of an established session mean
+// the connection was lost rather than that the server rejects the client
+func ClassifyTLSError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var handshake_err *ErrTLSHandshake
+	var net_err net.Error
+	if errors.As(err, &handshake_err) || IsTimeout(err) || (errors.As(err, &net_err) && net_err.Timeout()) {
+		return err
+	}
+
+	var record_err tls.RecordHeaderError
+	var unknown_authority x509.UnknownAuthorityError
+	var hostname_err x509.HostnameError
+	var invalid_err x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &record_err):
+		return &ErrTLSHandshake{Cause: ErrServerNotTLS, Err: err}
+	case errors.As(err, &unknown_authority):
+		return &ErrTLSHandshake{Cause: ErrUntrustedServerCertificate, Err: err}
+	case errors.As(err, &hostname_err):
+		return &ErrTLSHandshake{Cause: ErrServerNameMismatch, Err: err}
+	case errors.As(err, &invalid_err) && invalid_err.Reason == x509.Expired:
+		return &ErrTLSHandshake{Cause: ErrCertificateExpired, Err: err}
+	}
+
+	message := err.Error()
+	if strings.Contains(message, "remote error: tls: ") {
+		for _, alert := range clientCertificateAlerts {
+			if strings.Contains(message, alert) {
+				return &ErrTLSHandshake{Cause: ErrClientCertificateRejected, Err: err}
+			}
+		}
+		return &ErrTLSHandshake{Cause: ErrTLSProtocol, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,307 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A certificate generated for the tests along with its key
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	der         []byte
+}
+
+// Generates a certificate signed by parent, or self-signed if parent is nil
+func _NewTestCertificate(t *testing.T, name string, parent *testCertificate, is_ca bool, not_after time.Time) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-2 * time.Hour),
+		NotAfter:              not_after,
+		BasicConstraintsValid: true,
+		IsCA:                  is_ca,
+	}
+	if is_ca {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		template.DNSNames = []string{"localhost"}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	signer_certificate, signer_key := template, key
+	if parent != nil {
+		signer_certificate, signer_key = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer_certificate, &key.PublicKey, signer_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate: certificate, key: key, der: der}
+}
+
+// Writes the certificate and its key as PEM files and returns their paths
+func (c *testCertificate) _WriteFiles(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key_der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert_file := filepath.Join(dir, name+".crt")
+	key_file := filepath.Join(dir, name+".key")
+	err = ioutil.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert_file, key_file
+}
+
+func (c *testCertificate) _TLSCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.certificate}
+}
+
+// Certificates and files shared by the tests
+type testPKI struct {
+	dir           string
+	ca            *testCertificate
+	ca_file       string
+	other_ca_file string
+	server        *testCertificate
+	expired       *testCertificate
+	client_cert   string
+	client_key    string
+}
+
+func _NewTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	dir := t.TempDir()
+	valid_until := time.Now().Add(time.Hour)
+	ca := _NewTestCertificate(t, "test ca", nil, true, valid_until)
+	other_ca := _NewTestCertificate(t, "other ca", nil, true, valid_until)
+	client := _NewTestCertificate(t, "agency-1", ca, false, valid_until)
+
+	pki := &testPKI{
+		dir:     dir,
+		ca:      ca,
+		server:  _NewTestCertificate(t, "localhost", ca, false, valid_until),
+		expired: _NewTestCertificate(t, "localhost", ca, false, time.Now().Add(-time.Hour)),
+	}
+	pki.ca_file, _ = ca._WriteFiles(t, dir, "ca")
+	pki.other_ca_file, _ = other_ca._WriteFiles(t, dir, "other_ca")
+	pki.client_cert, pki.client_key = client._WriteFiles(t, dir, "agency-1")
+	return pki
+}
+
+// Starts a TLS listener on a local port that accepts a single connection,
+// completes the handshake, echoes one byte and reports the common name of
+// the client certificate, if any
+func _StartTLSServer(t *testing.T, pki *testPKI, certificate *testCertificate, require_client_cert bool) (string, chan string) {
+	t.Helper()
+	config := &tls.Config{Certificates: []tls.Certificate{certificate._TLSCertificate()}}
+	if require_client_cert {
+		roots := x509.NewCertPool()
+		roots.AddCert(pki.ca.certificate)
+		config.ClientCAs = roots
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	peers := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tls_conn := conn.(*tls.Conn)
+		if err := tls_conn.Handshake(); err != nil {
+			return
+		}
+		state := tls_conn.ConnectionState()
+		if len(state.PeerCertificates) > 0 {
+			peers <- state.PeerCertificates[0].Subject.CommonName
+		} else {
+			peers <- ""
+		}
+		buffer := make([]byte, 1)
+		if _, err := tls_conn.Read(buffer); err == nil {
+			tls_conn.Write(buffer)
+		}
+	}()
+	return listener.Addr().String(), peers
+}
+
+// Connects to address and exchanges one byte, so failures noticed after the
+// handshake are reported as well
+func _DialAndExchange(config TLSConfig, address string) error {
+	tls_config, err := NewTLSClientConfig(config, address)
+	if err != nil {
+		return err
+	}
+	conn, err := DialTLS(&net.Dialer{}, "tcp", address, tls_config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return ClassifyTLSError(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return ClassifyTLSError(err)
+}
+
+func TestDialTLSWithClientCertificate(t *testing.T) {
+	pki := _NewTestPKI(t)
+	address, peers := _StartTLSServer(t, pki, pki.server, true)
+
+	config := TLSConfig{Enabled: true, CAFile: pki.ca_file, CertFile: pki.client_cert, KeyFile: pki.client_key}
+	if err := _DialAndExchange(config, address); err != nil {
+		t.Fatalf("expected a successful exchange, got: %v", err)
+	}
+	if peer := <-peers; peer != "agency-1" {
+		t.Fatalf("expected the server to see the agency certificate, got %q", peer)
+	}
+}
+
+func TestDialTLSErrors(t *testing.T) {
+	pki := _NewTestPKI(t)
+	tests := []struct {
+		name                string
+		certificate         *testCertificate
+		require_client_cert bool
+		config              TLSConfig
+		expected            error
+	}{
+		{
+			name:        "untrusted server",
+			certificate: pki.server,
+			config:      TLSConfig{Enabled: true, CAFile: pki.other_ca_file},
+			expected:    ErrUntrustedServerCertificate,
+		},
+		{
+			name:        "server name mismatch",
+			certificate: pki.server,
+			config:      TLSConfig{Enabled: true, CAFile: pki.ca_file, ServerName: "server.example"},
+			expected:    ErrServerNameMismatch,
+		},
+		{
+			name:        "expired server certificate",
+			certificate: pki.expired,
+			config:      TLSConfig{Enabled: true, CAFile: pki.ca_file},
+			expected:    ErrCertificateExpired,
+		},
+		{
+			name:                "missing client certificate",
+			certificate:         pki.server,
+			require_client_cert: true,
+			config:              TLSConfig{Enabled: true, CAFile: pki.ca_file},
+			expected:            ErrClientCertificateRejected,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, _ := _StartTLSServer(t, pki, test.certificate, test.require_client_cert)
+			err := _DialAndExchange(test.config, address)
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got: %v", test.expected, err)
+			}
+			var handshake_err *ErrTLSHandshake
+			if !errors.As(err, &handshake_err) {
+				t.Fatalf("expected an ErrTLSHandshake, got: %T", err)
+			}
+		})
+	}
+}
+
+func TestDialTLSToPlainServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("this is not a tls server\n"))
+	}()
+
+	_, err = DialTLS(&net.Dialer{}, "tcp", listener.Addr().String(), &tls.Config{ServerName: "localhost"})
+	if !errors.Is(err, ErrServerNotTLS) {
+		t.Fatalf("expected %v, got: %v", ErrServerNotTLS, err)
+	}
+}
+
+func TestNewTLSClientConfigErrors(t *testing.T) {
+	pki := _NewTestPKI(t)
+	address := "localhost:12345"
+
+	config, err := NewTLSClientConfig(TLSConfig{Enabled: true}, address)
+	if err != nil {
+		t.Fatalf("expected a valid configuration, got: %v", err)
+	}
+	if config.ServerName != "localhost" {
+		t.Fatalf("expected the server name to default to the host, got %q", config.ServerName)
+	}
+
+	if _, err := NewTLSClientConfig(TLSConfig{Enabled: true, CertFile: pki.client_cert}, address); err == nil {
+		t.Fatal("expected an error for a certificate without a key")
+	}
+	if _, err := NewTLSClientConfig(TLSConfig{Enabled: true, CAFile: pki.client_key}, address); err == nil {
+		t.Fatal("expected an error for a CA file without certificates")
+	}
+	if _, err := NewTLSClientConfig(TLSConfig{Enabled: true, CAFile: filepath.Join(pki.dir, "missing.crt")}, address); err == nil {
+		t.Fatal("expected an error for a missing CA file")
+	}
+}
+
+func TestSessionTLSErrorsAreNotFatal(t *testing.T) {
+	// The error a TLS connection returns when a record is corrupted mid session
+	err := &net.OpError{Op: "local error", Net: "tcp", Err: errors.New("tls: bad record MAC")}
+	classified := ClassifyTLSError(err)
+	var handshake_err *ErrTLSHandshake
+	if errors.As(classified, &handshake_err) {
+		t.Fatalf("expected the error not to be classified as a handshake failure, got: %v", classified)
+	}
+	if _IsFatalError(err) || !_IsConnectionError(err) {
+		t.Fatalf("expected %v to be a connection error the client recovers from", err)
+	}
+}
@@ -0,0 +1,300 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A batch of bets that fits in one frame and was not confirmed yet
+type pendingBatch struct {
+	sequence        uint32
+	bets            []*Bet
+	retransmissions int
+}
+
+// BetWindowConfig Configuration used by a BetWindow
+type BetWindowConfig struct {
+	// Batches that may be in flight at once
+	Size     int
+	AgencyID int
+	// Times a corrupted batch is sent again before failing
+	MaxRetransmissions int
+	// Whether batches are compressed if compression was agreed
+	Compression bool
+	// Time to wait before sending again a batch the server rate limited
+	RetryDelay time.Duration
+}
+
+// BetWindow Sends bet batches keeping up to size of them in flight. A reader
+// goroutine matches the confirmations of the server to the batches in
+// flight, by sequence number if sequence numbers were agreed or in order
+// otherwise, and sends again the ones rejected by the server. Batches are
+// kept until confirmed so they can be sent again on a new connection
+type BetWindow struct {
+	config   BetWindowConfig
+	sequence *BatchSequence
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	conn    *FramedConn
+	queued  []*pendingBatch
+	pending []*pendingBatch
+	err     error
+	// Whether the reader goroutine is sending a batch again. Nothing else
+	// is sent meanwhile, so batches stay in the order they were sent
+	resending bool
+}
+
+// NewBetWindow Initializes a new BetWindow that numbers its batches with the
+// given sequence
+func NewBetWindow(config BetWindowConfig, sequence *BatchSequence) *BetWindow {
+	if config.Size <= 0 {
+		config.Size = 1
+	}
+	window := &BetWindow{
+		config:   config,
+		sequence: sequence,
+		queued:   make([]*pendingBatch, 0),
+		pending:  make([]*pendingBatch, 0),
+	}
+	window.cond = sync.NewCond(&window.mutex)
+	return window
+}
+
+// Attach Starts sending through a connection. The batches that were in
+// flight on a previous connection are sent again first, and a reader
+// goroutine is started to receive their confirmations
+func (w *BetWindow) Attach(conn *FramedConn) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.conn = conn
+	w.err = nil
+	for _, batch := range w.pending {
+		log.Debugf("action: resend_batch | result: in_progress | client_id: %v | sequence: %v", w.config.AgencyID, batch.sequence)
+		err := _SendBatch(conn, w.config.AgencyID, batch.sequence, batch.bets, w.config.Compression)
+		if err != nil {
+			w.err = err
+			return err
+		}
+	}
+	go w._Read(conn)
+	return nil
+}
+
+// Detach Stops using the current connection. The reader goroutine exits once
+// it has no batch in flight or its connection fails
+func (w *BetWindow) Detach() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.conn = nil
+	w.cond.Broadcast()
+}
+
+// Pending Returns the number of batches sent and not confirmed yet
+func (w *BetWindow) Pending() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.pending)
+}
+
+// Enqueue Splits bets in as many batches as needed to honor the maximum
+// frame size of the current connection, numbers them and queues them to be
+// sent. Returns an error if a single bet does not fit in a frame
+func (w *BetWindow) Enqueue(bets []*Bet) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.conn == nil {
+		return fmt.Errorf("bet window has no connection")
+	}
+
+	features := w.conn.Features()
+	max_body_size := w.conn.MaxFrameSize() - features.HeaderLength() - features.TrailerLength()
+	if features.Has(CAP_SEQUENCE_NUMBERS) {
+		max_body_size -= SEQUENCE_LENGTH
+	}
+
+	batches := make([]*pendingBatch, 0)
+	for total_bets_queued := 0; total_bets_queued < len(bets); {
+		bets_that_fit := _BetsThatFit(bets[total_bets_queued:], max_body_size, features)
+		if bets_that_fit == 0 {
+			bet_size := _BetSerializaitionLength(bets[total_bets_queued], features)
+			return &ErrBetTooLarge{Size: bet_size, MaxFrameSize: w.conn.MaxFrameSize()}
+		}
+		batches = append(batches, &pendingBatch{bets: bets[total_bets_queued : total_bets_queued+bets_that_fit]})
+		total_bets_queued += bets_that_fit
+	}
+
+	for _, batch := range batches {
+		batch.sequence = w.sequence.Next()
+		w.queued = append(w.queued, batch)
+	}
+	return nil
+}
+
+// Flush Sends every queued batch, blocking while the window is full. Returns
+// the error that stopped the window, if any
+func (w *BetWindow) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for len(w.queued) > 0 {
+		for (len(w.pending) >= w.config.Size || w.resending) && w.err == nil && w.conn != nil {
+			w.cond.Wait()
+		}
+		if w.err != nil {
+			return w.err
+		}
+		if w.conn == nil {
+			return fmt.Errorf("bet window has no connection")
+		}
+
+		batch := w.queued[0]
+		w.queued = w.queued[1:]
+		w.pending = append(w.pending, batch)
+		conn := w.conn
+		// Wake up the reader goroutine if it was waiting for a batch in flight
+		w.cond.Broadcast()
+
+		// Do not hold the lock while blocked writing, so that the reader
+		// goroutine can keep receiving confirmations
+		w.mutex.Unlock()
+		err := _SendBatch(conn, w.config.AgencyID, batch.sequence, batch.bets, w.config.Compression)
+		w.mutex.Lock()
+		if err != nil {
+			w.err = err
+			return err
+		}
+	}
+	return nil
+}
+
+// Drain Sends every queued batch and blocks until all of them are confirmed.
+// Returns the error that stopped the window, if any
+func (w *BetWindow) Drain() error {
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(w.pending) > 0 && w.err == nil {
+		w.cond.Wait()
+	}
+	return w.err
+}
+
+// Receives the confirmations of the batches in flight on a connection until
+// it is detached or fails
+func (w *BetWindow) _Read(conn *FramedConn) {
+	for {
+		w.mutex.Lock()
+		for len(w.pending) == 0 && w.conn == conn && w.err == nil {
+			w.cond.Wait()
+		}
+		if w.conn != conn || w.err != nil {
+			w.mutex.Unlock()
+			return
+		}
+		w.mutex.Unlock()
+
+		message, err := ReceiveMessage(conn)
+
+		w.mutex.Lock()
+		if w.conn != conn {
+			// The connection was replaced while reading
+			w.mutex.Unlock()
+			return
+		}
+		var rejected *pendingBatch
+		var delay time.Duration
+		if errors.Is(err, ErrRateLimited) {
+			rejected, delay = w._HandleRateLimited(err), w.config.RetryDelay
+			err = nil
+		} else if err == nil {
+			rejected, err = w._HandleResponse(conn, message)
+		}
+		if err != nil {
+			w.err = err
+		}
+		w.resending = rejected != nil
+		w.cond.Broadcast()
+		w.mutex.Unlock()
+
+		if rejected != nil {
+			time.Sleep(delay)
+			err = _SendBatch(conn, w.config.AgencyID, rejected.sequence, rejected.bets, w.config.Compression)
+			w.mutex.Lock()
+			w.resending = false
+			if err != nil && w.conn == conn {
+				w.err = err
+			}
+			w.cond.Broadcast()
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// Returns the batch the server rate limited, which is the oldest in flight
+// since the server answers batches in the order they are sent, and moves it
+// to the end of the window. It was not applied, so it can be sent again even
+// if sequence numbers were not agreed. Must be called with the mutex held
+func (w *BetWindow) _HandleRateLimited(err error) *pendingBatch {
+	batch := w.pending[0]
+	w.pending = append(w.pending[1:], batch)
+	log.Warnf("action: send_bets | result: retry | client_id: %v | sequence: %v | error: %v",
+		w.config.AgencyID, batch.sequence, err)
+	return batch
+}
+
+// Matches a response of the server to a batch in flight. Confirmed batches
+// are removed from the window and rejected ones are returned to be sent
+// again. Must be called with the mutex held
+func (w *BetWindow) _HandleResponse(conn *FramedConn, message Message) (*pendingBatch, error) {
+	var sequence uint32
+	switch msg := message.(type) {
+	case *ConfirmationMessage:
+		sequence = msg.Sequence
+	case *NackMessage:
+		sequence = msg.Sequence
+	default:
+		return nil, fmt.Errorf("invalid confirmation message")
+	}
+
+	index := 0
+	if conn.Features().Has(CAP_SEQUENCE_NUMBERS) {
+		index = -1
+		for i, batch := range w.pending {
+			if batch.sequence == sequence {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return nil, &ErrUnexpectedSequence{Expected: w.pending[0].sequence, Actual: sequence}
+		}
+	}
+	batch := w.pending[index]
+	w.pending = append(w.pending[:index], w.pending[index+1:]...)
+
+	if _, ok := message.(*NackMessage); ok {
+		if batch.retransmissions >= w.config.MaxRetransmissions {
+			return nil, ErrBatchRejected
+		}
+		batch.retransmissions++
+		log.Warnf("action: send_bets | result: retry | client_id: %v | retransmission: %v | sequence: %v | error: %v",
+			w.config.AgencyID, batch.retransmissions, batch.sequence, ErrBatchRejected)
+		// Responses arrive in the order batches are sent, so the batch goes
+		// back at the end of the window
+		w.pending = append(w.pending, batch)
+		return batch, nil
+	}
+
+	w.sequence.Confirm(batch.sequence)
+	return nil, nil
+}
@@ -0,0 +1,195 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// Features of a session where batches are numbered
+var sequencedFeatures = Features{Version: PROTOCOL_VERSION, Capabilities: CAP_SEQUENCE_NUMBERS}
+
+// Returns the frames the server sends for the given messages
+func _ServerFrames(t *testing.T, features Features, messages ...Message) []byte {
+	t.Helper()
+	frames := make([]byte, 0)
+	for _, message := range messages {
+		body, err := EncodeMessage(message, features)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := SIZE_FIELD_LENGTH + MSG_CODE_LENGTH + len(body) + 1
+		frames = append(frames, byte(size>>8), byte(size), byte(message.Code()))
+		frames = append(frames, body...)
+		frames = append(frames, MSG_TERMINATOR)
+	}
+	return frames
+}
+
+// Returns the sequence numbers of the bet batches written by the client
+func _SentSequences(t *testing.T, features Features, written []byte) []uint32 {
+	t.Helper()
+	conn := NewFramedConn(&testConn{reader: bytes.NewReader(written)})
+	sequences := make([]uint32, 0)
+	for {
+		frame, err := conn.ReadFrame(time.Time{})
+		if err == io.EOF {
+			return sequences
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		agency_id := _GetField(frame[SIZE_FIELD_LENGTH+MSG_CODE_LENGTH : features.HeaderLength()])
+		message, err := DecodeMessage(int(frame[SIZE_FIELD_LENGTH]), features, agency_id, frame[features.HeaderLength():])
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch, ok := message.(*BetsMessage)
+		if !ok {
+			t.Fatalf("expected a bet batch, got %T", message)
+		}
+		sequences = append(sequences, batch.Sequence)
+	}
+}
+
+// Returns a window attached to a connection that reads the server frames
+// from reader
+func _NewTestWindow(t *testing.T, config BetWindowConfig, reader io.Reader) (*BetWindow, *testConn) {
+	t.Helper()
+	conn := &testConn{reader: reader}
+	framed_conn := NewFramedConn(conn)
+	framed_conn.SetFeatures(sequencedFeatures)
+	window := NewBetWindow(config, NewBatchSequence())
+	if err := window.Attach(framed_conn); err != nil {
+		t.Fatal(err)
+	}
+	return window, conn
+}
+
+// Queues one batch per bet
+func _EnqueueBatches(t *testing.T, window *BetWindow, batches int) {
+	t.Helper()
+	bettor := NewBettorInfo("Santiago Lionel", "Lorca", 30904465, "1999-03-17")
+	for i := 0; i < batches; i++ {
+		if err := window.Enqueue([]*Bet{NewBet(7574+i, 1, *bettor)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func _AssertSequences(t *testing.T, expected, actual []uint32) {
+	t.Helper()
+	if len(expected) != len(actual) {
+		t.Fatalf("expected batches %v to be sent, got %v", expected, actual)
+	}
+	for i := range expected {
+		if expected[i] != actual[i] {
+			t.Fatalf("expected batches %v to be sent, got %v", expected, actual)
+		}
+	}
+}
+
+func TestBetWindowOutOfOrderConfirmations(t *testing.T) {
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	window, conn := _NewTestWindow(t, BetWindowConfig{Size: 3, AgencyID: 1}, reader)
+	_EnqueueBatches(t, window, 3)
+	if err := window.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Answered once every batch is in flight, so the confirmations cannot
+	// arrive before the batches they confirm
+	go writer.Write(_ServerFrames(t, sequencedFeatures,
+		&ConfirmationMessage{Sequence: 3}, &ConfirmationMessage{Sequence: 1}, &ConfirmationMessage{Sequence: 2}))
+	if err := window.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if window.Pending() != 0 || window.sequence.LastConfirmed() != 3 {
+		t.Fatalf("expected every batch confirmed, got %v pending and %v confirmed", window.Pending(), window.sequence.LastConfirmed())
+	}
+	_AssertSequences(t, []uint32{1, 2, 3}, _SentSequences(t, sequencedFeatures, conn.written.Bytes()))
+}
+
+func TestBetWindowUnexpectedConfirmation(t *testing.T) {
+	frames := _ServerFrames(t, sequencedFeatures, &ConfirmationMessage{Sequence: 9})
+	window, _ := _NewTestWindow(t, BetWindowConfig{Size: 1, AgencyID: 1}, bytes.NewReader(frames))
+	_EnqueueBatches(t, window, 1)
+
+	var sequence_err *ErrUnexpectedSequence
+	if err := window.Drain(); !errors.As(err, &sequence_err) {
+		t.Fatalf("expected an unexpected sequence error, got %v", err)
+	}
+}
+
+func TestBetWindowRetransmitsRejectedBatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []Message
+		expected  error
+		sent      []uint32
+	}{
+		{
+			name:      "confirmed after retransmissions",
+			responses: []Message{&NackMessage{Sequence: 1}, &NackMessage{Sequence: 1}, &ConfirmationMessage{Sequence: 1}},
+			sent:      []uint32{1, 1, 1},
+		},
+		{
+			name:      "rejected past the limit",
+			responses: []Message{&NackMessage{Sequence: 1}, &NackMessage{Sequence: 1}, &NackMessage{Sequence: 1}},
+			expected:  ErrBatchRejected,
+			sent:      []uint32{1, 1, 1},
+		},
+		{
+			name:      "rate limited",
+			responses: []Message{&ErrorMessage{Reason: ERROR_RATE_LIMITED}, &ConfirmationMessage{Sequence: 1}},
+			sent:      []uint32{1, 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := BetWindowConfig{Size: 1, AgencyID: 1, MaxRetransmissions: 2, RetryDelay: time.Millisecond}
+			window, conn := _NewTestWindow(t, config, bytes.NewReader(_ServerFrames(t, sequencedFeatures, test.responses...)))
+			_EnqueueBatches(t, window, 1)
+
+			err := window.Drain()
+			if !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+			_AssertSequences(t, test.sent, _SentSequences(t, sequencedFeatures, conn.written.Bytes()))
+		})
+	}
+}
+
+func TestBetWindowResendsAfterAttach(t *testing.T) {
+	// The first connection never answers, so both batches stay in flight
+	reader, writer := io.Pipe()
+	window, _ := _NewTestWindow(t, BetWindowConfig{Size: 2, AgencyID: 1}, reader)
+	_EnqueueBatches(t, window, 2)
+	if err := window.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	window.Detach()
+	writer.Close()
+	if window.Pending() != 2 {
+		t.Fatalf("expected 2 batches in flight, got %v", window.Pending())
+	}
+
+	frames := _ServerFrames(t, sequencedFeatures, &ConfirmationMessage{Sequence: 1}, &ConfirmationMessage{Sequence: 2})
+	conn := &testConn{reader: bytes.NewReader(frames)}
+	framed_conn := NewFramedConn(conn)
+	framed_conn.SetFeatures(sequencedFeatures)
+	if err := window.Attach(framed_conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := window.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if window.sequence.LastConfirmed() != 2 {
+		t.Fatalf("expected both batches confirmed, got %v", window.sequence.LastConfirmed())
+	}
+	_AssertSequences(t, []uint32{1, 2}, _SentSequences(t, sequencedFeatures, conn.written.Bytes()))
+}
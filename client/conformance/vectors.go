@@ -0,0 +1,50 @@
+// Package conformance Golden byte vectors of the messages of the protocol,
+// in both directions, for checking implementations of it against the same
+// bytes. The vectors are kept in testdata/vectors.json so implementations in
+// other languages can load them as well
+package conformance
+
+import (
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Senders of the frames of the vectors
+const SENDER_CLIENT = "client" // Frames carry the agency in the header
+const SENDER_SERVER = "server" // Frames have no agency and end with a terminator
+
+//go:embed testdata/vectors.json
+var vectors_json []byte
+
+// Vector A message along with the frame it is sent as. The frame is encoded
+// with the given protocol version and capabilities, and Message holds the
+// message as an object of the JSON lines encoding. Frames marked DecodeOnly
+// are not the only valid encoding of their message, so implementations are
+// only expected to decode them. The response of the auth vector answers the
+// nonce of the challenge vector, keyed with Secret
+type Vector struct {
+	Name         string          `json:"name"`
+	Sender       string          `json:"sender"`
+	Version      int             `json:"version"`
+	Capabilities uint32          `json:"capabilities"`
+	Agency       int             `json:"agency,omitempty"`
+	Secret       string          `json:"secret,omitempty"`
+	Frame        string          `json:"frame"`
+	Message      json.RawMessage `json:"message"`
+	DecodeOnly   bool            `json:"decode_only,omitempty"`
+}
+
+// Vectors Returns every golden vector
+func Vectors() ([]Vector, error) {
+	var vectors []Vector
+	if err := json.Unmarshal(vectors_json, &vectors); err != nil {
+		return nil, err
+	}
+	return vectors, nil
+}
+
+// Bytes Returns the frame of the vector
+func (v Vector) Bytes() ([]byte, error) {
+	return hex.DecodeString(v.Frame)
+}
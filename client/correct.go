@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// RunCorrect Runs the correct subcommand, which cancels or amends bets the
+// agency of the client already sent, as listed in a corrections file. The
+// client is configured as it is to send its bets, but no bet is sent, and the
+// server only accepts corrections until the agency finishes sending bets.
+// Returns the exit code of the program: 1 if any correction was not applied,
+// in which case the ones after it are not sent, and 2 on usage errors
+func RunCorrect(args []string) int {
+	flags := flag.NewFlagSet("correct", flag.ContinueOnError)
+	file := flags.String("file", "", "corrections file, with a cancel,<dni>,<number> or amend,<dni>,<number>,<name>,<lastname>,<dni>,<birthdate>,<number> line for each bet")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: client correct --file <corrections.csv>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *file == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	v, err := InitConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if err := InitLogger(v.GetString("log.level")); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	config, err := LoadClientConfig(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	agency_id, _ := strconv.Atoi(config.ID)
+	corrections, err := common.ReadCorrectionsFromCSVFile(*file, agency_id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	applied, err := common.NewClient(config).CorrectBets(corrections)
+	fmt.Printf("corrections: %v | applied: %v\n", len(corrections), applied)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
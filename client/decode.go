@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// RunDecode Runs the decode subcommand, which pretty-prints every frame of a
+// capture and flags its inconsistencies. The capture is read from the file
+// named by the argument, from the argument itself if it is not a file, or
+// from stdin if there is no argument or it is "-". Hex dumps are decoded
+// first, including log lines such as the ones printing packet.hex(). Returns
+// the exit code of the program: 1 if any inconsistency was found and 2 if
+// the capture could not be read
+func RunDecode(args []string) int {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	sender := flags.String("from", common.SENDER_CLIENT, "side that sent the frames, client or server")
+	version := flags.Int("version", common.LEGACY_PROTOCOL_VERSION, "protocol version agreed for the connection")
+	capabilities := flags.Uint("capabilities", 0, "capabilities bitmask agreed for the connection")
+	raw := flags.Bool("raw", false, "read the capture as raw bytes even if it looks like a hex dump")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: client decode [flags] [hex | file | -]\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *sender != common.SENDER_CLIENT && *sender != common.SENDER_SERVER {
+		fmt.Fprintf(os.Stderr, "invalid sender %q: expected %v or %v\n", *sender, common.SENDER_CLIENT, common.SENDER_SERVER)
+		return 2
+	}
+
+	capture, err := _ReadCapture(flags.Args(), *raw)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	features := common.Features{Version: *version, Capabilities: uint32(*capabilities)}
+	frames, trailing := common.DissectFrames(capture, *sender, features)
+	exit_code := 0
+	for _, frame := range frames {
+		fmt.Print(frame)
+		if len(frame.Problems) > 0 {
+			exit_code = 1
+		}
+	}
+	if len(trailing) > 0 {
+		fmt.Printf("offset: %v | ! %v trailing bytes: %x\n", len(capture)-len(trailing), len(trailing), trailing)
+		exit_code = 1
+	}
+	fmt.Printf("frames: %v | bytes: %v\n", len(frames), len(capture))
+	return exit_code
+}
+
+// Reads the capture named by the arguments. Unless raw is set, a capture
+// that reads as a hex dump is decoded
+func _ReadCapture(args []string, raw bool) ([]byte, error) {
+	var data []byte
+	var err error
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "-"):
+		data, err = ioutil.ReadAll(os.Stdin)
+	case len(args) == 1 && _IsFile(args[0]):
+		data, err = ioutil.ReadFile(args[0])
+	default:
+		data = []byte(strings.Join(args, " "))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read capture: %w", err)
+	}
+
+	if !raw {
+		if decoded, ok := _ParseHexDump(string(data)); ok {
+			return decoded, nil
+		}
+	}
+	return data, nil
+}
+
+// Returns whether path names a regular file
+func _IsFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Decodes a hex dump, which may be split in lines and words and whose lines
+// may be log lines ending with the dump after a colon. Returns false if the
+// text is not a hex dump
+func _ParseHexDump(text string) ([]byte, bool) {
+	var digits strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		if i := strings.LastIndex(line, ": "); i != -1 {
+			line = line[i+2:]
+		}
+		for _, word := range strings.Fields(line) {
+			digits.WriteString(strings.TrimPrefix(word, "0x"))
+		}
+	}
+	if digits.Len() == 0 {
+		return nil, false
+	}
+	decoded, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"strings"
@@ -35,10 +37,33 @@ func InitConfig() (*viper.Viper, error) {
 	// Add env variables supported
 	v.BindEnv("id")
 	v.BindEnv("server", "address")
+	v.BindEnv("server.tls.enabled")
+	v.BindEnv("server.tls.ca_file")
+	v.BindEnv("server.tls.cert_file")
+	v.BindEnv("server.tls.key_file")
+	v.BindEnv("server.tls.server_name")
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "lapse")
 	v.BindEnv("log", "level")
 	v.BindEnv("protocol", "bets_per_batch")
+	v.BindEnv("protocol", "max_frame_size")
+	v.BindEnv("protocol", "max_retransmissions")
+	v.BindEnv("protocol", "handshake_timeout")
+	v.BindEnv("protocol", "window_size")
+	v.BindEnv("protocol", "max_reconnections")
+	v.BindEnv("protocol", "compression")
+	v.BindEnv("protocol", "heartbeat_interval")
+	v.BindEnv("protocol", "max_missed_pongs")
+	v.BindEnv("protocol", "encoding")
+	v.BindEnv("protocol", "poll_interval")
+	v.BindEnv("timeouts", "connect")
+	v.BindEnv("timeouts", "write")
+	v.BindEnv("timeouts", "read")
+	v.BindEnv("timeouts", "results")
+	v.BindEnv("auth.secret")
+	v.BindEnv("secret_file")
+	v.BindEnv("winners_file")
+	v.BindEnv("corrections_file")
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
@@ -58,9 +83,100 @@ func InitConfig() (*viper.Viper, error) {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
 
+	v.SetDefault("protocol.max_frame_size", common.MAX_FRAME_SIZE)
+	v.SetDefault("protocol.max_retransmissions", common.DEFAULT_MAX_RETRANSMISSIONS)
+	v.SetDefault("protocol.handshake_timeout", common.DEFAULT_HANDSHAKE_TIMEOUT.String())
+	v.SetDefault("protocol.window_size", common.DEFAULT_WINDOW_SIZE)
+	v.SetDefault("protocol.max_reconnections", common.DEFAULT_MAX_RECONNECTIONS)
+	v.SetDefault("protocol.compression", true)
+	v.SetDefault("protocol.heartbeat_interval", common.DEFAULT_HEARTBEAT_INTERVAL.String())
+	v.SetDefault("protocol.max_missed_pongs", common.DEFAULT_MAX_MISSED_PONGS)
+	v.SetDefault("protocol.encoding", common.ENCODING_BINARY)
+	v.SetDefault("protocol.poll_interval", common.DEFAULT_POLL_INTERVAL.String())
+	if _, err := time.ParseDuration(v.GetString("protocol.handshake_timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_PROTOCOL_HANDSHAKE_TIMEOUT env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("protocol.heartbeat_interval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_PROTOCOL_HEARTBEAT_INTERVAL env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("protocol.poll_interval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_PROTOCOL_POLL_INTERVAL env var as time.Duration.")
+	}
+
+	v.SetDefault("timeouts.connect", common.DEFAULT_CONNECT_TIMEOUT.String())
+	v.SetDefault("timeouts.write", common.DEFAULT_WRITE_TIMEOUT.String())
+	v.SetDefault("timeouts.read", common.DEFAULT_READ_TIMEOUT.String())
+	v.SetDefault("timeouts.results", common.DEFAULT_RESULTS_TIMEOUT.String())
+	for _, key := range []string{"connect", "write", "read", "results"} {
+		if _, err := time.ParseDuration(v.GetString("timeouts." + key)); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse CLI_TIMEOUTS_%s env var as time.Duration.", strings.ToUpper(key))
+		}
+	}
+
 	return v, nil
 }
 
+// LoadSecret Returns the secret of the agency, read from the file set in
+// CLI_SECRET_FILE if any or from the configuration otherwise. Surrounding
+// whitespace is ignored
+func LoadSecret(v *viper.Viper) ([]byte, error) {
+	secret_file := v.GetString("secret_file")
+	if secret_file == "" {
+		return []byte(strings.TrimSpace(v.GetString("auth.secret"))), nil
+	}
+	secret, err := ioutil.ReadFile(secret_file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read CLI_SECRET_FILE.")
+	}
+	return bytes.TrimSpace(secret), nil
+}
+
+// LoadClientConfig Returns the configuration of the client, reading the
+// secret of the agency if one is set
+func LoadClientConfig(v *viper.Viper) (common.ClientConfig, error) {
+	secret, err := LoadSecret(v)
+	if err != nil {
+		return common.ClientConfig{}, err
+	}
+
+	return common.ClientConfig{
+		ServerAddress: v.GetString("server.address"),
+		ID:            v.GetString("id"),
+		LoopLapse:     v.GetDuration("loop.lapse"),
+		LoopPeriod:    v.GetDuration("loop.period"),
+		BetsPerBatch:  v.GetInt("protocol.bets_per_batch"),
+
+		MaxFrameSize:       v.GetInt("protocol.max_frame_size"),
+		MaxRetransmissions: v.GetInt("protocol.max_retransmissions"),
+		HandshakeTimeout:   v.GetDuration("protocol.handshake_timeout"),
+		WindowSize:         v.GetInt("protocol.window_size"),
+		MaxReconnections:   v.GetInt("protocol.max_reconnections"),
+		Compression:        v.GetBool("protocol.compression"),
+		HeartbeatInterval:  v.GetDuration("protocol.heartbeat_interval"),
+		MaxMissedPongs:     v.GetInt("protocol.max_missed_pongs"),
+		Encoding:           v.GetString("protocol.encoding"),
+		PollInterval:       v.GetDuration("protocol.poll_interval"),
+
+		Timeouts: common.TimeoutsConfig{
+			Connect: v.GetDuration("timeouts.connect"),
+			Write:   v.GetDuration("timeouts.write"),
+			Read:    v.GetDuration("timeouts.read"),
+			Results: v.GetDuration("timeouts.results"),
+		},
+
+		TLS: common.TLSConfig{
+			Enabled:    v.GetBool("server.tls.enabled"),
+			CAFile:     v.GetString("server.tls.ca_file"),
+			CertFile:   v.GetString("server.tls.cert_file"),
+			KeyFile:    v.GetString("server.tls.key_file"),
+			ServerName: v.GetString("server.tls.server_name"),
+		},
+		Secret:          secret,
+		WinnersFile:     v.GetString("winners_file"),
+		CorrectionsFile: v.GetString("corrections_file"),
+	}, nil
+}
+
 // InitLogger Receives the log level to be set in logrus as a string. This method
 // parses the string and set the level to the logger. If the level string is not
 // valid an error is returned
@@ -82,13 +198,31 @@ func InitLogger(logLevel string) error {
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	logrus.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_lapse: %v | loop_period: %v | log_level: %s | bets_per_batch: %d",
+	logrus.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_lapse: %v | loop_period: %v | log_level: %s | bets_per_batch: %d | max_frame_size: %d | max_retransmissions: %d | handshake_timeout: %v | window_size: %d | max_reconnections: %d | compression: %v | heartbeat_interval: %v | max_missed_pongs: %d | encoding: %s | poll_interval: %v | timeouts: connect=%v,write=%v,read=%v,results=%v | tls: %v | authentication: %v | winners_file: %s | corrections_file: %s",
 		v.GetString("id"),
 		v.GetString("server.address"),
 		v.GetDuration("loop.lapse"),
 		v.GetDuration("loop.period"),
 		v.GetString("log.level"),
 		v.GetInt("protocol.bets_per_batch"),
+		v.GetInt("protocol.max_frame_size"),
+		v.GetInt("protocol.max_retransmissions"),
+		v.GetDuration("protocol.handshake_timeout"),
+		v.GetInt("protocol.window_size"),
+		v.GetInt("protocol.max_reconnections"),
+		v.GetBool("protocol.compression"),
+		v.GetDuration("protocol.heartbeat_interval"),
+		v.GetInt("protocol.max_missed_pongs"),
+		v.GetString("protocol.encoding"),
+		v.GetDuration("protocol.poll_interval"),
+		v.GetDuration("timeouts.connect"),
+		v.GetDuration("timeouts.write"),
+		v.GetDuration("timeouts.read"),
+		v.GetDuration("timeouts.results"),
+		v.GetBool("server.tls.enabled"),
+		v.GetString("auth.secret") != "" || v.GetString("secret_file") != "",
+		v.GetString("winners_file"),
+		v.GetString("corrections_file"),
 	)
 }
 
@@ -106,6 +240,16 @@ func signalHandler(signalChannel chan os.Signal, client **common.Client) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		os.Exit(RunDecode(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		os.Exit(RunQuery(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "correct" {
+		os.Exit(RunCorrect(os.Args[2:]))
+	}
+
 	signalChannel := make(chan os.Signal, 1)
 	var client *common.Client = nil
 	signal.Notify(signalChannel, syscall.SIGTERM)
@@ -123,12 +267,9 @@ func main() {
 	// Print program config with debugging purposes
 	PrintConfig(v)
 
-	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		LoopLapse:     v.GetDuration("loop.lapse"),
-		LoopPeriod:    v.GetDuration("loop.period"),
-		BetsPerBatch:  v.GetInt("protocol.bets_per_batch"),
+	clientConfig, err := LoadClientConfig(v)
+	if err != nil {
+		log.Fatalf("%s", err)
 	}
 
 	client = common.NewClient(clientConfig)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// RunQuery Runs the query subcommand, which asks the server whether the
+// bettor with the given document won in the agency of the client. The client
+// is configured as it is to send its bets, but no bet is sent. Returns the
+// exit code of the program: 1 if the server could not answer, including
+// when the lottery was not drawn yet, and 2 on usage errors
+func RunQuery(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ContinueOnError)
+	dni := flags.Int("dni", -1, "document of the bettor")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: client query --dni <document>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dni < 0 || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	v, err := InitConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	if err := InitLogger(v.GetString("log.level")); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	config, err := LoadClientConfig(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+
+	numbers, err := common.NewClient(config).QueryBettor(*dni)
+	if errors.Is(err, common.ErrResultsNotReady) {
+		fmt.Printf("dni: %v | result: not ready\n", *dni)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("dni: %v | won: %v | numbers: %v\n", *dni, len(numbers) > 0, numbers)
+	return 0
+}
@@ -0,0 +1,35 @@
+import hashlib
+import hmac
+import logging
+import os
+from . import communication
+
+
+def load_secrets(path: str) -> dict[int, bytes]:
+    """
+    Load the secrets of the agencies from a file with one `agency=secret`
+    line per agency. Blank lines and lines starting with '#' are ignored
+    """
+    secrets = {}
+    with open(path) as file:
+        for line in file:
+            line = line.strip()
+            if not line or line.startswith('#'):
+                continue
+            agency, secret = line.split('=', 1)
+            secrets[int(agency)] = secret.strip().encode()
+    return secrets
+
+def new_nonce() -> bytes:
+    return os.urandom(communication.NONCE_LENGTH)
+
+def expected_response(secret: bytes, nonce: bytes, agency: int) -> bytes:
+    """
+    HMAC-SHA256 of the nonce followed by the agency, keyed with the secret
+    of the agency
+    """
+    message = nonce + agency.to_bytes(communication.AUTH_AGENCY_LENGTH_IN_BYTES, byteorder='big')
+    return hmac.new(secret, message, hashlib.sha256).digest()
+
+def verify_response(secret: bytes, nonce: bytes, agency: int, response: bytes) -> bool:
+    return hmac.compare_digest(expected_response(secret, nonce, agency), response)
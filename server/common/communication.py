@@ -1,10 +1,17 @@
 from curses.ascii import SI
+import base64
+import json
 import logging
+import select
 import socket
+import ssl
+import zlib
 from .utils import Bet
 
 SIZE_FIELD_LENGTH = 2      # Size of the length field in bytes
 TYPE_FIELD_LENGTH = 1      # Size of the type field in bytes
+CHECKSUM_LENGTH = 4        # Size of the CRC32 trailer in bytes
+SEQUENCE_LENGTH = 4        # Size of the batch sequence number in bytes
 NUMBER_LENGTH_IN_BYTES = 2 # Size of the number field in bytes
 AGENCY_LENGTH_IN_BYTES = 1 # Size of the agency field in bytes
 DNI_LENGTH_IN_BYTES = 4    # Size of the DNI field in bytes
@@ -12,16 +19,149 @@ YEAR_LENGTH_IN_BYTES = 2   # Size of the year field in bytes
 MONTH_LENGTH_IN_BYTES = 1  # Size of the month field in bytes
 DAY_LENGTH_IN_BYTES = 1    # Size of the day field in bytes
 
+# Handshake
+VERSION_LENGTH_IN_BYTES = 1      # Size of the protocol version field in bytes
+CAPABILITIES_LENGTH_IN_BYTES = 4 # Size of the capabilities bitmask in bytes
+SESSION_LENGTH_IN_BYTES = 4      # Size of the session of the batch sequence in bytes
+LEGACY_PROTOCOL_VERSION = 1      # Version spoken by clients that do not negotiate
+WIDE_FIELDS_PROTOCOL_VERSION = 2 # First version with wide agency and DNI fields
+PROTOCOL_VERSION = 2             # Highest version spoken by the server
+
+# Wide fields introduced in version 2
+AGENCY_LENGTH_IN_BYTES_V2 = 2 # Size of the agency field in bytes
+DNI_LENGTH_IN_BYTES_V2 = 8    # Size of the DNI field in bytes
+
+# Capabilities
+CAP_COMPRESSION = 1 << 0   # Bet batches may be compressed
+CAP_CHECKSUM = 1 << 1      # Frames carry a checksum
+CAP_PAGING = 1 << 2        # Results may be sent in pages
+CAP_PREFIXED_STRINGS = 1 << 3 # Name fields are length-prefixed instead of delimited
+CAP_SEQUENCE_NUMBERS = 1 << 4 # Bet batches and their confirmations carry a sequence number
+CAP_AUTHENTICATION = 1 << 5 # Agencies prove their identity answering a challenge
+CAP_HEARTBEAT = 1 << 6      # Either side may ping the other while the connection is idle
+CAP_DETAILED_RESULTS = 1 << 7 # Results carry the winning bets instead of their documents
+CAP_BETTOR_QUERY = 1 << 8     # Agencies may ask whether a bettor won by their document
+CAP_CORRECTIONS = 1 << 9      # Agencies may cancel or amend their bets before finishing
+CAP_PUSHED_RESULTS = 1 << 10  # Results are pushed to subscribed agencies once drawn instead of polled
+SUPPORTED_CAPABILITIES = CAP_PREFIXED_STRINGS | CAP_CHECKSUM | CAP_SEQUENCE_NUMBERS | CAP_COMPRESSION | CAP_AUTHENTICATION | CAP_HEARTBEAT | CAP_PAGING | CAP_DETAILED_RESULTS | CAP_BETTOR_QUERY | CAP_CORRECTIONS | CAP_PUSHED_RESULTS # Capabilities implemented by the server
+
+STRING_LENGTH_FIELD_LENGTH = 1 # Size of the length prefix of the name fields in bytes
+
+# Paged results
+MAX_FRAME_SIZE = (1 << 16) - 1    # Largest frame the size field can hold
+PAGE_INDEX_LENGTH_IN_BYTES = 4    # Size of the page index in bytes
+PAGE_FLAGS_LENGTH_IN_BYTES = 1    # Size of the page flags in bytes
+PAGE_FLAG_LAST = 1 << 0           # The page is the last one of the results
+
+# Authentication
+NONCE_LENGTH = 32              # Size of the challenge nonce in bytes
+AUTH_RESPONSE_LENGTH = 32      # Size of the HMAC-SHA256 answer in bytes
+AUTH_AGENCY_LENGTH_IN_BYTES = 4 # Size of the agency appended to the nonce before signing it
+
+# Compression
+UNCOMPRESSED_LENGTH_IN_BYTES = 4 # Size of the uncompressed length field in bytes
+MAX_UNCOMPRESSED_LENGTH = 1 << 20 # Largest uncompressed bet body accepted
+
 # Client Codes
 CONNECT_CODE = 10          # The code the client uses to connect to the server
 BET_MSG_CODE = 14          # The code the client uses to send a bet
+COMPRESSED_BET_MSG_CODE = 15 # The code the client uses to send a compressed bet
+QUERY_DNI_CODE = 16        # The code the client uses to ask whether a bettor won
+CANCEL_BET_CODE = 17       # The code the client uses to cancel a bet it sent
+AMEND_BET_CODE = 18        # The code the client uses to replace a bet it sent
+SUBSCRIBE_RESULTS_CODE = 19 # The code the client uses to have the results pushed once drawn
+AUTH_CODE = 13             # The code the client uses to answer the challenge
 FINISHED_CODE = 20         # The code the client uses to end betting
 CONSULT_CODE = 23          # The code the client uses to request the results
 
 # Server Codes
+CONNECT_ACK_CODE = 11      # The code the server uses to accept a connection
+CHALLENGE_CODE = 12        # The code the server uses to send the authentication nonce
 CONFIRMATION_CODE = 21     # The code the server uses to confirm a bet batch
 RESULTS_MSG_CODE = 22      # The code the server uses to send the results
+RESULTS_PAGE_CODE = 24     # The code the server uses to send a page of the results
 WAIT_MSG_CODE = 25          # The code the server uses to tell the client to wait
+NACK_CODE = 26             # The code the server uses to reject a corrupted bet batch
+AUTH_OK_CODE = 27          # The code the server uses to accept an authenticated agency
+AUTH_FAILED_CODE = 28      # The code the server uses to reject an agency that failed to authenticate
+ERROR_CODE = 29            # The code the server uses to report why it rejected a message
+
+# Codes used by both sides
+PING_CODE = 30             # The code either side uses to check that the other is alive
+PONG_CODE = 31             # The code either side uses to answer a ping
+
+# Server codes of the detailed results
+DETAILED_RESULTS_CODE = 32      # The code the server uses to send the winning bets
+DETAILED_RESULTS_PAGE_CODE = 33 # The code the server uses to send a page of the winning bets
+
+# Server codes of the bettor queries
+QUERY_RESULT_CODE = 34 # The code the server uses to answer whether a bettor won
+
+# Reasons of an error message
+ERROR_REASON_LENGTH_IN_BYTES = 1 # Size of the reason field in bytes
+ERROR_MALFORMED_BATCH = 1        # A bet batch could not be parsed
+ERROR_UNKNOWN_AGENCY = 2         # The agency is not one the server expects
+ERROR_BETTING_CLOSED = 3         # The agency already finished sending bets
+ERROR_RATE_LIMITED = 4           # The agency sent too many batches, it may retry later
+ERROR_BET_NOT_FOUND = 5          # The agency has no bet to cancel or amend with that number and document
+
+# Encodings
+ENCODING_BINARY = "binary" # Length-prefixed binary frames
+ENCODING_JSONL = "jsonl"   # One JSON object per line, meant for debugging
+MAX_LINE_LENGTH = 1 << 20  # Longest line accepted in the JSON lines encoding
+BINARY_CAPABILITIES = CAP_COMPRESSION | CAP_CHECKSUM | CAP_PREFIXED_STRINGS # Capabilities that only make sense in the binary encoding
+
+# Types of the messages in the JSON lines encoding, by message code
+JSON_MESSAGE_TYPES = {
+    CONNECT_CODE: "connect",
+    CONNECT_ACK_CODE: "connect_ack",
+    CHALLENGE_CODE: "challenge",
+    AUTH_CODE: "auth",
+    AUTH_OK_CODE: "auth_ok",
+    AUTH_FAILED_CODE: "auth_failed",
+    BET_MSG_CODE: "bets",
+    COMPRESSED_BET_MSG_CODE: "compressed_bets",
+    QUERY_DNI_CODE: "query_dni",
+    CANCEL_BET_CODE: "cancel_bet",
+    AMEND_BET_CODE: "amend_bet",
+    FINISHED_CODE: "finished",
+    CONSULT_CODE: "consult",
+    SUBSCRIBE_RESULTS_CODE: "subscribe_results",
+    CONFIRMATION_CODE: "confirmation",
+    NACK_CODE: "nack",
+    RESULTS_MSG_CODE: "results",
+    RESULTS_PAGE_CODE: "results_page",
+    DETAILED_RESULTS_CODE: "detailed_results",
+    DETAILED_RESULTS_PAGE_CODE: "detailed_results_page",
+    QUERY_RESULT_CODE: "query_result",
+    WAIT_MSG_CODE: "wait",
+    ERROR_CODE: "error",
+    PING_CODE: "ping",
+    PONG_CODE: "pong",
+}
+
+
+class Features():
+    """
+    Protocol version, capabilities and encoding agreed with a client
+    """
+    def __init__(self, version: int = LEGACY_PROTOCOL_VERSION, capabilities: int = 0, encoding: str = ENCODING_BINARY):
+        self.version = version
+        self.capabilities = capabilities
+        self.encoding = encoding
+
+    def has(self, capability: int) -> bool:
+        return self.capabilities & capability == capability
+
+    def agency_length(self) -> int:
+        if self.version >= WIDE_FIELDS_PROTOCOL_VERSION:
+            return AGENCY_LENGTH_IN_BYTES_V2
+        return AGENCY_LENGTH_IN_BYTES
+
+    def dni_length(self) -> int:
+        if self.version >= WIDE_FIELDS_PROTOCOL_VERSION:
+            return DNI_LENGTH_IN_BYTES_V2
+        return DNI_LENGTH_IN_BYTES
 
 
 class Message():
@@ -41,9 +181,36 @@ class Message():
     def is_consult_winners(self):
         return False
 
+    def is_subscribe_results(self):
+        return False
+
     def is_connect(self):
         return False
 
+    def is_corrupted(self):
+        return False
+
+    def is_auth(self):
+        return False
+
+    def is_malformed(self):
+        return False
+
+    def is_ping(self):
+        return False
+
+    def is_pong(self):
+        return False
+
+    def is_query_dni(self):
+        return False
+
+    def is_cancel_bet(self):
+        return False
+
+    def is_amend_bet(self):
+        return False
+
 class ConsultWinnersMessage(Message):
     def __init__(self, agency: int):
         self.agency_id = agency
@@ -51,10 +218,18 @@ class ConsultWinnersMessage(Message):
     def is_consult_winners(self):
         return True
 
+class SubscribeResultsMessage(Message):
+    def __init__(self, agency: int):
+        self.agency_id = agency
+
+    def is_subscribe_results(self):
+        return True
+
 class BetMessage(Message):
-    def __init__(self, agency: int, bets: list[Bet]):   
+    def __init__(self, agency: int, bets: list[Bet], sequence: int = None):   
         self.agency_id = agency
         self.bet_list = bets
+        self.sequence = sequence
 
     def is_bet(self):
         return True
@@ -70,19 +245,120 @@ class FinishedMessage(Message):
         return True
 
 class ConnectMessage(Message):
-    def __init__(self, agency: int):
+    def __init__(self, agency: int, version: int = LEGACY_PROTOCOL_VERSION, capabilities: int = 0, negotiates: bool = False, encoding: str = ENCODING_BINARY,
+                 session: int = 0):
         self.agency_id = agency
+        self.version = version
+        self.capabilities = capabilities
+        self.negotiates = negotiates
+        self.encoding = encoding
+        # Session the sequence numbers of the client belong to, zero if none
+        self.session = session
 
     def is_connect(self):
         return True
 
 
-def recv_message(sock: socket.socket) -> Message:
+class AuthMessage(Message):
+    def __init__(self, agency: int, response: bytes):
+        self.agency_id = agency
+        self.response = response
+
+    def is_auth(self):
+        return True
+
+
+class MalformedMessage(Message):
+    def __init__(self, agency: int, sequence: int, error: str):
+        self.agency_id = agency
+        self.sequence = sequence
+        self.error = error
+
+    def is_malformed(self):
+        return True
+
+
+class PingMessage(Message):
+    def __init__(self, agency: int):
+        self.agency_id = agency
+
+    def is_ping(self):
+        return True
+
+
+class PongMessage(Message):
+    def __init__(self, agency: int):
+        self.agency_id = agency
+
+    def is_pong(self):
+        return True
+
+
+class QueryDNIMessage(Message):
+    def __init__(self, agency: int, document: int):
+        self.agency_id = agency
+        self.document = document
+
+    def is_query_dni(self):
+        return True
+
+
+class CancelBetMessage(Message):
+    def __init__(self, agency: int, document: int, number: int, sequence: int = None):
+        self.agency_id = agency
+        self.document = document
+        self.number = number
+        self.sequence = sequence
+
+    def is_cancel_bet(self):
+        return True
+
+
+class AmendBetMessage(Message):
+    def __init__(self, agency: int, document: int, number: int, bet: Bet, sequence: int = None):
+        self.agency_id = agency
+        self.document = document
+        self.number = number
+        self.bet = bet
+        self.sequence = sequence
+
+    def is_amend_bet(self):
+        return True
+
+
+class CorruptedMessage(Message):
+    def __init__(self, agency: int, sequence: int = None):
+        self.agency_id = agency
+        self.sequence = sequence
+
+    def is_corrupted(self):
+        return True
+
+
+def recv_connect_message(sock: socket.socket) -> Message:
     """
-    Receive a message through a socket
+    Receive the first message of a connection through a socket. The encoding
+    the client speaks is told apart by its first byte, as a JSON object starts
+    with a brace and the connect frame is too short for its size to
     """
+    first_byte = sock.recv(1)
+    if not first_byte:
+        logging.error(f"action: receive_message | result: fail | error: Empty message received")
+        return None
+    if first_byte == b'{':
+        return _recv_json_message(sock, first_byte)
+    return recv_message(sock, Features(), first_byte)
 
-    msg = sock.recv(SIZE_FIELD_LENGTH)
+def recv_message(sock: socket.socket, features: Features = Features(), received: bytes = b'') -> Message:
+    """
+    Receive a message through a socket, decoding it with the features
+    agreed for the connection. The bytes of the message that were already
+    received may be given
+    """
+    if features.encoding == ENCODING_JSONL:
+        return _recv_json_message(sock)
+
+    msg = received + sock.recv(SIZE_FIELD_LENGTH - len(received))
     if not msg:
         logging.error(f"action: receive_message | result: fail | error: Empty message received")
         return None
@@ -94,26 +370,232 @@ def recv_message(sock: socket.socket) -> Message:
         return int.from_bytes(msg[:SIZE_FIELD_LENGTH], byteorder='big')
     
     while len(msg) < expected_length(msg):
-        msg += sock.recv(expected_length(msg) - len(msg))
+        chunk = sock.recv(expected_length(msg) - len(msg))
+        if not chunk:
+            logging.error(f"action: receive_message | result: fail | error: Connection closed mid message")
+            return None
+        msg += chunk
     
+    header_length = SIZE_FIELD_LENGTH + TYPE_FIELD_LENGTH + features.agency_length()
     message_type = int.from_bytes(msg[SIZE_FIELD_LENGTH:SIZE_FIELD_LENGTH+TYPE_FIELD_LENGTH], byteorder='big')
-    agency_id = int.from_bytes(msg[SIZE_FIELD_LENGTH+TYPE_FIELD_LENGTH:SIZE_FIELD_LENGTH+TYPE_FIELD_LENGTH+AGENCY_LENGTH_IN_BYTES], byteorder='big')
-
-    if message_type == BET_MSG_CODE:
-        bets = _bets_from_bytes(msg[SIZE_FIELD_LENGTH+TYPE_FIELD_LENGTH+AGENCY_LENGTH_IN_BYTES:], agency_id)
-        return BetMessage(agency_id, bets)
+    agency_id = int.from_bytes(msg[SIZE_FIELD_LENGTH+TYPE_FIELD_LENGTH:header_length], byteorder='big')
+
+    if features.has(CAP_CHECKSUM):
+        checksum = int.from_bytes(msg[-CHECKSUM_LENGTH:], byteorder='big')
+        msg = msg[:-CHECKSUM_LENGTH]
+        if zlib.crc32(msg) != checksum:
+            logging.error(f"action: receive_message | result: fail | error: Checksum mismatch | message: {msg.hex()}")
+            sequence = None
+            if features.has(CAP_SEQUENCE_NUMBERS):
+                sequence = int.from_bytes(msg[header_length:header_length+SEQUENCE_LENGTH], byteorder='big')
+            return CorruptedMessage(agency_id, sequence)
+
+    if message_type == BET_MSG_CODE or message_type == COMPRESSED_BET_MSG_CODE:
+        body = msg[header_length:]
+        sequence = None
+        if features.has(CAP_SEQUENCE_NUMBERS):
+            sequence = int.from_bytes(body[:SEQUENCE_LENGTH], byteorder='big')
+            body = body[SEQUENCE_LENGTH:]
+        if message_type == COMPRESSED_BET_MSG_CODE:
+            body = _decompress(body)
+            if body is None:
+                return CorruptedMessage(agency_id, sequence)
+        try:
+            bets = _bets_from_bytes(body, agency_id, features)
+        except ValueError as e:
+            logging.error(f"action: receive_message | result: fail | error: Malformed bet batch | detail: {e}")
+            return MalformedMessage(agency_id, sequence, str(e))
+        return BetMessage(agency_id, bets, sequence)
     elif message_type == FINISHED_CODE:
         return FinishedMessage(agency_id)
     elif message_type == CONSULT_CODE:
         return ConsultWinnersMessage(agency_id)
+    elif message_type == SUBSCRIBE_RESULTS_CODE:
+        return SubscribeResultsMessage(agency_id)
+    elif message_type == QUERY_DNI_CODE:
+        body = msg[header_length:]
+        if len(body) != features.dni_length():
+            logging.error(f"action: receive_message | result: fail | error: Malformed query | detail: body of {len(body)} bytes")
+            return MalformedMessage(agency_id, None, f"body of {len(body)} bytes, expected a dni of {features.dni_length()}")
+        document = int.from_bytes(body, byteorder='big')
+        return QueryDNIMessage(agency_id, document)
+    elif message_type == CANCEL_BET_CODE or message_type == AMEND_BET_CODE:
+        return _correction_from_bytes(message_type, msg[header_length:], agency_id, features)
     elif message_type == CONNECT_CODE:
-        return ConnectMessage(agency_id)
+        return _connect_from_bytes(msg[header_length:], agency_id)
+    elif message_type == AUTH_CODE:
+        return AuthMessage(agency_id, msg[header_length:])
+    elif message_type == PING_CODE:
+        return PingMessage(agency_id)
+    elif message_type == PONG_CODE:
+        return PongMessage(agency_id)
     else:
         logging.error(f"action: receive_message | result: fail | error: Unknown message received | message: {msg.hex()}")
         logging.error(f"Length: {expected_length(msg)}")
         return None
 
-def _bets_from_bytes(data: bytes, agency: int) -> list[Bet]:
+def _recv_json_message(sock: socket.socket, line: bytes = b'') -> Message:
+    """
+    Receive a message of the JSON lines encoding through a socket. The line
+    is read a byte at a time so nothing past it is consumed
+    """
+    while not line.endswith(b'\n'):
+        if len(line) > MAX_LINE_LENGTH:
+            logging.error(f"action: receive_message | result: fail | error: Line too long")
+            return None
+        byte = sock.recv(1)
+        if not byte:
+            logging.error(f"action: receive_message | result: fail | error: Connection closed mid line")
+            return None
+        line += byte
+
+    try:
+        fields = json.loads(line)
+    except ValueError as e:
+        logging.error(f"action: receive_message | result: fail | error: Invalid JSON message | detail: {e}")
+        return None
+    if not isinstance(fields, dict):
+        logging.error(f"action: receive_message | result: fail | error: Invalid JSON message | message: {line}")
+        return None
+    return _message_from_json(fields)
+
+def _message_from_json(fields: dict) -> Message:
+    message_type = fields.get("type")
+    agency_id = fields.get("agency", 0)
+    sequence = fields.get("sequence")
+
+    if message_type == "bets" or message_type == "compressed_bets":
+        try:
+            bets = [Bet(agency_id, bet["first_name"], bet["last_name"], str(bet["document"]), bet["birthdate"], bet["number"])
+                    for bet in fields.get("bets", [])]
+        except KeyError as e:
+            logging.error(f"action: receive_message | result: fail | error: Malformed bet batch | detail: missing field {e}")
+            return MalformedMessage(agency_id, sequence, f"missing field {e}")
+        except (TypeError, ValueError) as e:
+            logging.error(f"action: receive_message | result: fail | error: Malformed bet batch | detail: {e}")
+            return MalformedMessage(agency_id, sequence, str(e))
+        return BetMessage(agency_id, bets, sequence)
+    elif message_type == "finished":
+        return FinishedMessage(agency_id)
+    elif message_type == "consult":
+        return ConsultWinnersMessage(agency_id)
+    elif message_type == "subscribe_results":
+        return SubscribeResultsMessage(agency_id)
+    elif message_type == "query_dni":
+        document = fields.get("dni")
+        if type(document) is not int:
+            logging.error(f"action: receive_message | result: fail | error: Malformed query | message: {fields}")
+            return None
+        return QueryDNIMessage(agency_id, document)
+    elif message_type == "cancel_bet" or message_type == "amend_bet":
+        document, number = fields.get("dni"), fields.get("number")
+        if type(document) is not int or type(number) is not int:
+            logging.error(f"action: receive_message | result: fail | error: Malformed correction | message: {fields}")
+            return MalformedMessage(agency_id, sequence, "missing or invalid dni or number")
+        if message_type == "cancel_bet":
+            return CancelBetMessage(agency_id, document, number, sequence)
+        try:
+            bet = fields["bet"]
+            bet = Bet(agency_id, bet["first_name"], bet["last_name"], str(bet["document"]), bet["birthdate"], bet["number"])
+        except KeyError as e:
+            logging.error(f"action: receive_message | result: fail | error: Malformed correction | detail: missing field {e}")
+            return MalformedMessage(agency_id, sequence, f"missing field {e}")
+        except (TypeError, ValueError) as e:
+            logging.error(f"action: receive_message | result: fail | error: Malformed correction | detail: {e}")
+            return MalformedMessage(agency_id, sequence, str(e))
+        return AmendBetMessage(agency_id, document, number, bet, sequence)
+    elif message_type == "connect":
+        # Legacy clients send no version and do not expect an answer
+        return ConnectMessage(agency_id, fields.get("version", LEGACY_PROTOCOL_VERSION), fields.get("capabilities", 0),
+                              negotiates="version" in fields, encoding=ENCODING_JSONL, session=fields.get("session", 0))
+    elif message_type == "auth":
+        try:
+            response = base64.b64decode(fields.get("response", ""))
+        except ValueError:
+            response = b''
+        return AuthMessage(agency_id, response)
+    elif message_type == "ping":
+        return PingMessage(agency_id)
+    elif message_type == "pong":
+        return PongMessage(agency_id)
+    else:
+        logging.error(f"action: receive_message | result: fail | error: Unknown message received | message: {fields}")
+        return None
+
+def _connect_from_bytes(data: bytes, agency: int) -> ConnectMessage:
+    # Legacy clients send no body and do not expect an answer
+    if len(data) < VERSION_LENGTH_IN_BYTES + CAPABILITIES_LENGTH_IN_BYTES:
+        return ConnectMessage(agency)
+
+    version = int.from_bytes(data[:VERSION_LENGTH_IN_BYTES], byteorder='big')
+    i = VERSION_LENGTH_IN_BYTES
+    capabilities = int.from_bytes(data[i:i+CAPABILITIES_LENGTH_IN_BYTES], byteorder='big')
+    i += CAPABILITIES_LENGTH_IN_BYTES
+
+    # From version 2 on the agency is also carried in the body, optionally
+    # followed by the session of the sequence numbers
+    session = 0
+    if version >= WIDE_FIELDS_PROTOCOL_VERSION and len(data) >= i + AGENCY_LENGTH_IN_BYTES_V2:
+        agency = int.from_bytes(data[i:i+AGENCY_LENGTH_IN_BYTES_V2], byteorder='big')
+        i += AGENCY_LENGTH_IN_BYTES_V2
+        if len(data) >= i + SESSION_LENGTH_IN_BYTES:
+            session = int.from_bytes(data[i:i+SESSION_LENGTH_IN_BYTES], byteorder='big')
+    return ConnectMessage(agency, version, capabilities, negotiates=True, session=session)
+
+def _correction_from_bytes(message_type: int, data: bytes, agency: int, features: Features) -> Message:
+    """
+    Parse the body of a cancellation or an amendment, which identifies the bet
+    by its number and the document of the bettor. Amendments go on with the
+    bet that replaces it, laid out as in a bet batch
+    """
+    sequence = None
+    if features.has(CAP_SEQUENCE_NUMBERS):
+        sequence = int.from_bytes(data[:SEQUENCE_LENGTH], byteorder='big')
+        data = data[SEQUENCE_LENGTH:]
+    key_length = NUMBER_LENGTH_IN_BYTES + features.dni_length()
+    if len(data) < key_length:
+        logging.error(f"action: receive_message | result: fail | error: Malformed correction | detail: body of {len(data)} bytes")
+        return MalformedMessage(agency, sequence, f"body of {len(data)} bytes too short for a number and a dni")
+    number = int.from_bytes(data[:NUMBER_LENGTH_IN_BYTES], byteorder='big')
+    document = int.from_bytes(data[NUMBER_LENGTH_IN_BYTES:key_length], byteorder='big')
+    data = data[key_length:]
+
+    if message_type == CANCEL_BET_CODE:
+        if data:
+            return MalformedMessage(agency, sequence, f"{len(data)} bytes left after the bet to cancel")
+        return CancelBetMessage(agency, document, number, sequence)
+    try:
+        bets = _bets_from_bytes(data, agency, features)
+    except ValueError as e:
+        logging.error(f"action: receive_message | result: fail | error: Malformed correction | detail: {e}")
+        return MalformedMessage(agency, sequence, str(e))
+    if len(bets) != 1:
+        return MalformedMessage(agency, sequence, f"{len(bets)} bets to replace the amended one with, expected 1")
+    return AmendBetMessage(agency, document, number, bets[0], sequence)
+
+def _decompress(data: bytes) -> bytes:
+    """
+    Inflate a compressed bet body, which starts with its uncompressed length.
+    The length bounds the memory used, so bodies that inflate to more or less
+    bytes than announced are rejected
+    """
+    length = int.from_bytes(data[:UNCOMPRESSED_LENGTH_IN_BYTES], byteorder='big')
+    if len(data) < UNCOMPRESSED_LENGTH_IN_BYTES or length > MAX_UNCOMPRESSED_LENGTH:
+        logging.error(f"action: decompress | result: fail | error: Invalid uncompressed length | length: {length}")
+        return None
+
+    decompressor = zlib.decompressobj(-zlib.MAX_WBITS)
+    try:
+        body = decompressor.decompress(data[UNCOMPRESSED_LENGTH_IN_BYTES:], length)
+    except zlib.error as e:
+        logging.error(f"action: decompress | result: fail | error: {e}")
+        return None
+    if len(body) != length or decompressor.unconsumed_tail or not decompressor.eof:
+        logging.error(f"action: decompress | result: fail | error: Length mismatch | length: {length}")
+        return None
+    return body
+
+def _bets_from_bytes(data: bytes, agency: int, features: Features = Features()) -> list[Bet]:
     # packet_size = int.from_bytes(data[:1], byteorder='big')
     offset = 0
     bets = []
@@ -122,8 +604,8 @@ def _bets_from_bytes(data: bytes, agency: int) -> list[Bet]:
         i = offset
         chosen_number = int.from_bytes(data[i:i+NUMBER_LENGTH_IN_BYTES], byteorder='big')
         i += NUMBER_LENGTH_IN_BYTES
-        document = int.from_bytes(data[i:i+DNI_LENGTH_IN_BYTES], byteorder='big')
-        i += DNI_LENGTH_IN_BYTES
+        document = int.from_bytes(data[i:i+features.dni_length()], byteorder='big')
+        i += features.dni_length()
         birth_day = int.from_bytes(data[i:i+DAY_LENGTH_IN_BYTES], byteorder='big')
         i += DAY_LENGTH_IN_BYTES
         birth_month = int.from_bytes(data[i:i+MONTH_LENGTH_IN_BYTES], byteorder='big')
@@ -132,15 +614,27 @@ def _bets_from_bytes(data: bytes, agency: int) -> list[Bet]:
         i += YEAR_LENGTH_IN_BYTES    
 
         # Parse name and lastname and increment offset
-        first_delim = data.find(b'|', i)
-        second_delim = data.find(b'|', first_delim+1)
-        
-        if first_delim == -1 or second_delim == -1:
-            break
-        
-        decoded_string = data[i:second_delim].decode()
-        name, lastname = decoded_string.split('|')
-        offset = second_delim + 1
+        if features.has(CAP_PREFIXED_STRINGS):
+            fields = []
+            for _ in range(2):
+                length = int.from_bytes(data[i:i+STRING_LENGTH_FIELD_LENGTH], byteorder='big')
+                i += STRING_LENGTH_FIELD_LENGTH
+                if i + length > len(data):
+                    raise ValueError(f"name field of {length} bytes truncated at offset {i}")
+                fields.append(data[i:i+length].decode())
+                i += length
+            name, lastname = fields
+            offset = i
+        else:
+            first_delim = data.find(b'|', i)
+            second_delim = data.find(b'|', first_delim+1)
+
+            if first_delim == -1 or second_delim == -1:
+                raise ValueError(f"unterminated name fields at offset {i}")
+
+            decoded_string = data[i:second_delim].decode()
+            name, lastname = decoded_string.split('|')
+            offset = second_delim + 1
 
         # Format birthdate
         if birth_day < 10:
@@ -172,39 +666,241 @@ def recv_bet_batch(sock: socket.socket) ->  list[Bet]:
 
     return _bets_from_bytes(msg.rstrip())
 
-def send_winners(sock: socket.socket, winners_documents: list[str]) -> None:
+def send_winners(sock: socket.socket, winners_documents: list[str], features: Features = Features(), page_size: int = 0) -> None:
     """
-    Send the winners through a socket
+    Send the winners through a socket. If paging was agreed they are sent in
+    pages of at most page_size winners, or of as many as fit in a frame if
+    page_size is zero or too large
     """
+    if features.has(CAP_PAGING):
+        _send_winner_pages(sock, winners_documents, features, page_size)
+        return
 
-    encoded_winners_list = list(map(lambda x: int(x).to_bytes(DNI_LENGTH_IN_BYTES, byteorder='big'), winners_documents))
+    encoded_winners_list = list(map(lambda x: int(x).to_bytes(features.dni_length(), byteorder='big'), winners_documents))
     encoded_winners = b''.join(encoded_winners_list)
-    winners_message = RESULTS_MSG_CODE.to_bytes(1, byteorder='big') + encoded_winners
-    _send_aux(sock, winners_message)
+    _send(sock, features, RESULTS_MSG_CODE, encoded_winners, {"winners": [int(x) for x in winners_documents]})
+
+def max_winners_per_page(features: Features) -> int:
+    """
+    Return how many winners fit in a page of the results
+    """
+    return _max_page_body_length(features) // features.dni_length()
+
+def _max_page_body_length(features: Features) -> int:
+    overhead = SIZE_FIELD_LENGTH + TYPE_FIELD_LENGTH + PAGE_INDEX_LENGTH_IN_BYTES + PAGE_FLAGS_LENGTH_IN_BYTES + 1
+    if features.has(CAP_CHECKSUM):
+        overhead += CHECKSUM_LENGTH
+    return MAX_FRAME_SIZE - overhead
+
+def _send_winner_pages(sock: socket.socket, winners_documents: list[str], features: Features, page_size: int) -> None:
+    if page_size <= 0 or page_size > max_winners_per_page(features):
+        page_size = max_winners_per_page(features)
+
+    # Results without winners still take a page
+    starts = range(0, max(len(winners_documents), 1), page_size)
+    for index, start in enumerate(starts):
+        send_results_page(sock, features, index, index == len(starts) - 1, winners_documents[start:start+page_size])
+
+def send_results_page(sock: socket.socket, features: Features, index: int, last: bool, winners_documents: list[str]) -> None:
+    """
+    Send a page of the winners through a socket, flagging whether it is the
+    last one
+    """
+    page_body = index.to_bytes(PAGE_INDEX_LENGTH_IN_BYTES, byteorder='big')
+    page_body += (PAGE_FLAG_LAST if last else 0).to_bytes(PAGE_FLAGS_LENGTH_IN_BYTES, byteorder='big')
+    page_body += b''.join(int(x).to_bytes(features.dni_length(), byteorder='big') for x in winners_documents)
+    _send(sock, features, RESULTS_PAGE_CODE, page_body, {"index": index, "last": last, "winners": [int(x) for x in winners_documents]})
 
-def send_confirmation(sock: socket.socket) -> None:
+def send_winning_bets(sock: socket.socket, bets: list[Bet], features: Features, page_size: int = 0) -> None:
+    """
+    Send the winning bets through a socket, if detailed results were agreed.
+    If paging was agreed they are sent in pages of at most page_size bets
+    that fit in a frame, or of as many as fit if page_size is zero
+    """
+    if not features.has(CAP_PAGING):
+        body = b''.join(_bet_to_bytes(bet, features) for bet in bets)
+        _send(sock, features, DETAILED_RESULTS_CODE, body, {"bets": [_bet_fields(bet) for bet in bets]})
+        return
+
+    # Results without winners still take a page
+    pages = [[]]
+    page_length = 0
+    for bet in bets:
+        bet_length = len(_bet_to_bytes(bet, features))
+        page_full = page_size > 0 and len(pages[-1]) >= page_size
+        if pages[-1] and (page_full or page_length + bet_length > _max_page_body_length(features)):
+            pages.append([])
+            page_length = 0
+        pages[-1].append(bet)
+        page_length += bet_length
+    for index, page in enumerate(pages):
+        send_detailed_results_page(sock, features, index, index == len(pages) - 1, page)
+
+def send_detailed_results_page(sock: socket.socket, features: Features, index: int, last: bool, bets: list[Bet]) -> None:
+    """
+    Send a page of the winning bets through a socket, flagging whether it is
+    the last one
+    """
+    page_body = index.to_bytes(PAGE_INDEX_LENGTH_IN_BYTES, byteorder='big')
+    page_body += (PAGE_FLAG_LAST if last else 0).to_bytes(PAGE_FLAGS_LENGTH_IN_BYTES, byteorder='big')
+    page_body += b''.join(_bet_to_bytes(bet, features) for bet in bets)
+    _send(sock, features, DETAILED_RESULTS_PAGE_CODE, page_body,
+          {"index": index, "last": last, "bets": [_bet_fields(bet) for bet in bets]})
+
+def _bet_to_bytes(bet: Bet, features: Features) -> bytes:
+    """
+    Serialize a bet with the layout of the bet batches, without its agency
+    """
+    data = bet.number.to_bytes(NUMBER_LENGTH_IN_BYTES, byteorder='big')
+    data += int(bet.document).to_bytes(features.dni_length(), byteorder='big')
+    data += bet.birthdate.day.to_bytes(DAY_LENGTH_IN_BYTES, byteorder='big')
+    data += bet.birthdate.month.to_bytes(MONTH_LENGTH_IN_BYTES, byteorder='big')
+    data += bet.birthdate.year.to_bytes(YEAR_LENGTH_IN_BYTES, byteorder='big')
+    for field in (bet.first_name.encode(), bet.last_name.encode()):
+        if features.has(CAP_PREFIXED_STRINGS):
+            data += len(field).to_bytes(STRING_LENGTH_FIELD_LENGTH, byteorder='big') + field
+        else:
+            data += field + b'|'
+    return data
+
+def _bet_fields(bet: Bet) -> dict:
+    """
+    Return the fields of a bet in the JSON lines encoding
+    """
+    return {
+        "agency": bet.agency,
+        "first_name": bet.first_name,
+        "last_name": bet.last_name,
+        "document": int(bet.document),
+        "birthdate": bet.birthdate.isoformat(),
+        "number": bet.number,
+    }
+
+def send_query_result(sock: socket.socket, features: Features, document: int, numbers: list[int]) -> None:
     """
-    Send a confirmation message through a socket
+    Send through a socket the numbers of the winning bets of the bettor with
+    the given document, which are none if the bettor did not win
     """
-    confirmation_message = CONFIRMATION_CODE.to_bytes(1, byteorder='big')
-    _send_aux(sock, confirmation_message)
+    body = document.to_bytes(features.dni_length(), byteorder='big')
+    body += b''.join(number.to_bytes(NUMBER_LENGTH_IN_BYTES, byteorder='big') for number in numbers)
+    _send(sock, features, QUERY_RESULT_CODE, body, {"dni": document, "numbers": numbers})
+
+def send_connect_ack(sock: socket.socket, version: int, capabilities: int, encoding: str = ENCODING_BINARY) -> None:
+    """
+    Send the agreed protocol version and capabilities through a socket, in
+    the encoding of the connect message
+    """
+    ack_body = version.to_bytes(VERSION_LENGTH_IN_BYTES, byteorder='big')
+    ack_body += capabilities.to_bytes(CAPABILITIES_LENGTH_IN_BYTES, byteorder='big')
+    _send(sock, Features(encoding=encoding), CONNECT_ACK_CODE, ack_body, {"version": version, "capabilities": capabilities})
+
+def send_challenge(sock: socket.socket, features: Features, nonce: bytes) -> None:
+    """
+    Send the nonce the agency must sign to authenticate through a socket
+    """
+    _send(sock, features, CHALLENGE_CODE, nonce, {"nonce": base64.b64encode(nonce).decode()})
+
+def send_auth_ok(sock: socket.socket, features: Features) -> None:
+    """
+    Send a message accepting an authenticated agency through a socket
+    """
+    _send(sock, features, AUTH_OK_CODE)
+
+def send_auth_failed(sock: socket.socket, features: Features = Features()) -> None:
+    """
+    Send a message rejecting an agency that failed to authenticate through a socket
+    """
+    _send(sock, features, AUTH_FAILED_CODE)
+
+def send_error(sock: socket.socket, features: Features, reason: int, description: str) -> None:
+    """
+    Send an error message with its reason and a description through a socket
+    """
+    error_body = reason.to_bytes(ERROR_REASON_LENGTH_IN_BYTES, byteorder='big')
+    error_body += description.encode()
+    _send(sock, features, ERROR_CODE, error_body, {"reason": reason, "description": description})
+
+def _encode_sequence(sequence: int, features: Features) -> bytes:
+    if not features.has(CAP_SEQUENCE_NUMBERS) or sequence is None:
+        return b''
+    return sequence.to_bytes(SEQUENCE_LENGTH, byteorder='big')
+
+def _sequence_fields(sequence: int, features: Features) -> dict:
+    if not features.has(CAP_SEQUENCE_NUMBERS) or sequence is None:
+        return {}
+    return {"sequence": sequence}
+
+def send_confirmation(sock: socket.socket, features: Features = Features(), sequence: int = None) -> None:
+    """
+    Send a confirmation message through a socket, echoing the sequence
+    number of the confirmed batch if sequence numbers were agreed
+    """
+    _send(sock, features, CONFIRMATION_CODE, _encode_sequence(sequence, features), _sequence_fields(sequence, features))
+
+def send_nack(sock: socket.socket, features: Features = Features(), sequence: int = None) -> None:
+    """
+    Send a message rejecting a corrupted bet batch through a socket, echoing
+    its sequence number if sequence numbers were agreed
+    """
+    _send(sock, features, NACK_CODE, _encode_sequence(sequence, features), _sequence_fields(sequence, features))
     
-def send_wait(sock: socket.socket) -> None:
+def send_wait(sock: socket.socket, features: Features = Features()) -> None:
     """
     Send a wait message through a socket
     """
-    wait_message = WAIT_MSG_CODE.to_bytes(1, byteorder='big')
-    _send_aux(sock, wait_message)
+    _send(sock, features, WAIT_MSG_CODE)
 
-def _send_aux(sock: socket.socket, message: bytes) -> None:
+def send_ping(sock: socket.socket, features: Features) -> None:
     """
-    Send a message through a socket guaranteeing that all the bytes are sent
+    Send a ping to check that the agency is alive through a socket
     """
-    total_bytes_sent = 0
-    message += b'\n'
-    bytes_to_send = len(message) + SIZE_FIELD_LENGTH
+    _send(sock, features, PING_CODE)
+
+def send_pong(sock: socket.socket, features: Features) -> None:
+    """
+    Send an answer to a ping of the agency through a socket
+    """
+    _send(sock, features, PONG_CODE)
+
+def has_pending_data(sock: socket.socket) -> bool:
+    """
+    Return whether a read on the socket would not block. Data already
+    decrypted by a TLS socket is not seen by select, so it is checked first
+    """
+    if isinstance(sock, ssl.SSLSocket) and sock.pending():
+        return True
+    readable, _, _ = select.select([sock], [], [], 0)
+    return bool(readable)
+
+def _send(sock: socket.socket, features: Features, code: int, body: bytes = b'', fields: dict = {}) -> None:
+    """
+    Send a message through a socket in the encoding agreed for the
+    connection, either as a frame with the code and the binary body or as a
+    line with the type and the fields of the message
+    """
+    if features.encoding == ENCODING_JSONL:
+        line = json.dumps({"type": JSON_MESSAGE_TYPES[code], **fields}) + "\n"
+        _send_all(sock, line.encode())
+        return
+    _send_aux(sock, code.to_bytes(1, byteorder='big') + body, features)
+
+def _send_aux(sock: socket.socket, message: bytes, features: Features = Features()) -> None:
+    """
+    Send a message through a socket guaranteeing that all the bytes are sent.
+    If checksums were agreed, the CRC32 of the packet is added before the
+    terminator
+    """
+    bytes_to_send = len(message) + SIZE_FIELD_LENGTH + 1
+    if features.has(CAP_CHECKSUM):
+        bytes_to_send += CHECKSUM_LENGTH
     packet = bytes_to_send.to_bytes(SIZE_FIELD_LENGTH, byteorder='big') + message
+    if features.has(CAP_CHECKSUM):
+        packet += zlib.crc32(packet).to_bytes(CHECKSUM_LENGTH, byteorder='big')
+    packet += b'\n'
+    _send_all(sock, packet)
 
+def _send_all(sock: socket.socket, packet: bytes) -> None:
+    total_bytes_sent = 0
     while total_bytes_sent < len(packet):
         bytes_sent = sock.send(packet[total_bytes_sent:])
         total_bytes_sent += bytes_sent
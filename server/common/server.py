@@ -1,28 +1,61 @@
 import os
 import socket
+import ssl
 import logging
 import errno
 import threading
+import time
+from . import auth
 from . import communication
 from .utils import *
 
 class Server:
-    def __init__(self, port, listen_backlog):
-        # Initialize server socket
-        self._server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
-        self._server_socket.bind(('', port))
+    def __init__(self, port, listen_backlog, ssl_context=None, secrets=None, agencies=None, max_batches_per_second=0,
+                 heartbeat_interval=0, max_missed_pongs=3, unix_socket=None, results_page_size=0):
+        # Initialize server socket, on a unix domain socket instead of the
+        # port if one is given. A leading @ stands for the abstract namespace
+        self._unix_socket = unix_socket
+        if unix_socket:
+            self._server_socket = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+            if unix_socket.startswith('@'):
+                self._server_socket.bind('\0' + unix_socket[1:])
+            else:
+                if os.path.exists(unix_socket):
+                    os.unlink(unix_socket)
+                self._server_socket.bind(unix_socket)
+        else:
+            self._server_socket = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+            self._server_socket.bind(('', port))
         self._server_socket.listen(listen_backlog)
+        # Registered connections are tracked by agency and address, since an
+        # agency may open side connections to query or correct its bets
         self.registed_connections = {}
         self.unregistered_connections = {}
         self.handles = []
         self._terminated = False
         self._clients_finished = {}
         self._winning_bets_list = []
-        for i in range(1,2):
+        # Sequence numbers of the bet batches and of the corrections applied,
+        # by agency and session
+        self._applied_sequences = {}
+        self._applied_corrections = {}
+        # Without a number of agencies any agency is accepted
+        self._agencies = agencies
+        for i in range(1, (agencies or 1) + 1):
             self._clients_finished[i] = False
+        self._max_batches_per_second = max_batches_per_second
+        self._batch_times = {}
+        self._batch_times_lock = threading.Lock()
         self._results_condition = threading.Condition()
         self._bets_lock = threading.Lock()
         self._connections_lock = threading.Lock()
+        self._ssl_context = ssl_context
+        self._secrets = secrets
+        # Agencies waiting for the results are pinged every interval seconds
+        self._heartbeat_interval = heartbeat_interval
+        self._max_missed_pongs = max_missed_pongs
+        # Winners sent in each page of the results, zero for as many as fit
+        self._results_page_size = results_page_size
 
 
     def run(self):
@@ -50,6 +83,8 @@ class Server:
                     raise e
 
         self._server_socket.close()
+        if self._unix_socket and not self._unix_socket.startswith('@') and os.path.exists(self._unix_socket):
+            os.unlink(self._unix_socket)
         
         logging.info('action: stop_server | result: finishing')
 
@@ -80,20 +115,83 @@ class Server:
     def __handle_new_connection(self, sock, addr):
         self.unregistered_connections[addr] = sock
 
-        message = communication.recv_message(sock)
+        # The TLS handshake runs on the connection thread so a slow or
+        # misbehaving client does not block the accept loop
+        if self._ssl_context:
+            try:
+                sock = self._ssl_context.wrap_socket(sock, server_side=True)
+            except (ssl.SSLError, OSError) as e:
+                logging.info(f"action: tls_handshake | result: failure | ip: {addr[0]} | error: {e}")
+                self.unregistered_connections.pop(addr).close()
+                return
+            self.unregistered_connections[addr] = sock
+
+        message = communication.recv_connect_message(sock)
         if not message or not message.is_connect():
             logging.info(f"action: connect | result: failure | ip: {addr[0]}")
             sock.close()
             return
 
         agency = message.agency()
+        features = communication.Features(encoding=message.encoding)
+        if message.negotiates:
+            version = min(message.version, communication.PROTOCOL_VERSION)
+            capabilities = message.capabilities & communication.SUPPORTED_CAPABILITIES
+            if self._secrets is None:
+                capabilities &= ~communication.CAP_AUTHENTICATION
+            if not self._heartbeat_interval:
+                capabilities &= ~communication.CAP_HEARTBEAT
+            if message.encoding == communication.ENCODING_JSONL:
+                capabilities &= ~communication.BINARY_CAPABILITIES
+            features = communication.Features(version, capabilities, message.encoding)
+            communication.send_connect_ack(sock, version, capabilities, message.encoding)
+            logging.info(f"action: negotiate | result: success | agency: {agency} | version: {version} | capabilities: {capabilities} | encoding: {message.encoding}")
+
+        if self._agencies is not None and not 1 <= agency <= self._agencies:
+            communication.send_error(sock, features, communication.ERROR_UNKNOWN_AGENCY, f"unknown agency {agency}")
+            logging.info(f"action: connect | result: failure | ip: {addr[0]} | agency: {agency} | error: unknown agency")
+            self.unregistered_connections.pop(addr, None)
+            sock.close()
+            return
+
+        # Bets are only accepted from the agency once it is authenticated
+        if not self.__authenticate(sock, agency, features):
+            logging.info(f"action: authenticate | result: failure | ip: {addr[0]} | agency: {agency}")
+            self.unregistered_connections.pop(addr, None)
+            sock.close()
+            return
+
         with self._connections_lock:
-            self.registed_connections[agency] = self.unregistered_connections.pop(addr)
+            self.registed_connections[(agency, addr)] = self.unregistered_connections.pop(addr)
         logging.info(f"action: connect | result: success | ip: {addr[0]} | agency: {agency}")
-        self.__handle_client_connection(sock, agency)
+        self.__handle_client_connection(sock, addr, agency, features, message.session)
+
+
+    def __authenticate(self, sock, agency, features) -> bool:
+        """
+        Challenge the agency to sign a nonce with its secret. Agencies are
+        only challenged if the server was given secrets, and in that case the
+        ones that did not agree on authenticating are rejected
+        """
+        if self._secrets is None:
+            return True
+
+        secret = self._secrets.get(agency)
+        if secret is None or not features.has(communication.CAP_AUTHENTICATION):
+            communication.send_auth_failed(sock, features)
+            return False
 
+        nonce = auth.new_nonce()
+        communication.send_challenge(sock, features, nonce)
+        message = communication.recv_message(sock, features)
+        if not message or not message.is_auth() or not auth.verify_response(secret, nonce, agency, message.response):
+            communication.send_auth_failed(sock, features)
+            return False
 
-    def __handle_client_connection(self, sock, agency):
+        communication.send_auth_ok(sock, features)
+        return True
+
+    def __handle_client_connection(self, sock, addr, agency, features, session):
         """
         Read message from a specific client socket and closes the socket
 
@@ -104,34 +202,107 @@ class Server:
         results_sent = False
         while not self._terminated and not results_sent:
             try:
-                message: communication.Message = communication.recv_message(sock)
+                message: communication.Message = communication.recv_message(sock, features)
                 if not message:
-                    logging.info(f"action: recv message | result: failure | agency: {agency} | error: {e}")
+                    logging.info(f"action: recv message | result: failure | agency: {agency} | error: connection closed")
                     break
-                results_sent = self.__process_message(message)
+                results_sent = self.__process_message(sock, message, features, session)
             except OSError as e:
                 if not self._terminated:
                     logging.error(f"action: recv message | result: failure | agency: {agency} | error: {e}")
                 break
 
         with self._connections_lock:
-            self.registed_connections[agency].close()
-            del self.registed_connections[agency]
+            sock.close()
+            self.registed_connections.pop((agency, addr), None)
         logging.info(f"action: stop thread | result: success | agency: {agency}")
 
-    def __process_message(self, message: communication.Message):
+    def __process_message(self, sock, message: communication.Message, features: communication.Features, session: int):
+        # Heartbeat messages
+        if message.is_ping():
+            communication.send_pong(sock, features)
+            return False
+        if message.is_pong():
+            return False
+
+        # Corrupted message
+        if message.is_corrupted():
+            communication.send_nack(sock, features, message.sequence)
+            logging.info(f"action: batch_apuestas_rechazado | agency: {message.agency()} | result: success")
+            return False
+
+        # Malformed message
+        if message.is_malformed():
+            communication.send_error(sock, features, communication.ERROR_MALFORMED_BATCH, message.error)
+            logging.info(f"action: batch_apuestas_malformado | agency: {message.agency()} | result: success | error: {message.error}")
+            return False
+
         # Bet message
         if message.is_bet():
             logging.debug(f"action: processing_message | agency: {message.agency()} | result: in_progress | type: bet")
+            if self._clients_finished.get(message.agency(), False):
+                communication.send_error(sock, features, communication.ERROR_BETTING_CLOSED, "agency already finished sending bets")
+                logging.info(f"action: batch_apuestas_rechazado | agency: {message.agency()} | result: success | error: betting closed")
+                return False
+            if self.__rate_limited(message.agency()):
+                communication.send_error(sock, features, communication.ERROR_RATE_LIMITED, "too many bet batches, retry later")
+                logging.info(f"action: batch_apuestas_rechazado | agency: {message.agency()} | result: success | error: rate limited")
+                return False
             bets = message.bets()
             with self._bets_lock:
+                # A batch with an already applied sequence number is a retransmission.
+                # Batches may arrive out of order, so every applied number is kept.
+                # Numbers start again on each session of the agency
+                applied_sequences = self._applied_sequences.setdefault((message.agency(), session), set())
+                if message.sequence is not None and message.sequence in applied_sequences:
+                    communication.send_confirmation(sock, features, message.sequence)
+                    logging.info(
+                        f"action: batch_apuestas_duplicado | agency: {message.agency()} | result: success | sequence: {message.sequence}"
+                    )
+                    return False
                 store_bets(bets)
-            communication.send_confirmation(self.registed_connections[message.agency()])
+                if message.sequence is not None:
+                    applied_sequences.add(message.sequence)
+            communication.send_confirmation(sock, features, message.sequence)
             logging.info(
                 f"action: batch_apuestas_almacenado | agency: {message.agency()} | result: success | cantidad: {len(bets)}"
             )
             return False
 
+        # Cancel or amend bet message
+        elif message.is_cancel_bet() or message.is_amend_bet():
+            action = "apuesta_cancelada" if message.is_cancel_bet() else "apuesta_corregida"
+            logging.debug(f"action: processing_message | agency: {message.agency()} | result: in_progress | type: {action}")
+            if self._clients_finished.get(message.agency(), False):
+                communication.send_error(sock, features, communication.ERROR_BETTING_CLOSED, "agency already finished sending bets")
+                logging.info(f"action: {action} | agency: {message.agency()} | result: fail | error: betting closed")
+                return False
+            if self.__rate_limited(message.agency()):
+                communication.send_error(sock, features, communication.ERROR_RATE_LIMITED, "too many bet batches, retry later")
+                logging.info(f"action: {action} | agency: {message.agency()} | result: fail | error: rate limited")
+                return False
+            replacement = message.bet if message.is_amend_bet() else None
+            with self._bets_lock:
+                # A retransmission of an applied correction is confirmed again.
+                # Corrections may be sent by a process of their own, so they
+                # are told apart from the bet batches numbered the same
+                applied_corrections = self._applied_corrections.setdefault((message.agency(), session), set())
+                if message.sequence is not None and message.sequence in applied_corrections:
+                    communication.send_confirmation(sock, features, message.sequence)
+                    logging.info(f"action: apuesta_duplicada | agency: {message.agency()} | result: success | sequence: {message.sequence}")
+                    return False
+                found = replace_bet(message.agency(), message.document, message.number, replacement)
+                if found and message.sequence is not None:
+                    applied_corrections.add(message.sequence)
+            if not found:
+                communication.send_error(sock, features, communication.ERROR_BET_NOT_FOUND,
+                                         f"no bet with number {message.number} and document {message.document}")
+                logging.info(f"action: {action} | agency: {message.agency()} | result: fail | dni: {message.document} | numero: {message.number} | error: bet not found")
+                return False
+            communication.send_confirmation(sock, features, message.sequence)
+            logging.info(f"action: {action} | agency: {message.agency()} | result: success | dni: {message.document} | numero: {message.number}")
+            return False
+
         # Finished message
         elif message.is_finished():
             logging.debug(f"action: processing_message | agency: {message.agency()} | result: in_progress | type: finished")
@@ -145,24 +316,108 @@ class Server:
                 ) 
             return False
 
-        # Consult winners message
-        elif message.is_consult_winners():
-            logging.debug(f"action: processing_message | agency: {message.agency()} | result: in_progress | type: consult_winners")
+        # Consult winners or subscribe to results message. Subscriptions are
+        # held until the draw, while consults are told to wait and poll again
+        elif message.is_consult_winners() or message.is_subscribe_results():
+            request = "consult_winners" if message.is_consult_winners() else "subscribe_results"
+            logging.debug(f"action: processing_message | agency: {message.agency()} | result: in_progress | type: {request}")
+            if not self.__results_ready() and message.is_consult_winners():
+                communication.send_wait(sock, features)
+                logging.info(f"action: wait for winners | agency: {message.agency()} | result: wait")
+                return False
             if not self.__results_ready():
-                with self._results_condition:
-                    logging.info(f"action: wait for winners | agency: {message.agency()} | result: in_progress")
-                    self._results_condition.wait()
-                    if self._terminated:
-                        return False
-    
-            winning_bets = self._winning_bets()
-            winning_documents_for_agency = [bet.document for bet in winning_bets if bet.agency == message.agency()]
-            communication.send_winners(self.registed_connections[message.agency()], winning_documents_for_agency)
+                logging.info(f"action: wait for winners | agency: {message.agency()} | result: in_progress")
+                if not self.__wait_results(sock, message.agency(), features):
+                    # Either the server is stopping or the agency is gone
+                    return True
+
+            winning_bets_for_agency = [bet for bet in self._winning_bets() if bet.agency == message.agency()]
+            if features.has(communication.CAP_DETAILED_RESULTS):
+                communication.send_winning_bets(sock, winning_bets_for_agency, features, self._results_page_size)
+            else:
+                winning_documents_for_agency = [bet.document for bet in winning_bets_for_agency]
+                communication.send_winners(sock, winning_documents_for_agency, features, self._results_page_size)
             logging.info(
-                f"action: winners_sent | agency: {message.agency()} | result: success | cantidad: {len(winning_documents_for_agency)}"
+                f"action: winners_sent | agency: {message.agency()} | result: success | cantidad: {len(winning_bets_for_agency)}"
             )
             return True
 
+        # Query by document message
+        elif message.is_query_dni():
+            logging.debug(f"action: processing_message | agency: {message.agency()} | result: in_progress | type: query_dni")
+            if not self.__results_ready():
+                communication.send_wait(sock, features)
+                logging.info(f"action: consulta_dni | agency: {message.agency()} | result: wait | dni: {message.document}")
+                return False
+
+            numbers = [bet.number for bet in self._winning_bets()
+                       if bet.agency == message.agency() and int(bet.document) == message.document]
+            communication.send_query_result(sock, features, message.document, numbers)
+            logging.info(
+                f"action: consulta_dni | agency: {message.agency()} | result: success | dni: {message.document} | ganador: {bool(numbers)}"
+            )
+            return False
+
+    def __wait_results(self, sock, agency, features) -> bool:
+        """
+        Block until the results are ready and return whether they are. If
+        heartbeats were agreed the agency is pinged every interval meanwhile,
+        its pings are answered and it is given up on once too many pings in
+        a row go unanswered
+        """
+        heartbeat = features.has(communication.CAP_HEARTBEAT)
+        timeout = self._heartbeat_interval if heartbeat else None
+        unanswered_pings = 0
+        while not self._terminated:
+            with self._results_condition:
+                if self._results_condition.wait_for(lambda: self._terminated or self.__results_ready(), timeout):
+                    return not self._terminated
+            if self.__read_heartbeats(sock, agency, features):
+                unanswered_pings = 0
+            if unanswered_pings >= self._max_missed_pongs:
+                logging.info(f"action: heartbeat | result: failure | agency: {agency} | missed_pongs: {unanswered_pings}")
+                return False
+            communication.send_ping(sock, features)
+            unanswered_pings += 1
+        return False
+
+    def __read_heartbeats(self, sock, agency, features) -> bool:
+        """
+        Handle the messages the agency sent while waiting for the results
+        without blocking, and return whether it answered a ping. A closed
+        connection raises OSError so the thread ends
+        """
+        ponged = False
+        while communication.has_pending_data(sock):
+            message = communication.recv_message(sock, features)
+            if not message:
+                raise ConnectionResetError("connection closed by the agency")
+            if message.is_ping():
+                communication.send_pong(sock, features)
+            elif message.is_pong():
+                ponged = True
+            else:
+                logging.debug(f"action: heartbeat | result: ignored | agency: {agency} | message: {type(message).__name__}")
+        return ponged
+
+    def __rate_limited(self, agency) -> bool:
+        """
+        Record a bet batch of the agency and return whether it exceeds the
+        batches allowed in the last second
+        """
+        if not self._max_batches_per_second:
+            return False
+        # Connections of the same agency may send batches concurrently
+        with self._batch_times_lock:
+            now = time.monotonic()
+            times = [t for t in self._batch_times.get(agency, []) if now - t < 1]
+            if len(times) >= self._max_batches_per_second:
+                self._batch_times[agency] = times
+                return True
+            times.append(now)
+            self._batch_times[agency] = times
+            return False
+
     def __accept_new_connection(self):
         """
         Accept new connections
@@ -174,6 +429,10 @@ class Server:
         # Connection arrived
         logging.info('action: accept_connections | result: in_progress')
         c, addr = self._server_socket.accept()
+        if self._unix_socket:
+            # Peers of a unix domain socket have no address, so they are told
+            # apart by their file descriptor
+            addr = (f"unix:{self._unix_socket}", c.fileno())
         logging.info(f'action: accept_connections | result: success | ip: {addr[0]}')
         return c, addr
 
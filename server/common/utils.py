@@ -1,5 +1,6 @@
 import csv
 import datetime
+import os
 import time
 
 
@@ -36,8 +37,36 @@ def store_bets(bets: list[Bet]) -> None:
     with open(STORAGE_FILEPATH, 'a+') as file:
         writer = csv.writer(file, quoting=csv.QUOTE_MINIMAL)
         for bet in bets:
-            writer.writerow([bet.agency, bet.first_name, bet.last_name,
-                             bet.document, bet.birthdate, bet.number])
+            writer.writerow(_bet_row(bet))
+
+"""
+Replace the first bet of the agency with the given document and number in
+the STORAGE_FILEPATH file with replacement, or remove it if replacement is
+None. The file is rewritten as a whole and swapped for the old one, so it is
+never left half written. Returns whether such a bet was found.
+Not thread-safe/process-safe.
+"""
+def replace_bet(agency: int, document: int, number: int, replacement: Bet = None) -> bool:
+    if not os.path.exists(STORAGE_FILEPATH):
+        return False
+    bets = list(load_bets())
+    for i, bet in enumerate(bets):
+        if bet.agency == agency and int(bet.document) == document and bet.number == number:
+            bets[i:i+1] = [replacement] if replacement else []
+            break
+    else:
+        return False
+
+    temporary_filepath = STORAGE_FILEPATH + ".tmp"
+    with open(temporary_filepath, 'w') as file:
+        writer = csv.writer(file, quoting=csv.QUOTE_MINIMAL)
+        for bet in bets:
+            writer.writerow(_bet_row(bet))
+    os.replace(temporary_filepath, STORAGE_FILEPATH)
+    return True
+
+def _bet_row(bet: Bet) -> list:
+    return [bet.agency, bet.first_name, bet.last_name, bet.document, bet.birthdate, bet.number]
 
 """
 Loads the information all the bets in the STORAGE_FILEPATH file.
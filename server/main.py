@@ -2,9 +2,11 @@
 
 from configparser import ConfigParser
 from common.server import Server
+from common.auth import load_secrets
 import logging
 import os
 import signal
+import ssl
 
 def initialize_config():
     """ Parse env variables or config file to find program config params
@@ -26,6 +28,17 @@ def initialize_config():
         config_params["port"] = int(os.getenv('SERVER_PORT', config["DEFAULT"]["SERVER_PORT"]))
         config_params["listen_backlog"] = int(os.getenv('SERVER_LISTEN_BACKLOG', config["DEFAULT"]["SERVER_LISTEN_BACKLOG"]))
         config_params["logging_level"] = os.getenv('LOGGING_LEVEL', config["DEFAULT"]["LOGGING_LEVEL"])
+        config_params["tls_cert_file"] = os.getenv('SERVER_TLS_CERT_FILE', config["DEFAULT"].get("SERVER_TLS_CERT_FILE", ""))
+        config_params["tls_key_file"] = os.getenv('SERVER_TLS_KEY_FILE', config["DEFAULT"].get("SERVER_TLS_KEY_FILE", ""))
+        config_params["tls_ca_file"] = os.getenv('SERVER_TLS_CA_FILE', config["DEFAULT"].get("SERVER_TLS_CA_FILE", ""))
+        config_params["secrets_file"] = os.getenv('SERVER_SECRETS_FILE', config["DEFAULT"].get("SERVER_SECRETS_FILE", ""))
+        agencies = os.getenv('SERVER_AGENCIES', config["DEFAULT"].get("SERVER_AGENCIES", ""))
+        config_params["agencies"] = int(agencies) if agencies else None
+        config_params["max_batches_per_second"] = int(os.getenv('SERVER_MAX_BATCHES_PER_SECOND', config["DEFAULT"].get("SERVER_MAX_BATCHES_PER_SECOND", "0")))
+        config_params["heartbeat_interval"] = float(os.getenv('SERVER_HEARTBEAT_INTERVAL', config["DEFAULT"].get("SERVER_HEARTBEAT_INTERVAL", "5")))
+        config_params["max_missed_pongs"] = int(os.getenv('SERVER_MAX_MISSED_PONGS', config["DEFAULT"].get("SERVER_MAX_MISSED_PONGS", "3")))
+        config_params["unix_socket"] = os.getenv('SERVER_UNIX_SOCKET', config["DEFAULT"].get("SERVER_UNIX_SOCKET", ""))
+        config_params["results_page_size"] = int(os.getenv('SERVER_RESULTS_PAGE_SIZE', config["DEFAULT"].get("SERVER_RESULTS_PAGE_SIZE", "0")))
     except KeyError as e:
         raise KeyError("Key was not found. Error: {} .Aborting server".format(e))
     except ValueError as e:
@@ -47,10 +60,30 @@ def main():
                   f"listen_backlog: {listen_backlog} | logging_level: {logging_level}")
 
     # Initialize server and start server loop
-    server = Server(port, listen_backlog)
+    secrets = load_secrets(config_params["secrets_file"]) if config_params["secrets_file"] else None
+    server = Server(port, listen_backlog, initialize_ssl_context(config_params), secrets,
+                    config_params["agencies"], config_params["max_batches_per_second"],
+                    config_params["heartbeat_interval"], config_params["max_missed_pongs"],
+                    config_params["unix_socket"] or None, config_params["results_page_size"])
     signal.signal(signal.SIGTERM, lambda signum, frame: server.stop())
     server.run()
 
+def initialize_ssl_context(config_params):
+    """
+    Build the TLS context of the server, or None if no certificate is set.
+    If a CA file is set the agencies must present a certificate signed by it
+    """
+    if not config_params["tls_cert_file"]:
+        return None
+
+    context = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+    context.minimum_version = ssl.TLSVersion.TLSv1_2
+    context.load_cert_chain(config_params["tls_cert_file"], config_params["tls_key_file"] or None)
+    if config_params["tls_ca_file"]:
+        context.load_verify_locations(config_params["tls_ca_file"])
+        context.verify_mode = ssl.CERT_REQUIRED
+    return context
+
 def initialize_log(logging_level):
     """
     Python custom logging initialization
@@ -0,0 +1,185 @@
+from common import auth, communication
+from common.utils import Bet
+import base64
+import json
+import os
+import socket
+import unittest
+
+""" Golden vectors shared with the client, see client/conformance. """
+VECTORS_FILEPATH = os.path.join(os.path.dirname(__file__), '..', '..', 'client', 'conformance', 'testdata', 'vectors.json')
+
+
+class FakeSocket:
+    """ A socket that reads from a buffer and records what is sent to it. """
+    def __init__(self, data: bytes = b''):
+        self.data = data
+        self.sent = b''
+
+    def recv(self, size: int) -> bytes:
+        chunk, self.data = self.data[:size], self.data[size:]
+        return chunk
+
+    def send(self, data: bytes) -> int:
+        self.sent += data
+        return len(data)
+
+
+def load_vectors(sender: str) -> list[dict]:
+    with open(VECTORS_FILEPATH) as file:
+        return [vector for vector in json.load(file) if vector['sender'] == sender]
+
+def features_of(vector: dict) -> communication.Features:
+    return communication.Features(vector['version'], vector['capabilities'])
+
+def bets_of(message: dict) -> list[Bet]:
+    return [Bet(bet['agency'], bet['first_name'], bet['last_name'], str(bet['document']), bet['birthdate'], bet['number'])
+            for bet in message['bets']]
+
+
+@unittest.skipUnless(os.path.exists(VECTORS_FILEPATH), "golden vectors not available")
+class TestConformance(unittest.TestCase):
+
+    def test_recv_message_decodes_client_vectors(self):
+        for vector in load_vectors('client'):
+            with self.subTest(vector=vector['name']):
+                sock = FakeSocket(bytes.fromhex(vector['frame']))
+                expected = vector['message']
+                if expected['type'] == 'connect':
+                    message = communication.recv_connect_message(sock)
+                else:
+                    message = communication.recv_message(sock, features_of(vector))
+                self.assertEqual(b'', sock.data)
+                self.assertIsNotNone(message)
+                self.assertEqual(expected.get('agency', vector['agency']), message.agency())
+                self.__assert_message(expected, message)
+
+    def test_recv_message_rejects_query_dni_of_wrong_length(self):
+        vector = next(vector for vector in load_vectors('client') if vector['name'] == 'query_dni_v2')
+        frame = bytes.fromhex(vector['frame'])
+        header_length = communication.SIZE_FIELD_LENGTH + communication.TYPE_FIELD_LENGTH + features_of(vector).agency_length()
+        for body in (b'', frame[header_length:-1], frame[header_length:] + b'\x00'):
+            with self.subTest(body=body.hex()):
+                size = header_length + len(body)
+                sock = FakeSocket(size.to_bytes(communication.SIZE_FIELD_LENGTH, byteorder='big') + frame[communication.SIZE_FIELD_LENGTH:header_length] + body)
+                message = communication.recv_message(sock, features_of(vector))
+                self.assertTrue(message.is_malformed())
+
+    def __assert_message(self, expected: dict, message: communication.Message):
+        message_type = expected['type']
+        if message_type == 'connect':
+            self.assertTrue(message.is_connect())
+            self.assertEqual('version' in expected, message.negotiates)
+            if message.negotiates:
+                self.assertEqual(expected['version'], message.version)
+                self.assertEqual(expected['capabilities'], message.capabilities)
+                self.assertEqual(expected.get('session', 0), message.session)
+        elif message_type in ('bets', 'compressed_bets'):
+            self.assertTrue(message.is_bet())
+            self.assertEqual(expected.get('sequence'), message.sequence)
+            bets = [(bet.agency, bet.first_name, bet.last_name, int(bet.document), bet.birthdate.isoformat(), bet.number)
+                    for bet in message.bets()]
+            expected_bets = [(bet['agency'], bet['first_name'], bet['last_name'], bet['document'], bet['birthdate'], bet['number'])
+                             for bet in expected['bets']]
+            self.assertEqual(expected_bets, bets)
+        elif message_type == 'query_dni':
+            self.assertTrue(message.is_query_dni())
+            self.assertEqual(expected['dni'], message.document)
+        elif message_type in ('cancel_bet', 'amend_bet'):
+            self.assertTrue(message.is_cancel_bet() if message_type == 'cancel_bet' else message.is_amend_bet())
+            self.assertEqual(expected.get('sequence'), message.sequence)
+            self.assertEqual((expected['dni'], expected['number']), (message.document, message.number))
+            if message_type == 'amend_bet':
+                bet, expected_bet = message.bet, expected['bet']
+                self.assertEqual((expected_bet['agency'], expected_bet['first_name'], expected_bet['last_name'], expected_bet['document'], expected_bet['birthdate'], expected_bet['number']),
+                                 (bet.agency, bet.first_name, bet.last_name, int(bet.document), bet.birthdate.isoformat(), bet.number))
+        elif message_type == 'auth':
+            self.assertTrue(message.is_auth())
+            self.assertEqual(base64.b64decode(expected['response']), message.response)
+        else:
+            predicates = {
+                'finished': message.is_finished,
+                'consult': message.is_consult_winners,
+                'subscribe_results': message.is_subscribe_results,
+                'ping': message.is_ping,
+                'pong': message.is_pong,
+            }
+            self.assertTrue(predicates[message_type]())
+
+    def test_send_functions_encode_server_vectors(self):
+        for vector in load_vectors('server'):
+            with self.subTest(vector=vector['name']):
+                sock = FakeSocket()
+                self.__send(sock, features_of(vector), vector['message'])
+                self.assertEqual(vector['frame'], sock.sent.hex())
+
+    def __send(self, sock: FakeSocket, features: communication.Features, message: dict):
+        message_type = message['type']
+        if message_type == 'connect_ack':
+            communication.send_connect_ack(sock, message['version'], message['capabilities'])
+        elif message_type == 'confirmation':
+            communication.send_confirmation(sock, features, message.get('sequence'))
+        elif message_type == 'nack':
+            communication.send_nack(sock, features, message.get('sequence'))
+        elif message_type == 'results':
+            communication.send_winners(sock, [str(winner) for winner in message['winners']], features)
+        elif message_type == 'results_page':
+            communication.send_results_page(sock, features, message['index'], message['last'], [str(winner) for winner in message['winners']])
+        elif message_type == 'detailed_results':
+            communication.send_winning_bets(sock, bets_of(message), features)
+        elif message_type == 'detailed_results_page':
+            communication.send_detailed_results_page(sock, features, message['index'], message['last'], bets_of(message))
+        elif message_type == 'query_result':
+            communication.send_query_result(sock, features, message['dni'], message['numbers'])
+        elif message_type == 'challenge':
+            communication.send_challenge(sock, features, base64.b64decode(message['nonce']))
+        elif message_type == 'error':
+            communication.send_error(sock, features, message['reason'], message['description'])
+        else:
+            senders = {
+                'wait': communication.send_wait,
+                'auth_ok': communication.send_auth_ok,
+                'auth_failed': communication.send_auth_failed,
+                'ping': communication.send_ping,
+                'pong': communication.send_pong,
+            }
+            senders[message_type](sock, features)
+
+    def test_verify_response_accepts_auth_vector(self):
+        nonce = next(base64.b64decode(vector['message']['nonce']) for vector in load_vectors('server') if vector['name'] == 'challenge_v2')
+        vector = next(vector for vector in load_vectors('client') if vector['name'] == 'auth_v2')
+        response = base64.b64decode(vector['message']['response'])
+        self.assertTrue(auth.verify_response(vector['secret'].encode(), nonce, vector['agency'], response))
+        self.assertFalse(auth.verify_response(b'another secret', nonce, vector['agency'], response))
+        self.assertFalse(auth.verify_response(vector['secret'].encode(), nonce, vector['agency'] + 1, response))
+
+    def test_recv_message_reads_json_lines_over_a_connection(self):
+        bets_vector = next(vector for vector in load_vectors('client') if vector['name'] == 'bets_v2_prefixed_sequence')
+        connect = json.dumps({'type': 'connect', 'agency': 1, 'version': 2, 'capabilities': 0, 'session': 7}).encode() + b'\n'
+        bets = json.dumps(dict(bets_vector['message'], agency=1)).encode() + b'\n'
+        finished = json.dumps({'type': 'finished', 'agency': 1}).encode() + b'\n'
+        client, server = socket.socketpair()
+        with client, server:
+            server.settimeout(5)
+            # Several lines in a single write, and a line split across writes
+            client.sendall(connect + bets)
+            client.sendall(finished[:5])
+
+            message = communication.recv_connect_message(server)
+            self.assertTrue(message.is_connect())
+            self.assertEqual((communication.ENCODING_JSONL, 2, 7), (message.encoding, message.version, message.session))
+            features = communication.Features(message.version, message.capabilities, message.encoding)
+            message = communication.recv_message(server, features)
+            self.__assert_message(bets_vector['message'], message)
+
+            client.sendall(finished[5:] + b'["not an object"]\n')
+            self.assertTrue(communication.recv_message(server, features).is_finished())
+            self.assertIsNone(communication.recv_message(server, features))
+            # A connection closed mid line yields no message
+            client.sendall(finished[:5])
+            client.shutdown(socket.SHUT_WR)
+            self.assertIsNone(communication.recv_message(server, features))
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,134 @@
+from common.server import Server
+from common.utils import *
+import os
+import socket
+import threading
+import time
+import unittest
+
+""" Legacy connect message of agency 1. """
+LEGACY_CONNECT = bytes.fromhex('00040a01')
+""" Connect message of agency 1 proposing sequence numbers and corrections, and its answer. """
+CORRECTIONS_CONNECT = bytes.fromhex('000b0a0102000002100001')
+CORRECTIONS_CONNECT_ACK = bytes.fromhex('00090b02000002100a')
+""" Consult of the winners of agency 1 and the answer while the draw is pending. """
+CONSULT_WINNERS = bytes.fromhex('00041701')
+WAIT = bytes.fromhex('0004190a')
+""" Connect messages of agency 1 like CORRECTIONS_CONNECT in the given session of sequence numbers. """
+def session_connect(session: int) -> bytes:
+    return bytes.fromhex('000f0a0102000002100001') + session.to_bytes(4, byteorder='big')
+""" Batch numbered 1 with bet 7574 of document 30904465, and its confirmation. """
+BET_BATCH = bytes.fromhex('002d0e0001000000011d960000000001d79091110307cf53616e746961676f204c696f6e656c7c4c6f7263617c')
+BET_BATCH_CONFIRMATION = bytes.fromhex('000815000000010a')
+""" Cancel of bet 7574 of document 30904465 numbered 7, and its confirmation. """
+CANCEL_BET = bytes.fromhex('0013110001000000071d960000000001d79091')
+CANCEL_BET_CONFIRMATION = bytes.fromhex('000815000000070a')
+""" Cancel of bet 7574 of document 30904465 numbered 1, confirmed like BET_BATCH. """
+FIRST_CANCEL_BET = bytes.fromhex('0013110001000000011d960000000001d79091')
+
+
+class TestServer(unittest.TestCase):
+
+    def setUp(self):
+        self.server = Server(0, 5, agencies=1)
+        self.port = self.server._server_socket.getsockname()[1]
+        self.thread = threading.Thread(target=self.server.run)
+        self.thread.start()
+
+    def tearDown(self):
+        if self.thread.is_alive():
+            self.server.stop()
+            self.thread.join(5)
+        if os.path.exists(STORAGE_FILEPATH):
+            os.remove(STORAGE_FILEPATH)
+
+    def __connect(self, connect: bytes = LEGACY_CONNECT) -> socket.socket:
+        sock = socket.create_connection(('127.0.0.1', self.port))
+        sock.settimeout(5)
+        sock.sendall(connect)
+        return sock
+
+    def __recv(self, sock: socket.socket, size: int) -> bytes:
+        data = b''
+        while len(data) < size:
+            chunk = sock.recv(size - len(data))
+            if not chunk:
+                break
+            data += chunk
+        return data
+
+    def __wait_connections(self, count: int):
+        for _ in range(100):
+            if len(self.server.registed_connections) == count:
+                return
+            time.sleep(0.01)
+        self.fail(f"expected {count} registered connections, got {len(self.server.registed_connections)}")
+
+    def test_stop_closes_main_connection_after_side_connection(self):
+        main = self.__connect()
+        self.__wait_connections(1)
+        # A side connection of the same agency, like the ones used to query
+        # or correct bets, must not replace the main one
+        side = self.__connect()
+        self.__wait_connections(2)
+        side.close()
+        self.__wait_connections(1)
+
+        self.server.stop()
+        self.thread.join(5)
+        self.assertFalse(self.thread.is_alive())
+        main.settimeout(5)
+        self.assertEqual(b'', main.recv(1))
+        main.close()
+
+    def test_retransmitted_correction_is_confirmed_again(self):
+        store_bets([Bet('1', 'Santiago Lionel', 'Lorca', '30904465', '1999-03-17', 7574)])
+        sock = self.__connect(CORRECTIONS_CONNECT)
+        self.assertEqual(CORRECTIONS_CONNECT_ACK, self.__recv(sock, len(CORRECTIONS_CONNECT_ACK)))
+
+        sock.sendall(CANCEL_BET)
+        self.assertEqual(CANCEL_BET_CONFIRMATION, self.__recv(sock, len(CANCEL_BET_CONFIRMATION)))
+        self.assertEqual([], list(load_bets()))
+        # The bet is gone, but the retransmission was already applied
+        sock.sendall(CANCEL_BET)
+        self.assertEqual(CANCEL_BET_CONFIRMATION, self.__recv(sock, len(CANCEL_BET_CONFIRMATION)))
+        sock.close()
+
+    def __send_batch(self, connect: bytes):
+        sock = self.__connect(connect)
+        self.assertEqual(CORRECTIONS_CONNECT_ACK, self.__recv(sock, len(CORRECTIONS_CONNECT_ACK)))
+        sock.sendall(BET_BATCH)
+        self.assertEqual(BET_BATCH_CONFIRMATION, self.__recv(sock, len(BET_BATCH_CONFIRMATION)))
+        sock.close()
+
+    def test_sequence_numbers_start_again_on_each_session(self):
+        self.__send_batch(session_connect(1))
+        # A client that reconnects keeps its session, so the batch is a retransmission
+        self.__send_batch(session_connect(1))
+        self.assertEqual(1, len(list(load_bets())))
+
+        # A new client numbers its batches from 1 again
+        self.__send_batch(session_connect(2))
+        self.assertEqual(2, len(list(load_bets())))
+    def test_correction_numbered_like_an_applied_batch_is_applied(self):
+        self.__send_batch(CORRECTIONS_CONNECT)
+        self.assertEqual(1, len(list(load_bets())))
+
+        # Corrections sent on a side connection are numbered from 1 as well
+        side = self.__connect(CORRECTIONS_CONNECT)
+        self.assertEqual(CORRECTIONS_CONNECT_ACK, self.__recv(side, len(CORRECTIONS_CONNECT_ACK)))
+        side.sendall(FIRST_CANCEL_BET)
+        self.assertEqual(BET_BATCH_CONFIRMATION, self.__recv(side, len(BET_BATCH_CONFIRMATION)))
+        side.close()
+        self.assertEqual([], list(load_bets()))
+
+    def test_consult_before_the_draw_is_told_to_wait(self):
+        sock = self.__connect()
+        for _ in range(2):
+            sock.sendall(CONSULT_WINNERS)
+            self.assertEqual(WAIT, self.__recv(sock, len(WAIT)))
+        sock.close()
+
+
+if __name__ == '__main__':
+    unittest.main()